@@ -15,21 +15,21 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/containerd/containerd/sys/reaper"
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/oklog/run"
@@ -37,19 +37,24 @@ import (
 	parcadebuginfo "github.com/parca-dev/parca/pkg/debuginfo"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	commonconfig "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/parca-dev/parca-agent/pkg/agent"
+	"github.com/parca-dev/parca-agent/pkg/api"
+	"github.com/parca-dev/parca-agent/pkg/config"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
 	"github.com/parca-dev/parca-agent/pkg/discovery"
+	"github.com/parca-dev/parca-agent/pkg/ksym"
 	"github.com/parca-dev/parca-agent/pkg/logger"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/pprofui"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
 	"github.com/parca-dev/parca-agent/pkg/target"
 	"github.com/parca-dev/parca-agent/pkg/template"
 )
@@ -62,36 +67,220 @@ var (
 )
 
 type flags struct {
-	LogLevel           string            `kong:"enum='error,warn,info,debug',help='Log level.',default='info'"`
-	HttpAddress        string            `kong:"help='Address to bind HTTP server to.',default=':7071'"`
-	Node               string            `kong:"required,help='Name node the process is running on. If on Kubernetes, this must match the Kubernetes node name.'"`
-	ExternalLabel      map[string]string `kong:"help='Label(s) to attach to all profiles.'"`
-	StoreAddress       string            `kong:"help='gRPC address to send profiles and symbols to.'"`
-	BearerToken        string            `kong:"help='Bearer token to authenticate with store.'"`
-	BearerTokenFile    string            `kong:"help='File to read bearer token from to authenticate with store.'"`
-	Insecure           bool              `kong:"help='Send gRPC requests via plaintext instead of TLS.'"`
-	InsecureSkipVerify bool              `kong:"help='Skip TLS certificate verification.'"`
-	SamplingRatio      float64           `kong:"help='Sampling ratio to control how many of the discovered targets to profile. Defaults to 1.0, which is all.',default='1.0'"`
-	Kubernetes         bool              `kong:"help='Discover containers running on this node to profile automatically.',default='true'"`
-	PodLabelSelector   string            `kong:"help='Label selector to control which Kubernetes Pods to select.'"`
-	SystemdUnits       []string          `kong:"help='systemd units to profile on this node.'"`
-	TempDir            string            `kong:"help='Temporary directory path to use for object files.',default='/tmp'"`
-	SocketPath         string            `kong:"help='The filesystem path to the container runtimes socket. Leave this empty to use the defaults.'"`
-	ProfilingDuration  time.Duration     `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
-	SystemdCgroupPath  string            `kong:"help='The cgroupfs path to a systemd slice.'"`
+	LogLevel               string             `kong:"enum='error,warn,info,debug',help='Log level.',default='info'"`
+	HttpAddress            string             `kong:"help='Address to bind HTTP server to.',default=':7071'"`
+	ConfigPath             string             `kong:"help='Path to a YAML file configuring the external labels, stores, discovery, relabeling and profiling duration, instead of the flags. It is reloaded on SIGHUP or a POST request to /-/reload.'"`
+	Node                   string             `kong:"required,help='Name node the process is running on. If on Kubernetes, this must match the Kubernetes node name.'"`
+	ExternalLabel          map[string]string  `kong:"help='Label(s) to attach to all profiles.'"`
+	StoreAddress           string             `kong:"help='gRPC address to send profiles and symbols to.'"`
+	BearerToken            string             `kong:"help='Bearer token to authenticate with store.'"`
+	BearerTokenFile        string             `kong:"help='File to read bearer token from to authenticate with store.'"`
+	Insecure               bool               `kong:"help='Send gRPC requests via plaintext instead of TLS.'"`
+	InsecureSkipVerify     bool               `kong:"help='Skip TLS certificate verification.'"`
+	StoreConfigFile        string             `kong:"help='Path to a YAML file describing additional stores to send profiles to. Debug information is only uploaded to the first configured store.'"`
+	BatchMaxBytes          int                `kong:"help='Maximum number of raw profile bytes to buffer between writes to the store. Set to 0 to disable the limit.',default='67108864'"`
+	BatchMaxSeries         int                `kong:"help='Maximum number of series to buffer between writes to the store. Set to 0 to disable the limit.',default='10000'"`
+	MaxMessageSize         int                `kong:"help='Maximum size in bytes of a single write request sent to the store.',default='4194304'"`
+	BatchMode              string             `kong:"enum='raw,merged',help='Whether to send every raw profile of a series (raw) or to merge them into one profile per series and write (merged).',default='raw'"`
+	ProfileBufferSize      int                `kong:"help='Number of recent profiles of each series to keep in memory for querying them through the HTTP endpoints. Set to 0 to disable.',default='6'"`
+	LocalStoreAddress      string             `kong:"help='Address to accept profiles pushed by local applications on, either host:port or unix:///path/to/socket. The labels of the node and of the target the pushing process belongs to are attached. Disabled if empty.'"`
+	SamplingRatio          float64            `kong:"help='Sampling ratio to control how many of the discovered targets to profile. Defaults to 1.0, which is all. Targets are selected by a hash of the labels identifying their workload, so that the same workloads are profiled across restarts and nodes.',default='1.0'"`
+	SamplingLabels         []string           `kong:"help='Labels of the targets to hash to select the targets to profile. Defaults to namespace, workload_kind, workload_name, container, systemd_unit and executable, which identify the workload of a target.'"`
+	SamplingNamespaceRatio map[string]float64 `kong:"help='Sampling ratio of the targets of the given Kubernetes namespaces, instead of --sampling-ratio.'"`
+	Kubernetes             bool               `kong:"help='Discover containers running on this node to profile automatically.',default='true'"`
+	PodLabelSelector       string             `kong:"help='Label selector to control which Kubernetes Pods to select.'"`
+	PodLabels              map[string]string  `kong:"help='Pod labels to attach to the targets of their containers, mapped to the label names to attach them as, for example app.kubernetes.io/name=app. Names are sanitized if the label name is empty.'"`
+	PodAnnotations         map[string]string  `kong:"help='Pod annotations to attach to the targets of their containers, mapped to the label names to attach them as. Names are sanitized if the label name is empty.'"`
+	PodOptIn               bool               `kong:"help='Only profile the pods annotated with parca.dev/profile=true, instead of all pods not annotated with parca.dev/profile=false.'"`
+	PodImageLabels         []string           `kong:"help='Labels to attach the images of the containers of pods as, out of image, image_tag and image_digest.',default='image,image_tag,image_digest'"`
+	KubeletURL             string             `kong:"help='URL of the kubelet of this node to discover pods from, such as https://127.0.0.1:10250, instead of the Kubernetes API server.'"`
+	KubeletTokenFile       string             `kong:"help='File with the bearer token to authenticate to the kubelet with.',default='/var/run/secrets/kubernetes.io/serviceaccount/token'"`
+	KubeletCAFile          string             `kong:"help='CA certificate to verify the serving certificate of the kubelet with.',default='/var/run/secrets/kubernetes.io/serviceaccount/ca.crt'"`
+	KubeletInsecureTLS     bool               `kong:"help='Skip verifying the serving certificate of the kubelet, which is often self-signed.'"`
+	KubeletRefresh         time.Duration      `kong:"help='Interval to list the pods of the kubelet at.',default='10s'"`
+	SystemdUnits           []string           `kong:"help='systemd units to profile on this node.'"`
+	Docker                 bool               `kong:"help='Discover the containers of the Docker daemon on this node, for hosts without Kubernetes.'"`
+	DockerSocketPath       string             `kong:"help='The filesystem path to the Docker socket. Leave this empty to use the default.'"`
+	ContainerdNamespaces   []string           `kong:"help='containerd namespaces to discover the containers of, for hosts without Kubernetes.'"`
+	ContainerdSocketPath   string             `kong:"help='The filesystem path to the containerd socket. Leave this empty to use the default.'"`
+	ContainerdRefresh      time.Duration      `kong:"help='Interval to list the containers of the containerd namespaces at, in addition to listing them when tasks start or exit.',default='5s'"`
+	ContainerLabels        []string           `kong:"help='Labels of Docker and containerd containers to attach to their targets, as container_label_<name>.'"`
+	ContainerImageLabels   []string           `kong:"help='Labels to attach the images of Docker and containerd containers as, out of image, image_tag and image_digest.',default='image,image_tag,image_digest'"`
+	ProcessExecutable      string             `kong:"help='Profile the processes whose executable path matches this glob pattern, rather than cgroups.'"`
+	ProcessCmdline         string             `kong:"help='Profile the processes whose space separated command line matches this regex, rather than cgroups.'"`
+	ProcessUser            string             `kong:"help='Profile the processes of this user name or ID, rather than cgroups.'"`
+	ProcessParent          string             `kong:"help='Profile the processes whose parent executable path matches this glob pattern, rather than cgroups.'"`
+	ProcessRefresh         time.Duration      `kong:"help='Interval to scan for processes to profile at.',default='5s'"`
+	RelabelConfigFile      string             `kong:"help='Path to a YAML file with the relabel configurations to apply to the targets of each discovery mechanism.'"`
+	HostProfiling          bool               `kong:"help='Profile all processes of the node, including kernel threads, instead of each target on its own. Samples are attributed to the discovered target each process belongs to, or sent with the unattributed and comm labels.'"`
+	FileSDFiles            []string           `kong:"help='Files to read targets from, in the format of Prometheus file_sd_configs. Each target must have a __cgroup_path__ label. Globs are supported.'"`
+	FileSDRefresh          time.Duration      `kong:"help='Interval to re-read target files at, in addition to re-reading them on changes.',default='5m'"`
+	TempDir                string             `kong:"help='Temporary directory path to use for object files.',default='/tmp'"`
+	SocketPath             string             `kong:"help='The filesystem path to the container runtimes socket. Leave this empty to use the defaults.'"`
+	ProfilingDuration      time.Duration      `kong:"help='The agent profiling duration to use. Leave this empty to use the defaults.',default='10s'"`
+	SystemdCgroupPath      string             `kong:"help='The cgroupfs path to a systemd slice.'"`
 }
 
-func externalLabels(flagExternalLabels map[string]string, flagNode string) model.LabelSet {
-	if flagExternalLabels == nil {
-		flagExternalLabels = map[string]string{}
+func externalLabels(labels model.LabelSet, node string) model.LabelSet {
+	externalLabels := labels.Clone()
+	if externalLabels == nil {
+		externalLabels = model.LabelSet{}
 	}
-	flagExternalLabels["node"] = flagNode
+	externalLabels["node"] = model.LabelValue(node)
+	return externalLabels
+}
 
-	externalLabels := model.LabelSet{"node": model.LabelValue(flagNode)}
-	for k, v := range flagExternalLabels {
-		externalLabels[model.LabelName(k)] = model.LabelValue(v)
+// configFromFlags returns the configuration described by the flags, for when
+// no configuration file is given.
+func configFromFlags(flags flags) (*config.Config, error) {
+	cfg := config.DefaultConfig
+	cfg.Profiling.Duration = model.Duration(flags.ProfilingDuration)
+
+	cfg.ExternalLabels = model.LabelSet{}
+	for k, v := range flags.ExternalLabel {
+		cfg.ExternalLabels[model.LabelName(k)] = model.LabelValue(v)
 	}
-	return externalLabels
+
+	cfg.Sampling = &target.SamplingConfig{
+		Ratio:           flags.SamplingRatio,
+		Labels:          flags.SamplingLabels,
+		NamespaceRatios: flags.SamplingNamespaceRatio,
+	}
+
+	if len(flags.StoreAddress) > 0 {
+		cfg.Stores = append(cfg.Stores, &agent.StoreConfig{
+			Name:            "default",
+			Address:         flags.StoreAddress,
+			BearerToken:     commonconfig.Secret(flags.BearerToken),
+			BearerTokenFile: flags.BearerTokenFile,
+			Insecure:        flags.Insecure,
+			TLSConfig:       commonconfig.TLSConfig{InsecureSkipVerify: flags.InsecureSkipVerify},
+		})
+	}
+	if len(flags.StoreConfigFile) > 0 {
+		fileStores, err := agent.LoadStoreConfigs(flags.StoreConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Stores = append(cfg.Stores, fileStores...)
+	}
+
+	if flags.Kubernetes {
+		kubernetes := &config.KubernetesConfig{
+			PodLabelSelector: flags.PodLabelSelector,
+			SocketPath:       flags.SocketPath,
+			PodLabels:        flags.PodLabels,
+			PodAnnotations:   flags.PodAnnotations,
+			OptIn:            flags.PodOptIn,
+			ImageLabels:      flags.PodImageLabels,
+		}
+		if flags.KubeletURL != "" {
+			kubelet := config.DefaultKubeletConfig
+			kubelet.URL = flags.KubeletURL
+			kubelet.RefreshInterval = model.Duration(flags.KubeletRefresh)
+			kubelet.HTTPClientConfig.BearerTokenFile = flags.KubeletTokenFile
+			kubelet.HTTPClientConfig.TLSConfig = commonconfig.TLSConfig{InsecureSkipVerify: flags.KubeletInsecureTLS}
+			if !flags.KubeletInsecureTLS {
+				kubelet.HTTPClientConfig.TLSConfig.CAFile = flags.KubeletCAFile
+			}
+			kubernetes.Kubelet = &kubelet
+		}
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name:       "pod",
+			Kubernetes: kubernetes,
+		})
+	}
+
+	if len(flags.SystemdUnits) > 0 {
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name: "systemd",
+			Systemd: &config.SystemdConfig{
+				Units:      flags.SystemdUnits,
+				CgroupPath: flags.SystemdCgroupPath,
+			},
+		})
+	}
+
+	if flags.Docker {
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name: "docker",
+			Docker: &config.DockerConfig{
+				SocketPath:      flags.DockerSocketPath,
+				ContainerLabels: flags.ContainerLabels,
+				ImageLabels:     flags.ContainerImageLabels,
+			},
+		})
+	}
+
+	if len(flags.ContainerdNamespaces) > 0 {
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name: "containerd",
+			Containerd: &config.ContainerdConfig{
+				SocketPath:      flags.ContainerdSocketPath,
+				Namespaces:      flags.ContainerdNamespaces,
+				ContainerLabels: flags.ContainerLabels,
+				ImageLabels:     flags.ContainerImageLabels,
+				RefreshInterval: model.Duration(flags.ContainerdRefresh),
+			},
+		})
+	}
+
+	process := config.ProcessConfig{
+		Executable:      flags.ProcessExecutable,
+		Cmdline:         flags.ProcessCmdline,
+		User:            flags.ProcessUser,
+		Parent:          flags.ProcessParent,
+		RefreshInterval: model.Duration(flags.ProcessRefresh),
+	}
+	if process.Executable != "" || process.Cmdline != "" || process.User != "" || process.Parent != "" {
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name:    "process",
+			Process: &process,
+		})
+	}
+
+	if len(flags.FileSDFiles) > 0 {
+		cfg.DiscoveryConfigs = append(cfg.DiscoveryConfigs, &config.DiscoveryConfig{
+			Name: "file",
+			File: &config.FileConfig{
+				Files:           flags.FileSDFiles,
+				RefreshInterval: model.Duration(flags.FileSDRefresh),
+			},
+		})
+	}
+
+	if flags.RelabelConfigFile != "" {
+		relabelConfigs, err := target.LoadRelabelConfigs(flags.RelabelConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("load relabel config: %w", err)
+		}
+		for _, dc := range cfg.DiscoveryConfigs {
+			dc.RelabelConfigs = relabelConfigs[dc.Name]
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyConfig applies the targets, relabeling and profiling configuration to
+// the target manager, and the discovery configuration to the discovery
+// manager.
+func applyConfig(cfg *config.Config, node string, m *discovery.Manager, tm *target.Manager) error {
+	names := make([]string, 0, len(cfg.DiscoveryConfigs))
+	for _, dc := range cfg.DiscoveryConfigs {
+		names = append(names, dc.Name)
+	}
+	tm.ApplyConfig(
+		names,
+		time.Duration(cfg.Profiling.Duration),
+		externalLabels(cfg.ExternalLabels, node),
+		cfg.RelabelConfigs(),
+		cfg.SamplingConfigs(),
+	)
+	return m.ApplyConfig(cfg.DiscoveryManagerConfigs(node))
 }
 
 func main() {
@@ -118,52 +307,105 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	profileStoreClient := agent.NewNoopProfileStoreClient()
-	debugInfoClient := debuginfo.NewNoopClient()
+	var (
+		cfg *config.Config
+		err error
+	)
+	if flags.ConfigPath != "" {
+		cfg, err = config.Load(flags.ConfigPath)
+	} else {
+		cfg, err = configFromFlags(flags)
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to load config", "err", err)
+		os.Exit(1)
+	}
+	// Stores are set up once, changes to them take effect on restart.
+	stores := cfg.Stores
 
-	if len(flags.StoreAddress) > 0 {
-		conn, err := grpcConn(reg, flags)
+	met := grpc_prometheus.NewClientMetrics()
+	met.EnableClientHandlingTimeHistogram()
+	reg.MustRegister(met)
+
+	var (
+		debugInfoClient = debuginfo.NewNoopClient()
+		batchers        = make([]*agent.Batcher, 0, len(stores))
+		storeWriters    = make([]*agent.StoreWriter, 0, len(stores))
+	)
+	for i, store := range stores {
+		conn, err := agent.DialStore(store, met)
 		if err != nil {
 			level.Error(logger).Log("err", err)
 			os.Exit(1)
 		}
 
-		// Initialize actual clients with the connection.
-		profileStoreClient = profilestorepb.NewProfileStoreServiceClient(conn)
-		debugInfoClient = parcadebuginfo.NewDebugInfoClient(conn)
-	}
+		// Debug information is only uploaded to the first store.
+		if i == 0 {
+			debugInfoClient = parcadebuginfo.NewDebugInfoClient(conn)
+		}
 
-	var (
-		configs discovery.Configs
+		// Every store gets its own queue, so that a slow or failing store
+		// does not hold back the others.
 		// TODO(Sylfrena): Make ticker duration configurable
-		batchWriteClient = agent.NewBatchWriteClient(logger, profileStoreClient, 10*time.Second)
-		profileListener  = agent.NewProfileListener(logger, batchWriteClient)
-	)
-
-	if flags.Kubernetes {
-		configs = append(configs, discovery.NewPodConfig(
-			flags.PodLabelSelector,
-			flags.SocketPath,
-			flags.Node,
-		))
-	}
-
-	if len(flags.SystemdUnits) > 0 {
-		configs = append(configs, discovery.NewSystemdConfig(
-			flags.SystemdUnits,
-			flags.SystemdCgroupPath,
-		))
+		storeReg := prometheus.WrapRegistererWith(prometheus.Labels{"store": store.Name}, reg)
+		batcher := agent.NewBatchWriteClient(
+			log.With(logger, "store", store.Name),
+			storeReg,
+			profilestorepb.NewProfileStoreServiceClient(conn),
+			10*time.Second,
+			flags.BatchMaxBytes,
+			flags.BatchMaxSeries,
+			flags.MaxMessageSize,
+			agent.BatchMode(flags.BatchMode),
+		)
+		batchers = append(batchers, batcher)
+
+		var storeClient profilestorepb.ProfileStoreServiceClient = batcher
+		if store.HasTenants() {
+			storeClient = agent.NewTenantRouter(store, batcher)
+		}
+		storeWriters = append(storeWriters, agent.NewStoreWriter(storeReg, store, storeClient))
 	}
+	profileListener := agent.NewProfileListener(logger, agent.NewFanoutClient(storeWriters...), flags.ProfileBufferSize)
 
+	profilerMetrics := profiler.NewMetrics(reg)
 	tm := target.NewManager(
-		logger, reg,
+		logger, profilerMetrics,
 		profileListener, debugInfoClient,
-		flags.ProfilingDuration,
-		externalLabels(flags.ExternalLabel, flags.Node),
+		time.Duration(cfg.Profiling.Duration),
+		externalLabels(cfg.ExternalLabels, flags.Node),
 		flags.TempDir,
+		flags.HostProfiling,
+		cfg.RelabelConfigs(),
+		cfg.SamplingConfigs(),
 	)
 
 	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.Handle("/pprof/", http.StripPrefix("/pprof", pprofui.NewHandler(log.With(logger, "component", "pprofui"), profileListener)))
+	mux.Handle("/api/v1/targets", api.NewTargetsHandler(log.With(logger, "component", "api"), tm))
+	mux.Handle("/report/", http.StripPrefix("/report", pprofui.NewReportHandler(log.With(logger, "component", "report"), profileListener)))
+	// Reload requests are served by the configuration reload run group, which
+	// sends back the result of the reload.
+	reloadCh := make(chan chan error)
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests reload the configuration.", http.StatusMethodNotAllowed)
+			return
+		}
+		if flags.ConfigPath == "" {
+			http.Error(w, "No configuration file to reload, the configuration is set by flags.", http.StatusBadRequest)
+			return
+		}
+		errc := make(chan error)
+		select {
+		case reloadCh <- errc:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-errc; err != nil {
+			http.Error(w, "Failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -197,7 +439,6 @@ func main() {
 					sort.Sort(labelSet)
 
 					q := url.Values{}
-					q.Add("debug", "1")
 					q.Add("query", labelSet.String())
 
 					statusPage.ActiveProfilers = append(statusPage.ActiveProfilers, template.ActiveProfiler{
@@ -205,7 +446,7 @@ func main() {
 						Labels:       labelSet,
 						LastTakenAgo: time.Since(profiler.LastProfileTakenAt()),
 						Error:        profiler.LastError(),
-						Link:         fmt.Sprintf("/query?%s", q.Encode()),
+						Link:         fmt.Sprintf("/pprof/flamegraph?%s", q.Encode()),
 					})
 				}
 			}
@@ -231,6 +472,56 @@ func main() {
 				return len(a)-len(b) < 0
 			})
 
+			for name, targets := range tm.SampledOutTargets() {
+				for _, t := range targets {
+					labelSet := labels.Labels{}
+					for name, value := range t.Labels() {
+						labelSet = append(labelSet, labels.Label{Name: string(name), Value: string(value)})
+					}
+					sort.Sort(labelSet)
+
+					statusPage.SampledOutTargets = append(statusPage.SampledOutTargets, template.SampledOutTarget{
+						DiscoveryConfig: name,
+						Labels:          labelSet,
+					})
+				}
+			}
+			sort.Slice(statusPage.SampledOutTargets, func(j, k int) bool {
+				a, b := statusPage.SampledOutTargets[j], statusPage.SampledOutTargets[k]
+				if a.DiscoveryConfig != b.DiscoveryConfig {
+					return a.DiscoveryConfig < b.DiscoveryConfig
+				}
+				return labels.Compare(a.Labels, b.Labels) < 0
+			})
+
+			for name, targets := range tm.DroppedTargets() {
+				for _, t := range targets {
+					if t.Error() == "" {
+						continue
+					}
+					labelSet := labels.Labels{}
+					for name, value := range t.DiscoveredLabels() {
+						if !strings.HasPrefix(string(name), "__") {
+							labelSet = append(labelSet, labels.Label{Name: string(name), Value: string(value)})
+						}
+					}
+					sort.Sort(labelSet)
+
+					statusPage.FailedTargets = append(statusPage.FailedTargets, template.FailedTarget{
+						DiscoveryConfig: name,
+						Labels:          labelSet,
+						Error:           t.Error(),
+					})
+				}
+			}
+			sort.Slice(statusPage.FailedTargets, func(j, k int) bool {
+				a, b := statusPage.FailedTargets[j], statusPage.FailedTargets[k]
+				if a.DiscoveryConfig != b.DiscoveryConfig {
+					return a.DiscoveryConfig < b.DiscoveryConfig
+				}
+				return labels.Compare(a.Labels, b.Labels) < 0
+			})
+
 			err := template.StatusPageTemplate.Execute(w, statusPage)
 			if err != nil {
 				http.Error(w,
@@ -242,49 +533,17 @@ func main() {
 			return
 		}
 
-		if strings.HasPrefix(r.URL.Path, "/query") {
-			ctx := r.Context()
-			query := r.URL.Query().Get("query")
-			matchers, err := parser.ParseMetricSelector(query)
-			if err != nil {
-				http.Error(w,
-					`query incorrectly formatted, expecting selector in form of: {name1="value1",name2="value2"}`,
-					http.StatusBadRequest,
-				)
+		if strings.HasPrefix(r.URL.Path, "/query") || strings.HasPrefix(r.URL.Path, "/diff") {
+			if r.URL.Query().Get("debug") == "1" {
+				q := r.URL.Query()
+				q.Del("debug")
+				http.Redirect(w, r, "/pprof/?"+q.Encode(), http.StatusFound)
 				return
 			}
 
-			// We profile every 10 seconds so leaving 1s wiggle room. If after
-			// 11s no profile has matched, then there is very likely no
-			// profiler running that matches the label-set.
-			ctx, cancel := context.WithTimeout(ctx, time.Second*11)
-			defer cancel()
-
-			profile, err := profileListener.NextMatchingProfile(ctx, matchers)
-			if profile == nil || err == context.Canceled {
-				http.Error(w,
-					"No profile taken in the last 11 seconds that matches the requested label-matchers query. "+
-						"Profiles are taken every 10 seconds so either the profiler matching the label-set has stopped profiling, "+
-						"or the label-set was incorrect.",
-					http.StatusNotFound,
-				)
-				return
-			}
+			profile, err := pprofui.FetchProfile(profileListener, r, strings.HasPrefix(r.URL.Path, "/diff"))
 			if err != nil {
-				http.Error(w, "Unexpected error occurred: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			v := r.URL.Query().Get("debug")
-			if v == "1" {
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				q := url.Values{}
-				q.Add("query", query)
-
-				fmt.Fprintf(w, "<p><a href='/query?%s'>Download Pprof</a></p>\n", q.Encode())
-				fmt.Fprint(w, "<code><pre>\n")
-				fmt.Fprint(w, profile.String())
-				fmt.Fprint(w, "\n</pre></code>")
+				pprofui.WriteError(w, err)
 				return
 			}
 
@@ -332,11 +591,13 @@ func main() {
 		})
 	}
 
-	{
+	for i := range batchers {
+		batcher := batchers[i]
+		store := stores[i]
 		ctx, cancel := context.WithCancel(ctx)
 		g.Add(func() error {
-			level.Debug(logger).Log("msg", "starting batch write client")
-			return batchWriteClient.Run(ctx)
+			level.Debug(logger).Log("msg", "starting batch write client", "store", store.Name)
+			return batcher.Run(ctx)
 		}, func(error) {
 			cancel()
 		})
@@ -348,23 +609,9 @@ func main() {
 		ctx, cancel := context.WithCancel(ctx)
 		reg := prometheus.NewRegistry()
 		m = discovery.NewManager(ctx, logger, reg)
-		var err error
-		if len(flags.SystemdUnits) > 0 {
-			err = m.ApplyConfig(map[string]discovery.Configs{"systemd": configs})
-
-			if err != nil {
-				level.Error(logger).Log("err", err)
-				os.Exit(1)
-			}
-		}
-
-		if flags.Kubernetes {
-			err = m.ApplyConfig(map[string]discovery.Configs{"pod": configs})
-
-			if err != nil {
-				level.Error(logger).Log("err", err)
-				os.Exit(1)
-			}
+		if err := m.ApplyConfig(cfg.DiscoveryManagerConfigs(flags.Node)); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
 		}
 
 		g.Add(func() error {
@@ -386,6 +633,127 @@ func main() {
 		})
 	}
 
+	// Run group for configuration reloads
+	if flags.ConfigPath != "" {
+		ctx, cancel := context.WithCancel(ctx)
+		reloadSuccess := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		})
+		reloadSuccessTimestamp := promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		})
+		reloadSuccess.Set(1)
+		reloadSuccessTimestamp.SetToCurrentTime()
+
+		reload := func() error {
+			newCfg, err := config.Load(flags.ConfigPath)
+			if err != nil {
+				reloadSuccess.Set(0)
+				return err
+			}
+			if !reflect.DeepEqual(newCfg.Stores, stores) {
+				level.Warn(logger).Log("msg", "changes to the stores take effect on restart")
+			}
+			if err := applyConfig(newCfg, flags.Node, m, tm); err != nil {
+				reloadSuccess.Set(0)
+				return err
+			}
+			reloadSuccess.Set(1)
+			reloadSuccessTimestamp.SetToCurrentTime()
+			level.Info(logger).Log("msg", "configuration reloaded", "file", flags.ConfigPath)
+			return nil
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, unix.SIGHUP)
+		g.Add(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-hup:
+					if err := reload(); err != nil {
+						level.Error(logger).Log("msg", "failed to reload configuration", "err", err)
+					}
+				case errc := <-reloadCh:
+					err := reload()
+					if err != nil {
+						level.Error(logger).Log("msg", "failed to reload configuration", "err", err)
+					}
+					errc <- err
+				}
+			}
+		}, func(error) {
+			signal.Stop(hup)
+			cancel()
+		})
+	}
+
+	// Run group for host profiler
+	if flags.HostProfiling {
+		ctx, cancel := context.WithCancel(ctx)
+		hostProfiler := profiler.NewHostProfiler(
+			logger, profilerMetrics,
+			ksym.NewKsymCache(logger),
+			// An arbitrary number of object files of all processes of the node.
+			objectfile.NewCache(logger, 1024),
+			profileListener, debugInfoClient,
+			tm.ExternalLabels,
+			tm,
+			time.Duration(cfg.Profiling.Duration),
+			flags.TempDir,
+		)
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting host profiler")
+			return hostProfiler.Run(ctx)
+		}, func(error) {
+			hostProfiler.Stop()
+			cancel()
+		})
+	}
+
+	// Run group for local profile store server
+	if flags.LocalStoreAddress != "" {
+		network, address := "tcp", flags.LocalStoreAddress
+		if strings.HasPrefix(address, "unix://") {
+			network, address = "unix", strings.TrimPrefix(address, "unix://")
+			// Remove a socket left behind by a previous run.
+			if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+				level.Error(logger).Log("msg", "failed to remove stale local store socket", "err", err)
+				os.Exit(1)
+			}
+		}
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to listen for local store", "err", err)
+			os.Exit(1)
+		}
+
+		serverMet := grpc_prometheus.NewServerMetrics()
+		reg.MustRegister(serverMet)
+		srv := grpc.NewServer(
+			grpc.Creds(agent.NewPeerCredentials()),
+			grpc.MaxRecvMsgSize(flags.MaxMessageSize),
+			grpc.UnaryInterceptor(serverMet.UnaryServerInterceptor()),
+		)
+		profilestorepb.RegisterProfileStoreServiceServer(srv, agent.NewProfileStoreServer(
+			log.With(logger, "component", "local_store"),
+			profileListener,
+			tm.ExternalLabels,
+			tm,
+		))
+		serverMet.InitializeMetrics(srv)
+
+		g.Add(func() error {
+			level.Debug(logger).Log("msg", "starting local store server", "address", flags.LocalStoreAddress)
+			return srv.Serve(ln)
+		}, func(error) {
+			srv.GracefulStop()
+		})
+	}
+
 	// Run group for http server
 	{
 		ln, err := net.Listen("tcp", flags.HttpAddress)
@@ -405,58 +773,3 @@ func main() {
 		level.Error(logger).Log("err", err)
 	}
 }
-
-func grpcConn(reg prometheus.Registerer, flags flags) (*grpc.ClientConn, error) {
-	met := grpc_prometheus.NewClientMetrics()
-	met.EnableClientHandlingTimeHistogram()
-	reg.MustRegister(met)
-
-	opts := []grpc.DialOption{
-		grpc.WithUnaryInterceptor(
-			met.UnaryClientInterceptor(),
-		),
-	}
-	if flags.Insecure {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	} else {
-		config := &tls.Config{
-			InsecureSkipVerify: flags.InsecureSkipVerify,
-		}
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
-	}
-
-	if flags.BearerToken != "" {
-		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestBearerToken{
-			token:    flags.BearerToken,
-			insecure: flags.Insecure,
-		}))
-	}
-
-	if flags.BearerTokenFile != "" {
-		b, err := ioutil.ReadFile(flags.BearerTokenFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
-		}
-		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestBearerToken{
-			token:    strings.TrimSpace(string(b)),
-			insecure: flags.Insecure,
-		}))
-	}
-
-	return grpc.Dial(flags.StoreAddress, opts...)
-}
-
-type perRequestBearerToken struct {
-	token    string
-	insecure bool
-}
-
-func (t *perRequestBearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return map[string]string{
-		"authorization": "Bearer " + t.token,
-	}, nil
-}
-
-func (t *perRequestBearerToken) RequireTransportSecurity() bool {
-	return !t.insecure
-}
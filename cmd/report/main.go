@@ -0,0 +1,132 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+type reportFlags struct {
+	Query string `kong:"required,arg,name='query',help='Series selector of the profiles to report on, for example {pod=\"my-pod\"}.'"`
+
+	Start       string `kong:"help='Start of the time range, as Unix timestamp or RFC 3339 time. Defaults to the oldest profile kept by the agent.'"`
+	End         string `kong:"help='End of the time range, as Unix timestamp or RFC 3339 time. Defaults to now.'"`
+	NodeCount   int    `kong:"help='Maximum number of nodes to show. Set to 0 to show all.',default='0'"`
+	Focus       string `kong:"help='Only show samples with a frame matching this regex.'"`
+	Ignore      string `kong:"help='Drop samples with a frame matching this regex.'"`
+	Hide        string `kong:"help='Drop frames matching this regex.'"`
+	Show        string `kong:"help='Only show frames matching this regex.'"`
+	SampleIndex string `kong:"help='Sample type to report, by name or index.'"`
+	Unit        string `kong:"help='Unit to show values in, for example ms or MB.'"`
+
+	BaseQuery string `kong:"help='Series selector of the profiles to subtract. Defaults to the query if a base time range is given.'"`
+	BaseStart string `kong:"help='Start of the time range of the profiles to subtract.'"`
+	BaseEnd   string `kong:"help='End of the time range of the profiles to subtract.'"`
+	Normalize bool   `kong:"help='Scale the profiles to the total of the subtracted profiles first.'"`
+}
+
+type flags struct {
+	AgentAddress string        `kong:"help='HTTP address of the agent to query.',default='http://localhost:7071'"`
+	Timeout      time.Duration `kong:"help='Timeout of the request to the agent.',default='30s'"`
+
+	Top    reportFlags `cmd:"" help:"Show the functions with the highest flat value."`
+	Tree   reportFlags `cmd:"" help:"Show the call graph as text, with callers and callees of each function."`
+	Traces reportFlags `cmd:"" help:"Show all sampled stack traces."`
+}
+
+func main() {
+	flags := flags{}
+	kongCtx := kong.Parse(&flags)
+
+	var (
+		name = strings.Fields(kongCtx.Command())[0]
+		rf   reportFlags
+	)
+	switch name {
+	case "top":
+		rf = flags.Top
+	case "tree":
+		rf = flags.Tree
+	case "traces":
+		rf = flags.Traces
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flags.Timeout)
+	defer cancel()
+
+	if err := printReport(ctx, os.Stdout, flags.AgentAddress, name, rf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// printReport requests the named report from the agent and copies it to w.
+func printReport(ctx context.Context, w io.Writer, address, name string, rf reportFlags) error {
+	q := url.Values{}
+	q.Set("query", rf.Query)
+	params := map[string]string{
+		"start":        rf.Start,
+		"end":          rf.End,
+		"focus":        rf.Focus,
+		"ignore":       rf.Ignore,
+		"hide":         rf.Hide,
+		"show":         rf.Show,
+		"sample_index": rf.SampleIndex,
+		"unit":         rf.Unit,
+		"base_query":   rf.BaseQuery,
+		"base_start":   rf.BaseStart,
+		"base_end":     rf.BaseEnd,
+	}
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if rf.Normalize {
+		q.Set("normalize", "true")
+	}
+	if rf.NodeCount > 0 {
+		q.Set("nodecount", strconv.Itoa(rf.NodeCount))
+	}
+
+	u := strings.TrimSuffix(address, "/") + "/report/" + name + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("query agent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("query agent: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
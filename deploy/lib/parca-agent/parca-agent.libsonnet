@@ -91,6 +91,16 @@ function(params) {
         resources: ['nodes'],
         verbs: ['get'],
       },
+      {
+        apiGroups: ['apps'],
+        resources: ['replicasets'],
+        verbs: ['list', 'watch'],
+      },
+      {
+        apiGroups: ['batch'],
+        resources: ['jobs'],
+        verbs: ['list', 'watch'],
+      },
     ],
   },
 
@@ -0,0 +1,39 @@
+{
+  prometheusAlerts+:: {
+    groups+: [
+      {
+        name: 'parca-agent',
+        rules: [
+          {
+            alert: 'ParcaAgentTargetProfilingFailing',
+            expr: |||
+              max by (job, instance, target) (parca_agent_profiler_consecutive_failures{%(parcaAgentSelector)s}) >= %(consecutiveFailuresThreshold)s
+            ||| % $._config,
+            'for': '5m',
+            labels: {
+              severity: 'warning',
+            },
+            annotations: {
+              summary: 'Parca Agent fails to profile a target.',
+              description: 'Parca Agent {{ $labels.instance }} failed to profile target {{ $labels.target }} {{ $value }} times in a row.',
+            },
+          },
+          {
+            alert: 'ParcaAgentMissingStacks',
+            expr: |||
+              sum by (job, instance) (rate(parca_agent_profiler_missing_stacks_total{%(parcaAgentSelector)s}[5m])) > 0
+            ||| % $._config,
+            'for': '15m',
+            labels: {
+              severity: 'info',
+            },
+            annotations: {
+              summary: 'Parca Agent is missing stack traces.',
+              description: 'Parca Agent {{ $labels.instance }} misses {{ $value | humanize }} stacks per second.',
+            },
+          },
+        ],
+      },
+    ],
+  },
+}
@@ -0,0 +1,12 @@
+{
+  _config+:: {
+    // Selector of the Parca Agent jobs, used by all alerts and dashboards.
+    parcaAgentSelector: 'job=~"parca-agent.*"',
+
+    // Number of profiling intervals in a row a target may fail before alerting.
+    consecutiveFailuresThreshold: 5,
+
+    dashboardTags: ['parca-agent'],
+    dashboardTimezone: 'UTC',
+  },
+}
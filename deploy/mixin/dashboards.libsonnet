@@ -0,0 +1,72 @@
+local panel(title, expr, unit, legend) = {
+  type: 'timeseries',
+  title: title,
+  datasource: '$datasource',
+  fieldConfig: { defaults: { unit: unit } },
+  targets: [{ expr: expr, legendFormat: legend }],
+};
+
+{
+  grafanaDashboards+:: {
+    'parca-agent-targets.json':
+      local selector = '%(parcaAgentSelector)s, instance=~"$instance", target=~"$target"' % $._config;
+      local row(y, panels) = [
+        panels[i] { gridPos: { x: i * 12, y: y, w: 12, h: 8 } }
+        for i in std.range(0, std.length(panels) - 1)
+      ];
+      {
+        uid: 'parca-agent-targets',
+        title: 'Parca Agent / Targets',
+        tags: $._config.dashboardTags,
+        timezone: $._config.dashboardTimezone,
+        schemaVersion: 30,
+        refresh: '30s',
+        time: { from: 'now-1h', to: 'now' },
+        templating: {
+          list: [
+            {
+              name: 'datasource',
+              type: 'datasource',
+              query: 'prometheus',
+            },
+            {
+              name: 'instance',
+              type: 'query',
+              datasource: '$datasource',
+              query: 'label_values(parca_agent_profiler_consecutive_failures{%(parcaAgentSelector)s}, instance)' % $._config,
+              includeAll: true,
+              multi: true,
+              refresh: 2,
+            },
+            {
+              name: 'target',
+              type: 'query',
+              datasource: '$datasource',
+              query: 'label_values(parca_agent_profiler_consecutive_failures{%(parcaAgentSelector)s, instance=~"$instance"}, target)' % $._config,
+              includeAll: true,
+              multi: true,
+              refresh: 2,
+            },
+          ],
+        },
+        panels:
+          row(0, [
+            panel('Samples per interval', 'parca_agent_profiler_last_profile_samples{%s}' % selector, 'short', '{{target}}'),
+            panel('Distinct stacks', 'parca_agent_profiler_last_profile_stacks{%s}' % selector, 'short', '{{target}}'),
+          ]) +
+          row(8, [
+            panel('Profile size', 'parca_agent_profiler_last_profile_size_bytes{%s}' % selector, 'bytes', '{{target}}'),
+            panel('Consecutive failures', 'parca_agent_profiler_consecutive_failures{%s}' % selector, 'short', '{{target}}'),
+          ]) +
+          row(16, [
+            panel(
+              'Phase duration p99',
+              'histogram_quantile(0.99, sum by (phase, le) (rate(parca_agent_profiler_phase_duration_seconds_bucket{%s}[$__rate_interval])))' % selector,
+              's',
+              '{{phase}}',
+            ),
+            panel('Missing stacks', 'sum by (target, type) (rate(parca_agent_profiler_missing_stacks_total{%s}[$__rate_interval]))' % selector, 'short', '{{target}} {{type}}'),
+          ]),
+      },
+  },
+}
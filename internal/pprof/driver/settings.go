@@ -82,9 +82,11 @@ type configMenuEntry struct {
 func configMenu(fname string, url url.URL) []configMenuEntry {
 	// Start with system configs.
 	configs := []namedConfig{{Name: "Default", config: defaultConfig()}}
-	if settings, err := readSettings(fname); err == nil {
-		// Add user configs.
-		configs = append(configs, settings.Configs...)
+	if fname != "" {
+		if settings, err := readSettings(fname); err == nil {
+			// Add user configs.
+			configs = append(configs, settings.Configs...)
+		}
 	}
 
 	// Convert to menu entries.
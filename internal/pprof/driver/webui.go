@@ -42,11 +42,9 @@ type webInterface struct {
 	settingsFile string
 }
 
-func makeWebInterface(p *profile.Profile, opt *plugin.Options) (*webInterface, error) {
-	settingsFile, err := settingsFileName()
-	if err != nil {
-		return nil, err
-	}
+// makeWebInterface returns the web interface for p, which saves its settings
+// to settingsFile, or only has the default settings if it is empty.
+func makeWebInterface(p *profile.Profile, opt *plugin.Options, settingsFile string) *webInterface {
 	templates := template.New("templategroup")
 	addTemplates(templates)
 	report.AddSourceTemplates(templates)
@@ -56,7 +54,7 @@ func makeWebInterface(p *profile.Profile, opt *plugin.Options) (*webInterface, e
 		help:         make(map[string]string),
 		templates:    templates,
 		settingsFile: settingsFile,
-	}, nil
+	}
 }
 
 // maxEntries is the maximum number of entries to print for text interfaces.
@@ -95,20 +93,14 @@ func serveWebInterface(hostport string, p *profile.Profile, o *plugin.Options, d
 		return err
 	}
 	interactiveMode = true
-	ui, err := makeWebInterface(p, o)
+	settingsFile, err := settingsFileName()
 	if err != nil {
 		return err
 	}
-	for n, c := range pprofCommands {
-		ui.help[n] = c.description
-	}
-	for n, help := range configHelp {
-		ui.help[n] = help
-	}
-	ui.help["details"] = "Show information about the profile and this view"
-	ui.help["graph"] = "Display profile as a directed graph"
-	ui.help["reset"] = "Show the entire profile"
-	ui.help["save_config"] = "Save current settings"
+	ui := makeWebInterface(p, o, settingsFile)
+	handlers := ui.handlers()
+	handlers["/saveconfig"] = http.HandlerFunc(ui.saveConfig)
+	handlers["/deleteconfig"] = http.HandlerFunc(ui.deleteConfig)
 
 	server := o.HTTPServer
 	if server == nil {
@@ -118,21 +110,7 @@ func serveWebInterface(hostport string, p *profile.Profile, o *plugin.Options, d
 		Hostport: net.JoinHostPort(host, strconv.Itoa(port)),
 		Host:     host,
 		Port:     port,
-		Handlers: map[string]http.Handler{
-			"/":             http.HandlerFunc(ui.dot),
-			"/top":          http.HandlerFunc(ui.top),
-			"/disasm":       http.HandlerFunc(ui.disasm),
-			"/source":       http.HandlerFunc(ui.source),
-			"/peek":         http.HandlerFunc(ui.peek),
-			"/flamegraph":   http.HandlerFunc(ui.flamegraph),
-			"/saveconfig":   http.HandlerFunc(ui.saveConfig),
-			"/deleteconfig": http.HandlerFunc(ui.deleteConfig),
-			"/download": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				w.Header().Set("Content-Type", "application/vnd.google.protobuf+gzip")
-				w.Header().Set("Content-Disposition", "attachment;filename=profile.pb.gz")
-				p.Write(w)
-			}),
-		},
+		Handlers: handlers,
 	}
 
 	url := "http://" + args.Hostport
@@ -145,6 +123,45 @@ func serveWebInterface(hostport string, p *profile.Profile, o *plugin.Options, d
 	return server(args)
 }
 
+// WebHandlers returns the handlers of the web interface for p, keyed by
+// their path relative to the root the interface is served under. All pages
+// link to each other relatively, so the interface can be served under any
+// path prefix. The o.UI and o.Obj options must be set. Settings cannot be
+// saved, so only the default settings are available.
+func WebHandlers(p *profile.Profile, o *plugin.Options) map[string]http.Handler {
+	return makeWebInterface(p, o, "").handlers()
+}
+
+// handlers returns the handlers of the web interface, except the ones saving
+// settings.
+func (ui *webInterface) handlers() map[string]http.Handler {
+	p := ui.prof
+	for n, c := range pprofCommands {
+		ui.help[n] = c.description
+	}
+	for n, help := range configHelp {
+		ui.help[n] = help
+	}
+	ui.help["details"] = "Show information about the profile and this view"
+	ui.help["graph"] = "Display profile as a directed graph"
+	ui.help["reset"] = "Show the entire profile"
+	ui.help["save_config"] = "Save current settings"
+
+	return map[string]http.Handler{
+		"/":           http.HandlerFunc(ui.dot),
+		"/top":        http.HandlerFunc(ui.top),
+		"/disasm":     http.HandlerFunc(ui.disasm),
+		"/source":     http.HandlerFunc(ui.source),
+		"/peek":       http.HandlerFunc(ui.peek),
+		"/flamegraph": http.HandlerFunc(ui.flamegraph),
+		"/download": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.google.protobuf+gzip")
+			w.Header().Set("Content-Disposition", "attachment;filename=profile.pb.gz")
+			p.Write(w)
+		}),
+	}
+}
+
 func getHostAndPort(hostport string) (string, int, error) {
 	host, portStr, err := net.SplitHostPort(hostport)
 	if err != nil {
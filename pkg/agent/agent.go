@@ -21,7 +21,15 @@ import (
 	"google.golang.org/grpc"
 )
 
-const CgroupPathLabelName = model.LabelName("__cgroup_path__")
+const (
+	CgroupPathLabelName = model.LabelName("__cgroup_path__")
+	// PIDLabelName is the label of targets that are a single process rather
+	// than a cgroup, holding the process's PID.
+	PIDLabelName = model.LabelName("__pid__")
+	// ErrorLabelName is the label of targets whose cgroup or process could
+	// not be looked up, holding the error.
+	ErrorLabelName = model.LabelName("__error__")
+)
 
 type NoopProfileStoreClient struct{}
 
@@ -0,0 +1,138 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// StoreWriter sends the series selected by a StoreConfig to a single store.
+type StoreWriter struct {
+	config *StoreConfig
+	client profilestorepb.ProfileStoreServiceClient
+
+	failedWrites *prometheus.CounterVec
+}
+
+// NewStoreWriter returns a StoreWriter that filters and labels series as
+// configured by c before writing them to client. The config must have been
+// validated. The metrics of the writer are registered with reg, which is
+// expected to label them with the store.
+func NewStoreWriter(reg prometheus.Registerer, c *StoreConfig, client profilestorepb.ProfileStoreServiceClient) *StoreWriter {
+	return &StoreWriter{
+		config: c,
+		client: client,
+		failedWrites: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_store_failed_writes_total",
+			Help: "Total number of write requests that the store did not accept, by gRPC status code.",
+		}, []string{"code"}),
+	}
+}
+
+// FanoutClient writes every request to a set of stores. Each store is
+// expected to be fronted by its own Batcher, so that a slow or failing store
+// does not block the others.
+type FanoutClient struct {
+	writers []*StoreWriter
+}
+
+func NewFanoutClient(writers ...*StoreWriter) *FanoutClient {
+	return &FanoutClient{
+		writers: writers,
+	}
+}
+
+// WriteRaw writes the series of r selected by each store to it. Stores that
+// do not accept their series, for instance because their queue is full, are
+// recorded in their metrics. An error is only returned if none of the stores
+// that any series were selected for accepted them.
+func (f *FanoutClient) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	var (
+		result   *multierror.Error
+		selected int
+	)
+	for _, w := range f.writers {
+		req := w.filter(r)
+		if len(req.Series) == 0 {
+			continue
+		}
+
+		selected++
+		if _, err := w.client.WriteRaw(ctx, req, opts...); err != nil {
+			w.failedWrites.WithLabelValues(status.Code(err).String()).Inc()
+			result = multierror.Append(result, fmt.Errorf("store %q: %w", w.config.Name, err))
+		}
+	}
+	if result != nil && len(result.Errors) == selected {
+		return nil, result.ErrorOrNil()
+	}
+
+	return &profilestorepb.WriteRawResponse{}, nil
+}
+
+// filter returns a request with the series of r that are selected by the
+// store's matchers, with the store's external labels attached.
+func (w *StoreWriter) filter(r *profilestorepb.WriteRawRequest) *profilestorepb.WriteRawRequest {
+	if len(w.config.matchers) == 0 && len(w.config.ExternalLabels) == 0 {
+		return r
+	}
+
+	req := &profilestorepb.WriteRawRequest{Tenant: r.Tenant}
+	for _, s := range r.Series {
+		if !w.matches(s.Labels) {
+			continue
+		}
+
+		req.Series = append(req.Series, &profilestorepb.RawProfileSeries{
+			Labels:  w.addExternalLabels(s.Labels),
+			Samples: s.Samples,
+		})
+	}
+	return req
+}
+
+func (w *StoreWriter) matches(ls *profilestorepb.LabelSet) bool {
+	if len(w.config.matchers) == 0 {
+		return true
+	}
+	return matchesAny(w.config.matchers, ls)
+}
+
+func (w *StoreWriter) addExternalLabels(ls *profilestorepb.LabelSet) *profilestorepb.LabelSet {
+	if len(w.config.ExternalLabels) == 0 {
+		return ls
+	}
+
+	res := &profilestorepb.LabelSet{Labels: make([]*profilestorepb.Label, 0, len(ls.GetLabels())+len(w.config.ExternalLabels))}
+	existing := make(map[string]struct{}, len(ls.GetLabels()))
+	for _, l := range ls.GetLabels() {
+		existing[l.Name] = struct{}{}
+		res.Labels = append(res.Labels, l)
+	}
+	for name, value := range w.config.ExternalLabels {
+		if _, ok := existing[string(name)]; ok {
+			continue
+		}
+		res.Labels = append(res.Labels, &profilestorepb.Label{Name: string(name), Value: string(value)})
+	}
+	return res
+}
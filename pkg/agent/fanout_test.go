@@ -0,0 +1,101 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"testing"
+
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFanoutClient(t *testing.T) {
+	ctx := context.Background()
+
+	all := &StoreConfig{Name: "all", Address: "all:7070"}
+	teamA := &StoreConfig{
+		Name:           "team-a",
+		Address:        "team-a:7070",
+		Match:          []string{`{namespace=~"team-a-.*"}`},
+		ExternalLabels: model.LabelSet{"region": "eu", "namespace": "overridden"},
+	}
+	failing := &StoreConfig{Name: "failing", Address: "failing:7070"}
+	require.NoError(t, ValidateStoreConfigs([]*StoreConfig{all, teamA, failing}))
+
+	allClient := &fakeProfileStoreClient{}
+	teamAClient := &fakeProfileStoreClient{}
+	failingClient := &fakeProfileStoreClient{errs: []error{status.Error(codes.ResourceExhausted, "full")}}
+	failingWriter := newTestStoreWriter(failing, failingClient)
+	f := NewFanoutClient(
+		failingWriter,
+		newTestStoreWriter(all, allClient),
+		newTestStoreWriter(teamA, teamAClient),
+	)
+
+	_, err := f.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "namespace", Value: "team-a-prod"}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}},
+		}, {
+			Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "namespace", Value: "team-b-prod"}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte{2}}},
+		}},
+	})
+	// The failing store is recorded, but does not prevent the others from
+	// receiving the series.
+	require.NoError(t, err)
+	require.Equal(t, 1, failingClient.calls)
+	require.Equal(t, 1.0, testutil.ToFloat64(failingWriter.failedWrites.WithLabelValues(codes.ResourceExhausted.String())))
+
+	require.Equal(t, 1, len(allClient.requests))
+	require.Equal(t, 2, len(allClient.requests[0].Series))
+
+	require.Equal(t, 1, len(teamAClient.requests))
+	require.Equal(t, 1, len(teamAClient.requests[0].Series))
+	require.Equal(t, []*profilestorepb.Label{
+		{Name: "namespace", Value: "team-a-prod"},
+		{Name: "region", Value: "eu"},
+	}, sortedLabelSet(teamAClient.requests[0].Series[0].Labels).Labels)
+}
+
+func TestFanoutClientAllStoresFail(t *testing.T) {
+	all := &StoreConfig{Name: "all", Address: "all:7070"}
+	teamA := &StoreConfig{Name: "team-a", Address: "team-a:7070", Match: []string{`{namespace=~"team-a-.*"}`}}
+	failing := &StoreConfig{Name: "failing", Address: "failing:7070"}
+	require.NoError(t, ValidateStoreConfigs([]*StoreConfig{all, teamA, failing}))
+
+	// The store that no series are selected for does not count.
+	f := NewFanoutClient(
+		newTestStoreWriter(all, &fakeProfileStoreClient{errs: []error{status.Error(codes.ResourceExhausted, "full")}}),
+		newTestStoreWriter(failing, &fakeProfileStoreClient{errs: []error{status.Error(codes.Unavailable, "down")}}),
+		newTestStoreWriter(teamA, &fakeProfileStoreClient{}),
+	)
+	_, err := f.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "namespace", Value: "team-b-prod"}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}},
+		}},
+	})
+	require.Error(t, err)
+}
+
+func newTestStoreWriter(c *StoreConfig, client profilestorepb.ProfileStoreServiceClient) *StoreWriter {
+	return NewStoreWriter(prometheus.NewRegistry(), c, client)
+}
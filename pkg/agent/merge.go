@@ -0,0 +1,103 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/pprof/profile"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+)
+
+// BatchMode controls how the Batcher sends the samples of a series.
+type BatchMode string
+
+const (
+	// BatchModeRaw sends every raw profile of a series as it was written.
+	BatchModeRaw BatchMode = "raw"
+	// BatchModeMerged merges all profiles of a series into a single
+	// compacted profile per flush.
+	BatchModeMerged BatchMode = "merged"
+)
+
+// mergeSamples decodes the raw profiles of samples and merges them into a
+// single profile. The merged profile spans from the earliest start to the
+// latest end of the merged profiles.
+func mergeSamples(samples []*profilestorepb.RawSample) (*profilestorepb.RawSample, error) {
+	if len(samples) == 1 {
+		return samples[0], nil
+	}
+
+	raw := make([][]byte, 0, len(samples))
+	for _, s := range samples {
+		raw = append(raw, s.RawProfile)
+	}
+	merged, err := mergeProfiles(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := merged.Write(buf); err != nil {
+		return nil, fmt.Errorf("write merged profile: %w", err)
+	}
+
+	return &profilestorepb.RawSample{RawProfile: buf.Bytes()}, nil
+}
+
+// mergeProfiles decodes the given raw profiles and merges them into a single
+// profile spanning from the earliest start to the latest end of them.
+func mergeProfiles(raw [][]byte) (*profile.Profile, error) {
+	profiles, err := parseProfiles(raw)
+	if err != nil {
+		return nil, err
+	}
+	return mergeParsedProfiles(profiles)
+}
+
+// parseProfiles decodes the given raw profiles.
+func parseProfiles(raw [][]byte) ([]*profile.Profile, error) {
+	profiles := make([]*profile.Profile, 0, len(raw))
+	for _, b := range raw {
+		p, err := profile.ParseData(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse profile: %w", err)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// mergeParsedProfiles merges the given profiles into a single profile spanning
+// from the earliest start to the latest end of them.
+func mergeParsedProfiles(profiles []*profile.Profile) (*profile.Profile, error) {
+	var start, end int64
+	for _, p := range profiles {
+		if start == 0 || (p.TimeNanos != 0 && p.TimeNanos < start) {
+			start = p.TimeNanos
+		}
+		if e := p.TimeNanos + p.DurationNanos; e > end {
+			end = e
+		}
+	}
+
+	merged, err := profile.Merge(profiles)
+	if err != nil {
+		return nil, fmt.Errorf("merge profiles: %w", err)
+	}
+	merged.TimeNanos = start
+	merged.DurationNanos = end - start
+	return merged, nil
+}
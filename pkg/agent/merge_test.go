@@ -0,0 +1,88 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func testProfile(t *testing.T, start time.Time, value int64) []byte {
+	t.Helper()
+
+	fn := &profile.Function{ID: 1, Name: "main"}
+	loc := &profile.Location{ID: 1, Address: 0x1000, Line: []profile.Line{{Function: fn}}}
+	p := &profile.Profile{
+		SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(10 * time.Second),
+		Sample:        []*profile.Sample{{Value: []int64{value}, Location: []*profile.Location{loc}}},
+		Location:      []*profile.Location{loc},
+		Function:      []*profile.Function{fn},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, p.Write(buf))
+	return buf.Bytes()
+}
+
+func TestMergeSamples(t *testing.T) {
+	start := time.Unix(1000, 0)
+	samples := []*profilestorepb.RawSample{
+		{RawProfile: testProfile(t, start.Add(20*time.Second), 3)},
+		{RawProfile: testProfile(t, start, 2)},
+	}
+
+	merged, err := mergeSamples(samples)
+	require.NoError(t, err)
+
+	p, err := profile.ParseData(merged.RawProfile)
+	require.NoError(t, err)
+	require.Equal(t, start.UnixNano(), p.TimeNanos)
+	require.Equal(t, int64(30*time.Second), p.DurationNanos)
+	require.Equal(t, 1, len(p.Sample))
+	require.Equal(t, int64(5), p.Sample[0].Value[0])
+}
+
+func TestWriteClientMergedMode(t *testing.T) {
+	ctx := context.Background()
+	wc := &fakeProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, time.Second, 0, 0, 0, BatchModeMerged)
+
+	labelset := &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "n1", Value: "v1"}}}
+	for i := 0; i < 3; i++ {
+		_, err := batcher.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+			Series: []*profilestorepb.RawProfileSeries{{
+				Labels:  labelset,
+				Samples: []*profilestorepb.RawSample{{RawProfile: testProfile(t, time.Unix(int64(i*10), 0), 1)}},
+			}},
+		})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, batcher.batchLoop(ctx))
+	require.Equal(t, 1, len(wc.requests))
+	require.Equal(t, 1, len(wc.requests[0].Series))
+	require.Equal(t, 1, len(wc.requests[0].Series[0].Samples))
+}
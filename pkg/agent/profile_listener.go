@@ -15,112 +15,217 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/google/pprof/profile"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"google.golang.org/grpc"
 )
 
+// staleSeriesTimeout is how long the profiles of a series that is no longer
+// written to are kept around.
+const staleSeriesTimeout = 5 * time.Minute
+
+var (
+	// ErrNoMatchingProfiles is returned by Query if no buffered profile
+	// matches.
+	ErrNoMatchingProfiles = errors.New("no matching profiles")
+	// ErrMixedSampleTypes is returned by Query if the matching profiles
+	// have different sample types, which cannot be merged.
+	ErrMixedSampleTypes = errors.New("matching profiles have different sample types")
+)
+
+// profileListener keeps the most recent profiles of every series written
+// through it in memory, so that they can be queried locally.
 type profileListener struct {
-	next      profilestorepb.ProfileStoreServiceClient
-	observers []*observer
-	omtx      *sync.Mutex
-	logger    log.Logger
+	next   profilestorepb.ProfileStoreServiceClient
+	logger log.Logger
+	size   int
+
+	mtx    sync.RWMutex
+	series map[uint64]*profileRing
+	lastGC time.Time
 }
 
-func NewProfileListener(logger log.Logger, next profilestorepb.ProfileStoreServiceClient) *profileListener {
+// NewProfileListener returns a profileListener that keeps the last size
+// profiles of each series. A size of 0 disables buffering.
+func NewProfileListener(logger log.Logger, next profilestorepb.ProfileStoreServiceClient, size int) *profileListener {
 	return &profileListener{
-		next:      next,
-		observers: []*observer{},
-		omtx:      &sync.Mutex{},
-		logger:    logger,
+		next:   next,
+		logger: logger,
+		size:   size,
+		series: map[uint64]*profileRing{},
 	}
 }
 
 func (l *profileListener) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
-	l.observeProfile(r)
+	l.observeProfile(r, time.Now())
 	return l.next.WriteRaw(ctx, r, opts...)
 }
 
-type observer struct {
-	f func(*profilestorepb.WriteRawRequest)
-}
+func (l *profileListener) observeProfile(r *profilestorepb.WriteRawRequest, now time.Time) {
+	if l.size <= 0 {
+		return
+	}
 
-func (l *profileListener) observeProfile(r *profilestorepb.WriteRawRequest) {
-	l.omtx.Lock()
-	defer l.omtx.Unlock()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
 
-	for _, o := range l.observers {
-		o.f(r)
+	for _, s := range r.Series {
+		ls := sortedLabelSet(s.Labels)
+		h := hashSeries("", ls)
+		ring, ok := l.series[h]
+		if !ok || !isEqualLabel(ring.labels, ls) {
+			ring = newProfileRing(ls, l.size)
+			l.series[h] = ring
+		}
+		for _, sample := range s.Samples {
+			ring.add(now, sample.RawProfile)
+		}
+	}
+
+	if now.Sub(l.lastGC) > staleSeriesTimeout {
+		for h, ring := range l.series {
+			if now.Sub(ring.lastWrite) > staleSeriesTimeout {
+				delete(l.series, h)
+			}
+		}
+		l.lastGC = now
 	}
 }
 
-func (l *profileListener) observe(f func(*profilestorepb.WriteRawRequest)) *observer {
-	l.omtx.Lock()
-	defer l.omtx.Unlock()
+// Query merges the buffered profiles of all series matching all of the given
+// matchers that were written between start and end, inclusive. A zero start
+// or end leaves the range open on that side. If the matching profiles have
+// different sample types, an error wrapping ErrMixedSampleTypes lists the
+// names of their series, one of which the matchers have to select.
+func (l *profileListener) Query(matchers []*labels.Matcher, start, end time.Time) (*profile.Profile, error) {
+	selector := [][]*labels.Matcher{matchers}
+
+	var (
+		raw   [][]byte
+		names []string
+	)
+	l.mtx.RLock()
+	for _, ring := range l.series {
+		if !matchesAny(selector, ring.labels) {
+			continue
+		}
+		profiles := ring.between(start, end)
+		raw = append(raw, profiles...)
+		for range profiles {
+			names = append(names, labelValue(ring.labels, labels.MetricName))
+		}
+	}
+	l.mtx.RUnlock()
+
+	if len(raw) == 0 {
+		return nil, ErrNoMatchingProfiles
+	}
 
-	o := &observer{
-		f: f,
+	profiles, err := parseProfiles(raw)
+	if err != nil {
+		return nil, err
 	}
-	l.observers = append(l.observers, o)
-	return o
+	// The names of the series of the profiles of each sample type.
+	sampleTypes := map[string]map[string]struct{}{}
+	for i, p := range profiles {
+		key := sampleTypesKey(p)
+		if sampleTypes[key] == nil {
+			sampleTypes[key] = map[string]struct{}{}
+		}
+		sampleTypes[key][names[i]] = struct{}{}
+	}
+	if len(sampleTypes) > 1 {
+		groups := make([]string, 0, len(sampleTypes))
+		for key, names := range sampleTypes {
+			groups = append(groups, fmt.Sprintf("%s (%s)", key, strings.Join(sortedKeys(names), ", ")))
+		}
+		sort.Strings(groups)
+		return nil, fmt.Errorf("%w: %s, select the series of one of them with __name__", ErrMixedSampleTypes, strings.Join(groups, "; "))
+	}
+	return mergeParsedProfiles(profiles)
 }
 
-func (l *profileListener) removeObserver(o *observer) {
-	l.omtx.Lock()
-	defer l.omtx.Unlock()
+// sampleTypesKey identifies the sample types of a profile, such as
+// samples/count.
+func sampleTypesKey(p *profile.Profile) string {
+	types := make([]string, 0, len(p.SampleType))
+	for _, st := range p.SampleType {
+		types = append(types, st.Type+"/"+st.Unit)
+	}
+	return strings.Join(types, ",")
+}
 
-	found := false
-	i := 0
-	for ; i < len(l.observers); i++ {
-		if l.observers[i] == o {
-			found = true
-			break
+// labelValue returns the value of the label with the given name, or an empty
+// string if there is none.
+func labelValue(ls *profilestorepb.LabelSet, name string) string {
+	for _, l := range ls.Labels {
+		if l.Name == name {
+			return l.Value
 		}
 	}
-	if found {
-		l.observers = append(l.observers[:i], l.observers[i+1:]...)
+	return ""
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
 }
 
-func (l *profileListener) NextMatchingProfile(ctx context.Context, matchers []*labels.Matcher) (*profile.Profile, error) {
-	pCh := make(chan []byte)
-	defer close(pCh)
+type bufferedProfile struct {
+	timestamp time.Time
+	raw       []byte
+}
 
-	o := l.observe(func(r *profilestorepb.WriteRawRequest) {
-		var searchedSeries *profilestorepb.RawProfileSeries
+// profileRing holds the last profiles written for a series, overwriting the
+// oldest one once it is full.
+type profileRing struct {
+	labels    *profilestorepb.LabelSet
+	profiles  []bufferedProfile
+	next      int
+	lastWrite time.Time
+}
 
-		for _, series := range r.Series {
-			profileLabels := model.LabelSet{}
+func newProfileRing(ls *profilestorepb.LabelSet, size int) *profileRing {
+	return &profileRing{
+		labels:   ls,
+		profiles: make([]bufferedProfile, 0, size),
+	}
+}
 
-			for _, label := range series.Labels.Labels {
-				profileLabels[model.LabelName(label.Name)] = model.LabelValue(label.Value)
-			}
+func (r *profileRing) add(ts time.Time, raw []byte) {
+	p := bufferedProfile{timestamp: ts, raw: raw}
+	if len(r.profiles) < cap(r.profiles) {
+		r.profiles = append(r.profiles, p)
+	} else {
+		r.profiles[r.next] = p
+	}
+	r.next = (r.next + 1) % cap(r.profiles)
+	r.lastWrite = ts
+}
 
-			for _, matcher := range matchers {
-				labelValue := profileLabels[model.LabelName(matcher.Name)]
-				if !matcher.Matches(string(labelValue)) {
-					continue
-				}
-			}
-			searchedSeries = series
-			break
+func (r *profileRing) between(start, end time.Time) [][]byte {
+	var res [][]byte
+	for _, p := range r.profiles {
+		if !start.IsZero() && p.timestamp.Before(start) {
+			continue
 		}
-
-		if searchedSeries != nil {
-			pCh <- searchedSeries.Samples[len(searchedSeries.Samples)-1].RawProfile
+		if !end.IsZero() && p.timestamp.After(end) {
+			continue
 		}
-	})
-	defer l.removeObserver(o)
-
-	select {
-	case p := <-pCh:
-		return profile.ParseData(p)
-	case <-ctx.Done():
-		return nil, ctx.Err()
+		res = append(res, p.raw)
 	}
+	return res
 }
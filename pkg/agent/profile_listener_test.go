@@ -0,0 +1,115 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestProfile(t *testing.T, l *profileListener, now time.Time, value int64, labels ...string) {
+	t.Helper()
+
+	ls := &profilestorepb.LabelSet{}
+	for i := 0; i < len(labels); i += 2 {
+		ls.Labels = append(ls.Labels, &profilestorepb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	l.observeProfile(&profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels:  ls,
+			Samples: []*profilestorepb.RawSample{{RawProfile: testProfile(t, now, value)}},
+		}},
+	}, now)
+}
+
+func TestProfileListenerQuery(t *testing.T) {
+	l := NewProfileListener(log.NewNopLogger(), NewNoopProfileStoreClient(), 3)
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Second)
+		writeTestProfile(t, l, ts, 1, "pod", "a", "container", "x")
+		writeTestProfile(t, l, ts, 10, "pod", "b", "container", "x")
+	}
+
+	query := func(selector string, start, end time.Time) int64 {
+		t.Helper()
+		matchers, err := parser.ParseMetricSelector(selector)
+		require.NoError(t, err)
+		p, err := l.Query(matchers, start, end)
+		if err == ErrNoMatchingProfiles {
+			return 0
+		}
+		require.NoError(t, err)
+		require.Equal(t, 1, len(p.Sample))
+		return p.Sample[0].Value[0]
+	}
+
+	// Only the last three profiles of each series are kept.
+	require.Equal(t, int64(3), query(`{pod="a"}`, time.Time{}, time.Time{}))
+	require.Equal(t, int64(33), query(`{container="x"}`, time.Time{}, time.Time{}))
+	require.Equal(t, int64(0), query(`{pod="c"}`, time.Time{}, time.Time{}))
+	require.Equal(t, int64(0), query(`{pod="a",container="y"}`, time.Time{}, time.Time{}))
+
+	require.Equal(t, int64(2), query(`{pod="a"}`, start.Add(20*time.Second), time.Time{}))
+	require.Equal(t, int64(10), query(`{pod="b"}`, start.Add(15*time.Second), start.Add(25*time.Second)))
+	require.Equal(t, int64(0), query(`{pod="b"}`, start, start.Add(5*time.Second)))
+
+	// Series that are no longer written to are eventually dropped.
+	writeTestProfile(t, l, start.Add(time.Hour), 1, "pod", "a", "container", "x")
+	require.Equal(t, int64(3), query(`{container="x"}`, time.Time{}, time.Time{}))
+}
+
+func TestProfileListenerQueryMixedSampleTypes(t *testing.T) {
+	l := NewProfileListener(log.NewNopLogger(), NewNoopProfileStoreClient(), 3)
+
+	now := time.Unix(1000, 0)
+	writeTestProfile(t, l, now, 1, "__name__", "parca_agent_cpu", "pod", "a")
+
+	heap, err := profile.ParseData(testProfile(t, now, 2))
+	require.NoError(t, err)
+	heap.SampleType = []*profile.ValueType{{Type: "inuse_space", Unit: "bytes"}}
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, heap.Write(buf))
+	l.observeProfile(&profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{
+				{Name: "__name__", Value: "heap"},
+				{Name: "pod", Value: "a"},
+			}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: buf.Bytes()}},
+		}},
+	}, now)
+
+	matchers, err := parser.ParseMetricSelector(`{pod="a"}`)
+	require.NoError(t, err)
+	_, err = l.Query(matchers, time.Time{}, time.Time{})
+	require.True(t, errors.Is(err, ErrMixedSampleTypes))
+	require.Contains(t, err.Error(), "inuse_space/bytes (heap); samples/count (parca_agent_cpu)")
+
+	// Selecting the series of one sample type merges them.
+	matchers, err = parser.ParseMetricSelector(`heap{pod="a"}`)
+	require.NoError(t, err)
+	p, err := l.Query(matchers, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), p.Sample[0].Value[0])
+}
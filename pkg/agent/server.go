@@ -0,0 +1,205 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TargetResolver looks up the labels of the discovered target a process
+// belongs to.
+type TargetResolver interface {
+	TargetForPID(pid int) (model.LabelSet, bool)
+}
+
+// ProfileStoreServer accepts profiles pushed by applications running on the
+// node, attaches the labels of the node and of the target the pushing
+// process belongs to, and forwards them to next.
+type ProfileStoreServer struct {
+	profilestorepb.UnimplementedProfileStoreServiceServer
+
+	logger log.Logger
+	next   profilestorepb.ProfileStoreServiceClient
+	// externalLabels returns the labels of the node, which change when the
+	// configuration is reloaded.
+	externalLabels func() model.LabelSet
+	resolver       TargetResolver
+}
+
+// NewProfileStoreServer returns a ProfileStoreServer. The resolver may be nil,
+// in which case only the external labels are attached.
+func NewProfileStoreServer(logger log.Logger, next profilestorepb.ProfileStoreServiceClient, externalLabels func() model.LabelSet, resolver TargetResolver) *ProfileStoreServer {
+	return &ProfileStoreServer{
+		logger:         logger,
+		next:           next,
+		externalLabels: externalLabels,
+		resolver:       resolver,
+	}
+}
+
+// WriteRaw forwards the pushed series with the node and target labels
+// attached. These take precedence over labels of the same name set by the
+// client. The tenant of the request is ignored, as it is chosen by the
+// stores the agent is configured to send to.
+func (s *ProfileStoreServer) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest) (*profilestorepb.WriteRawResponse, error) {
+	extra := model.LabelSet{}
+	if pid, ok := PeerPID(ctx); ok && s.resolver != nil {
+		if ls, ok := s.resolver.TargetForPID(pid); ok {
+			for name, value := range ls {
+				if !strings.HasPrefix(string(name), "__") {
+					extra[name] = value
+				}
+			}
+		} else {
+			level.Debug(s.logger).Log("msg", "no target found for peer", "pid", pid)
+		}
+	}
+	for name, value := range s.externalLabels() {
+		extra[name] = value
+	}
+
+	req := &profilestorepb.WriteRawRequest{
+		Series: make([]*profilestorepb.RawProfileSeries, 0, len(r.Series)),
+	}
+	for _, series := range r.Series {
+		if len(series.Samples) == 0 {
+			continue
+		}
+		req.Series = append(req.Series, &profilestorepb.RawProfileSeries{
+			Labels:  overrideLabels(series.Labels, extra),
+			Samples: series.Samples,
+		})
+	}
+	if len(req.Series) == 0 {
+		return &profilestorepb.WriteRawResponse{}, nil
+	}
+
+	if _, err := s.next.WriteRaw(ctx, req); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &profilestorepb.WriteRawResponse{}, nil
+}
+
+// overrideLabels returns the labels of ls with the given labels added,
+// replacing any labels of the same name. The result is sorted by name.
+func overrideLabels(ls *profilestorepb.LabelSet, override model.LabelSet) *profilestorepb.LabelSet {
+	res := &profilestorepb.LabelSet{Labels: make([]*profilestorepb.Label, 0, len(ls.GetLabels())+len(override))}
+	for _, l := range ls.GetLabels() {
+		if _, ok := override[model.LabelName(l.Name)]; ok {
+			continue
+		}
+		res.Labels = append(res.Labels, l)
+	}
+	for name, value := range override {
+		res.Labels = append(res.Labels, &profilestorepb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(res.Labels, func(i, j int) bool {
+		return res.Labels[i].Name < res.Labels[j].Name
+	})
+	return res
+}
+
+// PeerAuthInfo carries the PID of the process on the other end of a unix
+// socket connection.
+type PeerAuthInfo struct {
+	credentials.CommonAuthInfo
+	PID int
+}
+
+func (PeerAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+// PeerPID returns the PID of the client of the gRPC request handled with ctx,
+// if it is connected over a unix socket.
+func PeerPID(ctx context.Context) (int, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	info, ok := p.AuthInfo.(PeerAuthInfo)
+	if !ok || info.PID == 0 {
+		return 0, false
+	}
+	return info.PID, true
+}
+
+// peerCredentials are insecure transport credentials that record the
+// credentials of clients connected over unix sockets.
+type peerCredentials struct{}
+
+// NewPeerCredentials returns server transport credentials that make the PID
+// of clients connected over unix sockets available through PeerPID. No
+// transport security is provided.
+func NewPeerCredentials() credentials.TransportCredentials {
+	return peerCredentials{}
+}
+
+func (peerCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, PeerAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}, nil
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info := PeerAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, info, nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, nil, err
+	}
+	if credErr == nil {
+		info.PID = int(cred.Pid)
+	}
+	return conn, info, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type fakeTargetResolver map[int]model.LabelSet
+
+func (r fakeTargetResolver) TargetForPID(pid int) (model.LabelSet, bool) {
+	ls, ok := r[pid]
+	return ls, ok
+}
+
+func TestProfileStoreServer(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	next := &fakeProfileStoreClient{}
+	externalLabels := model.LabelSet{"node": "node-a"}
+	srv := grpc.NewServer(grpc.Creds(NewPeerCredentials()))
+	profilestorepb.RegisterProfileStoreServiceServer(srv, NewProfileStoreServer(
+		log.NewNopLogger(),
+		next,
+		func() model.LabelSet { return externalLabels },
+		fakeTargetResolver{os.Getpid(): {
+			"__cgroup_path__": "/sys/fs/cgroup/system.slice/test.service",
+			"namespace":       "default",
+			"pod":             "test",
+		}},
+	))
+	go srv.Serve(ln) //nolint:errcheck
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = profilestorepb.NewProfileStoreServiceClient(conn).WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Tenant: "other",
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{
+				{Name: "__name__", Value: "heap"},
+				{Name: "node", Value: "spoofed"},
+				{Name: "version", Value: "v1"},
+			}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}},
+		}, {
+			Labels: &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "__name__", Value: "empty"}}},
+		}},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(next.requests))
+	req := next.requests[0]
+	require.Equal(t, "", req.Tenant)
+	require.Equal(t, 1, len(req.Series))
+	require.Equal(t, []*profilestorepb.Label{
+		{Name: "__name__", Value: "heap"},
+		{Name: "namespace", Value: "default"},
+		{Name: "node", Value: "node-a"},
+		{Name: "pod", Value: "test"},
+		{Name: "version", Value: "v1"},
+	}, req.Series[0].Labels.Labels)
+
+	// Reloaded external labels are attached to the profiles pushed after.
+	externalLabels = model.LabelSet{"node": "node-a", "region": "eu"}
+	_, err = profilestorepb.NewProfileStoreServiceClient(conn).WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{
+			Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "__name__", Value: "heap"}}},
+			Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}},
+		}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(next.requests))
+	require.Equal(t, []*profilestorepb.Label{
+		{Name: "__name__", Value: "heap"},
+		{Name: "namespace", Value: "default"},
+		{Name: "node", Value: "node-a"},
+		{Name: "pod", Value: "test"},
+		{Name: "region", Value: "eu"},
+	}, next.requests[1].Series[0].Labels.Labels)
+}
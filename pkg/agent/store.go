@@ -0,0 +1,220 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/yaml.v2"
+)
+
+// StoreConfig configures a remote store that profiles are sent to.
+type StoreConfig struct {
+	// Name identifies the store in logs and metrics.
+	Name string `yaml:"name"`
+	// Address is the gRPC address of the store.
+	Address string `yaml:"address"`
+
+	BearerToken     config.Secret    `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string           `yaml:"bearer_token_file,omitempty"`
+	Insecure        bool             `yaml:"insecure,omitempty"`
+	TLSConfig       config.TLSConfig `yaml:"tls_config,omitempty"`
+
+	// Match is a list of series selectors. If set, only series matching at
+	// least one of them are sent to the store.
+	Match []string `yaml:"match,omitempty"`
+	// ExternalLabels are attached to every series sent to the store, unless
+	// the series already has a label with the same name.
+	ExternalLabels model.LabelSet `yaml:"external_labels,omitempty"`
+
+	// TenantHeader is the gRPC metadata key the tenant of a request is sent
+	// in, for example X-Scope-OrgID.
+	TenantHeader string `yaml:"tenant_header,omitempty"`
+	// DefaultTenant is used for series that match none of the Tenants.
+	DefaultTenant string          `yaml:"default_tenant,omitempty"`
+	Tenants       []*TenantConfig `yaml:"tenants,omitempty"`
+
+	matchers [][]*labels.Matcher
+}
+
+// Validate checks the configuration and parses its series selectors.
+func (c *StoreConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("store name must not be empty")
+	}
+	if c.Address == "" {
+		return fmt.Errorf("store %q: address must not be empty", c.Name)
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("store %q: at most one of bearer_token and bearer_token_file must be configured", c.Name)
+	}
+	if err := c.ExternalLabels.Validate(); err != nil {
+		return fmt.Errorf("store %q: invalid external labels: %w", c.Name, err)
+	}
+
+	c.matchers = make([][]*labels.Matcher, 0, len(c.Match))
+	for _, m := range c.Match {
+		matchers, err := parser.ParseMetricSelector(m)
+		if err != nil {
+			return fmt.Errorf("store %q: invalid selector %q: %w", c.Name, m, err)
+		}
+		c.matchers = append(c.matchers, matchers)
+	}
+
+	// gRPC metadata keys are always lowercase.
+	c.TenantHeader = strings.ToLower(c.TenantHeader)
+	ids := map[string]struct{}{}
+	for _, t := range c.Tenants {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("store %q: %w", c.Name, err)
+		}
+		if _, ok := ids[t.ID]; ok {
+			return fmt.Errorf("store %q: duplicate tenant %q", c.Name, t.ID)
+		}
+		ids[t.ID] = struct{}{}
+	}
+	return nil
+}
+
+// HasTenants reports whether series sent to the store are routed to tenants.
+func (c *StoreConfig) HasTenants() bool {
+	return len(c.Tenants) > 0 || c.DefaultTenant != ""
+}
+
+// SetDirectory resolves the relative file paths of the configuration against
+// dir.
+func (c *StoreConfig) SetDirectory(dir string) {
+	c.BearerTokenFile = config.JoinDir(dir, c.BearerTokenFile)
+	c.TLSConfig.SetDirectory(dir)
+	for _, t := range c.Tenants {
+		t.BearerTokenFile = config.JoinDir(dir, t.BearerTokenFile)
+	}
+}
+
+// storesFile is the format of the file read by LoadStoreConfigs.
+type storesFile struct {
+	Stores []*StoreConfig `yaml:"stores"`
+}
+
+// LoadStoreConfigs reads and validates the store configurations in the YAML
+// file at filename. Relative file paths are resolved against the directory
+// of the file.
+func LoadStoreConfigs(filename string) ([]*StoreConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read store config: %w", err)
+	}
+
+	f := storesFile{}
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("parse store config %s: %w", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	for _, c := range f.Stores {
+		c.SetDirectory(dir)
+	}
+
+	if err := ValidateStoreConfigs(f.Stores); err != nil {
+		return nil, err
+	}
+	return f.Stores, nil
+}
+
+// ValidateStoreConfigs validates each of the given store configurations and
+// makes sure their names are unique.
+func ValidateStoreConfigs(stores []*StoreConfig) error {
+	names := map[string]struct{}{}
+	for _, c := range stores {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate store name %q", c.Name)
+		}
+		names[c.Name] = struct{}{}
+	}
+	return nil
+}
+
+// DialStore opens a gRPC connection to the store described by c.
+func DialStore(c *StoreConfig, met *grpc_prometheus.ClientMetrics) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithUnaryInterceptor(
+			met.UnaryClientInterceptor(),
+		),
+	}
+	if c.Insecure {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		tlsConfig, err := config.NewTLSConfig(&c.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("store %q: %w", c.Name, err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	token := string(c.BearerToken)
+	if c.BearerTokenFile != "" {
+		b, err := ioutil.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	switch {
+	case c.HasTenants() || c.TenantHeader != "":
+		creds, err := newTenantCredentials(c, token)
+		if err != nil {
+			return nil, fmt.Errorf("store %q: %w", c.Name, err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(creds))
+	case token != "":
+		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestBearerToken{
+			token:    token,
+			insecure: c.Insecure,
+		}))
+	}
+
+	return grpc.Dial(c.Address, opts...)
+}
+
+type perRequestBearerToken struct {
+	token    string
+	insecure bool
+}
+
+func (t *perRequestBearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + t.token,
+	}, nil
+}
+
+func (t *perRequestBearerToken) RequireTransportSecurity() bool {
+	return !t.insecure
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadStoreConfigs(t *testing.T) {
+	stores, err := LoadStoreConfigs("testdata/stores.yaml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(stores))
+
+	require.Equal(t, "regional", stores[0].Name)
+	require.True(t, stores[0].Insecure)
+	require.Equal(t, 1, len(stores[0].matchers))
+
+	require.Equal(t, "central", stores[1].Name)
+	require.Equal(t, "testdata/token", stores[1].BearerTokenFile)
+	require.Equal(t, "testdata/ca.crt", stores[1].TLSConfig.CAFile)
+	require.Equal(t, model.LabelSet{"region": "eu-west-1"}, stores[1].ExternalLabels)
+}
+
+func TestValidateStoreConfigs(t *testing.T) {
+	require.Error(t, ValidateStoreConfigs([]*StoreConfig{{Name: "a"}}))
+	require.Error(t, ValidateStoreConfigs([]*StoreConfig{{Name: "a", Address: "a:7070", Match: []string{"{"}}}))
+	require.Error(t, ValidateStoreConfigs([]*StoreConfig{
+		{Name: "a", Address: "a:7070"},
+		{Name: "a", Address: "b:7070"},
+	}))
+	require.NoError(t, ValidateStoreConfigs([]*StoreConfig{
+		{Name: "a", Address: "a:7070"},
+		{Name: "b", Address: "b:7070"},
+	}))
+}
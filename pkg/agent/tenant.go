@@ -0,0 +1,212 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"google.golang.org/grpc"
+)
+
+// TenantConfig maps the series matching any of its selectors to a tenant of a
+// multi-tenant store, optionally with tenant specific credentials.
+type TenantConfig struct {
+	ID    string   `yaml:"id"`
+	Match []string `yaml:"match"`
+
+	BearerToken     config.Secret `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string        `yaml:"bearer_token_file,omitempty"`
+
+	matchers [][]*labels.Matcher
+}
+
+// Validate checks the configuration and parses its series selectors.
+func (c *TenantConfig) Validate() error {
+	if c.ID == "" {
+		return errors.New("tenant id must not be empty")
+	}
+	if len(c.Match) == 0 {
+		return fmt.Errorf("tenant %q: at least one selector must be configured", c.ID)
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("tenant %q: at most one of bearer_token and bearer_token_file must be configured", c.ID)
+	}
+
+	c.matchers = make([][]*labels.Matcher, 0, len(c.Match))
+	for _, m := range c.Match {
+		matchers, err := parser.ParseMetricSelector(m)
+		if err != nil {
+			return fmt.Errorf("tenant %q: invalid selector %q: %w", c.ID, m, err)
+		}
+		c.matchers = append(c.matchers, matchers)
+	}
+	return nil
+}
+
+// TenantRouter assigns every series written through it to the first tenant
+// whose selectors match, or to the default tenant otherwise, and writes the
+// series of each tenant in a separate request. Requests that already carry a
+// tenant are passed on unchanged.
+type TenantRouter struct {
+	tenants       []*TenantConfig
+	defaultTenant string
+	next          profilestorepb.ProfileStoreServiceClient
+}
+
+// NewTenantRouter returns a TenantRouter for the tenants of the given store
+// configuration. The config must have been validated.
+func NewTenantRouter(c *StoreConfig, next profilestorepb.ProfileStoreServiceClient) *TenantRouter {
+	return &TenantRouter{
+		tenants:       c.Tenants,
+		defaultTenant: c.DefaultTenant,
+		next:          next,
+	}
+}
+
+func (t *TenantRouter) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	if r.Tenant != "" {
+		return t.next.WriteRaw(ctx, r, opts...)
+	}
+
+	var (
+		reqs     []*profilestorepb.WriteRawRequest
+		byTenant = map[string]*profilestorepb.WriteRawRequest{}
+	)
+	for _, s := range r.Series {
+		tenant := t.tenant(s.Labels)
+		req, ok := byTenant[tenant]
+		if !ok {
+			req = &profilestorepb.WriteRawRequest{Tenant: tenant}
+			byTenant[tenant] = req
+			reqs = append(reqs, req)
+		}
+		req.Series = append(req.Series, s)
+	}
+
+	for _, req := range reqs {
+		if _, err := t.next.WriteRaw(ctx, req, opts...); err != nil {
+			return nil, err
+		}
+	}
+	return &profilestorepb.WriteRawResponse{}, nil
+}
+
+func (t *TenantRouter) tenant(ls *profilestorepb.LabelSet) string {
+	for _, tenant := range t.tenants {
+		if matchesAny(tenant.matchers, ls) {
+			return tenant.ID
+		}
+	}
+	return t.defaultTenant
+}
+
+// matchesAny reports whether ls matches all matchers of at least one of the
+// given selectors.
+func matchesAny(selectors [][]*labels.Matcher, ls *profilestorepb.LabelSet) bool {
+	values := make(map[string]string, len(ls.GetLabels()))
+	for _, l := range ls.GetLabels() {
+		values[l.Name] = l.Value
+	}
+
+	for _, matchers := range selectors {
+		matched := true
+		for _, m := range matchers {
+			if !m.Matches(values[m.Name]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context that carries the tenant a request is sent for.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by ctx, if any.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantCredentials attaches the tenant of a request and the bearer token
+// configured for it to the request metadata.
+type tenantCredentials struct {
+	header       string
+	tokens       map[string]string
+	defaultToken string
+	insecure     bool
+}
+
+func newTenantCredentials(c *StoreConfig, defaultToken string) (*tenantCredentials, error) {
+	creds := &tenantCredentials{
+		header:       c.TenantHeader,
+		tokens:       map[string]string{},
+		defaultToken: defaultToken,
+		insecure:     c.Insecure,
+	}
+	for _, t := range c.Tenants {
+		switch {
+		case t.BearerToken != "":
+			creds.tokens[t.ID] = string(t.BearerToken)
+		case t.BearerTokenFile != "":
+			b, err := ioutil.ReadFile(t.BearerTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read bearer token of tenant %q from file: %w", t.ID, err)
+			}
+			creds.tokens[t.ID] = strings.TrimSpace(string(b))
+		}
+	}
+	return creds, nil
+}
+
+func (t *tenantCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := map[string]string{}
+
+	tenant := TenantFromContext(ctx)
+	if tenant != "" && t.header != "" {
+		md[t.header] = tenant
+	}
+
+	token, ok := t.tokens[tenant]
+	if !ok {
+		token = t.defaultToken
+	}
+	if token != "" {
+		md["authorization"] = "Bearer " + token
+	}
+	return md, nil
+}
+
+func (t *tenantCredentials) RequireTransportSecurity() bool {
+	return !t.insecure
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func namespaceSeries(namespace string, raw byte) *profilestorepb.RawProfileSeries {
+	return &profilestorepb.RawProfileSeries{
+		Labels:  &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "namespace", Value: namespace}}},
+		Samples: []*profilestorepb.RawSample{{RawProfile: []byte{raw}}},
+	}
+}
+
+func tenantStoreConfig(t *testing.T) *StoreConfig {
+	t.Helper()
+
+	c := &StoreConfig{
+		Name:          "shared",
+		Address:       "gateway:7070",
+		TenantHeader:  "X-Scope-OrgID",
+		DefaultTenant: "shared",
+		BearerToken:   "default-token",
+		Tenants: []*TenantConfig{{
+			ID:          "team-a",
+			Match:       []string{`{namespace=~"team-a-.*"}`},
+			BearerToken: "team-a-token",
+		}, {
+			ID:    "team-b",
+			Match: []string{`{namespace="team-b"}`},
+		}},
+	}
+	require.NoError(t, c.Validate())
+	return c
+}
+
+func TestTenantRouter(t *testing.T) {
+	ctx := context.Background()
+	wc := &fakeProfileStoreClient{}
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, time.Second, 0, 0, 0, BatchModeRaw)
+	router := NewTenantRouter(tenantStoreConfig(t), batcher)
+
+	_, err := router.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{
+			namespaceSeries("team-a-prod", 1),
+			namespaceSeries("kube-system", 2),
+			namespaceSeries("team-b", 3),
+			namespaceSeries("team-a-dev", 4),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, batcher.batchLoop(ctx))
+
+	tenants := map[string]int{}
+	for _, req := range wc.requests {
+		tenants[req.Tenant] += len(req.Series)
+	}
+	require.Equal(t, map[string]int{"team-a": 2, "shared": 1, "team-b": 1}, tenants)
+}
+
+func TestTenantRouterKeepsTenant(t *testing.T) {
+	wc := &fakeProfileStoreClient{}
+	router := NewTenantRouter(tenantStoreConfig(t), wc)
+
+	_, err := router.WriteRaw(context.Background(), &profilestorepb.WriteRawRequest{
+		Tenant: "explicit",
+		Series: []*profilestorepb.RawProfileSeries{namespaceSeries("team-a-prod", 1)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(wc.requests))
+	require.Equal(t, "explicit", wc.requests[0].Tenant)
+}
+
+func TestTenantCredentials(t *testing.T) {
+	creds, err := newTenantCredentials(tenantStoreConfig(t), "default-token")
+	require.NoError(t, err)
+
+	md, err := creds.GetRequestMetadata(WithTenant(context.Background(), "team-a"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"x-scope-orgid": "team-a",
+		"authorization": "Bearer team-a-token",
+	}, md)
+
+	md, err = creds.GetRequestMetadata(WithTenant(context.Background(), "team-b"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"x-scope-orgid": "team-b",
+		"authorization": "Bearer default-token",
+	}, md)
+
+	md, err = creds.GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"authorization": "Bearer default-token",
+	}, md)
+}
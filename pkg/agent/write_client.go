@@ -15,36 +15,130 @@ package agent
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+const (
+	// DefaultMaxMessageSize is the default maximum size of a single gRPC
+	// message accepted by gRPC servers.
+	DefaultMaxMessageSize = 4 << 20
+
+	// retryBudget is the number of retries a single flush may spend on
+	// retryable errors across all of its requests.
+	retryBudget = 5
+
+	// messageOverhead is a conservative estimate of the bytes needed for
+	// the tags and length prefixes wrapping a series or a sample.
+	messageOverhead = 16
+)
+
+type batcherMetrics struct {
+	queuedBytes    prometheus.Gauge
+	queuedSeries   prometheus.Gauge
+	droppedSamples *prometheus.CounterVec
+	sentSamples    prometheus.Counter
+	mergedSamples  prometheus.Counter
+	retries        prometheus.Counter
+	sendDuration   prometheus.Histogram
+}
+
+func newBatcherMetrics(reg prometheus.Registerer) *batcherMetrics {
+	return &batcherMetrics{
+		queuedBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_batcher_queued_bytes",
+			Help: "Current number of raw profile bytes queued to be sent.",
+		}),
+		queuedSeries: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_batcher_queued_series",
+			Help: "Current number of series queued to be sent.",
+		}),
+		droppedSamples: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_batcher_dropped_samples_total",
+			Help: "Total number of samples dropped by the batcher.",
+		}, []string{"reason"}),
+		sentSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_batcher_sent_samples_total",
+			Help: "Total number of samples successfully sent.",
+		}),
+		mergedSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_batcher_merged_samples_total",
+			Help: "Total number of samples merged into per-series profiles before sending.",
+		}),
+		retries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_batcher_retries_total",
+			Help: "Total number of retried write requests.",
+		}),
+		sendDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "parca_agent_batcher_send_duration_seconds",
+			Help:    "Latency of write requests sent to the store.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
 type Batcher struct {
-	logger        log.Logger
-	writeClient   profilestorepb.ProfileStoreServiceClient
-	writeInterval time.Duration
+	logger         log.Logger
+	metrics        *batcherMetrics
+	writeClient    profilestorepb.ProfileStoreServiceClient
+	writeInterval  time.Duration
+	maxBytes       int
+	maxSeries      int
+	maxMessageSize int
+	mode           BatchMode
 
 	mtx    *sync.RWMutex
 	series []*profilestorepb.RawProfileSeries
+	// tenants holds the tenant of the series at the same position.
+	tenants []string
+	index   map[uint64]int
+	bytes   int
 
 	lastBatchSentAt    time.Time
 	lastBatchSendError error
 }
 
-func NewBatchWriteClient(logger log.Logger, wc profilestorepb.ProfileStoreServiceClient, writeInterval time.Duration) *Batcher {
+// NewBatchWriteClient returns a Batcher that buffers up to maxBytes of raw
+// profiles in at most maxSeries series and flushes them every writeInterval
+// in requests no larger than maxMessageSize. A value of zero disables the
+// respective limit. In BatchModeMerged the profiles of each series are merged
+// into one before they are sent.
+func NewBatchWriteClient(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	wc profilestorepb.ProfileStoreServiceClient,
+	writeInterval time.Duration,
+	maxBytes int,
+	maxSeries int,
+	maxMessageSize int,
+	mode BatchMode,
+) *Batcher {
 	return &Batcher{
-		logger:        logger,
-		writeClient:   wc,
-		writeInterval: writeInterval,
+		logger:         logger,
+		metrics:        newBatcherMetrics(reg),
+		writeClient:    wc,
+		writeInterval:  writeInterval,
+		maxBytes:       maxBytes,
+		maxSeries:      maxSeries,
+		maxMessageSize: maxMessageSize,
+		mode:           mode,
 
-		series: []*profilestorepb.RawProfileSeries{},
-		mtx:    &sync.RWMutex{},
+		series:  []*profilestorepb.RawProfileSeries{},
+		tenants: []string{},
+		index:   map[uint64]int{},
+		mtx:     &sync.RWMutex{},
 	}
 }
 
@@ -74,34 +168,207 @@ func (b *Batcher) Run(ctx context.Context) error {
 func (b *Batcher) batchLoop(ctx context.Context) error {
 	b.mtx.Lock()
 	batch := b.series
+	tenants := b.tenants
 	b.series = []*profilestorepb.RawProfileSeries{}
+	b.tenants = []string{}
+	b.index = map[uint64]int{}
+	b.bytes = 0
+	b.metrics.queuedBytes.Set(0)
+	b.metrics.queuedSeries.Set(0)
 	b.mtx.Unlock()
 
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if b.mode == BatchModeMerged {
+		b.mergeBatch(batch)
+	}
+
+	budget := retryBudget
+	var lastErr error
+	for _, tb := range splitByTenant(batch, tenants) {
+		for _, req := range splitBatch(tb.series, b.maxMessageSize) {
+			req.Tenant = tb.tenant
+			err := b.send(WithTenant(ctx, tb.tenant), req, &budget)
+			if err == nil {
+				continue
+			}
+
+			lastErr = err
+			samples := countSamples(req.Series)
+			if isRetryable(err) {
+				// Give the failed series another chance with the next flush,
+				// as long as they still fit into the buffer.
+				level.Warn(b.logger).Log("msg", "batch write client failed to send profiles, requeueing", "count", samples, "tenant", tb.tenant, "err", err)
+				b.requeue(req.Series, tb.tenant)
+				continue
+			}
+
+			level.Error(b.logger).Log("msg", "batch write client failed to send profiles", "count", samples, "tenant", tb.tenant, "err", err)
+			b.metrics.droppedSamples.WithLabelValues("send_failed").Add(float64(samples))
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+
+	level.Debug(b.logger).Log("msg", "batch write client has sent profiles", "count", len(batch))
+	return nil
+}
+
+// send writes a single request, retrying retryable errors for as long as the
+// shared budget and the write interval allow.
+func (b *Batcher) send(ctx context.Context, req *profilestorepb.WriteRawRequest, budget *int) error {
 	expbackOff := backoff.NewExponentialBackOff()
 	expbackOff.MaxElapsedTime = b.writeInterval         // TODO: Subtract ~10% of interval to account for overhead in loop
 	expbackOff.InitialInterval = 500 * time.Millisecond // Let's not retry to aggressively to start with.
 
-	err := backoff.Retry(func() error {
-		_, err := b.writeClient.WriteRaw(ctx, &profilestorepb.WriteRawRequest{Series: batch})
-		// Only log error if retrying, otherwise it will be logged outside the retry
-		if err != nil && expbackOff.NextBackOff().Nanoseconds() > 0 {
-			level.Debug(b.logger).Log(
-				"msg", "batch write client failed to send profiles",
-				"retry", expbackOff.NextBackOff(),
-				"count", len(batch),
-				"err", err,
-			)
+	attempt := 0
+	return backoff.Retry(func() error {
+		if attempt > 0 {
+			b.metrics.retries.Inc()
 		}
+		attempt++
+
+		start := time.Now()
+		_, err := b.writeClient.WriteRaw(ctx, req)
+		b.metrics.sendDuration.Observe(time.Since(start).Seconds())
+		if err == nil {
+			b.metrics.sentSamples.Add(float64(countSamples(req.Series)))
+			return nil
+		}
+
+		if !isRetryable(err) || *budget <= 0 {
+			return backoff.Permanent(err)
+		}
+		*budget--
+
+		level.Debug(b.logger).Log(
+			"msg", "batch write client failed to send profiles",
+			"retry", expbackOff.NextBackOff(),
+			"count", len(req.Series),
+			"err", err,
+		)
 		return err
-	}, expbackOff)
-	if err != nil {
-		// TODO: Add metric and increase with every backoff iteration.
-		level.Error(b.logger).Log("msg", "batch write client failed to send profiles", "count", len(batch), "err", err)
-		return err
+	}, backoff.WithContext(expbackOff, ctx))
+}
+
+// mergeBatch replaces the samples of every series in batch by a single merged
+// sample. Series that fail to merge are sent as they are.
+func (b *Batcher) mergeBatch(batch []*profilestorepb.RawProfileSeries) {
+	for _, s := range batch {
+		if len(s.Samples) < 2 {
+			continue
+		}
+
+		merged, err := mergeSamples(s.Samples)
+		if err != nil {
+			level.Debug(b.logger).Log("msg", "failed to merge profiles, sending them unmerged", "err", err)
+			continue
+		}
+
+		b.metrics.mergedSamples.Add(float64(len(s.Samples)))
+		s.Samples = []*profilestorepb.RawSample{merged}
 	}
+}
 
-	level.Debug(b.logger).Log("msg", "batch write client has sent profiles", "count", len(batch))
-	return nil
+func (b *Batcher) requeue(series []*profilestorepb.RawProfileSeries, tenant string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, s := range series {
+		b.appendSeries(s, tenant, "requeue_full")
+	}
+}
+
+type tenantBatch struct {
+	tenant string
+	series []*profilestorepb.RawProfileSeries
+}
+
+// splitByTenant groups series by their tenant, preserving the order in which
+// tenants first appear.
+func splitByTenant(series []*profilestorepb.RawProfileSeries, tenants []string) []*tenantBatch {
+	var (
+		res     []*tenantBatch
+		batches = map[string]*tenantBatch{}
+	)
+	for i, s := range series {
+		tb, ok := batches[tenants[i]]
+		if !ok {
+			tb = &tenantBatch{tenant: tenants[i]}
+			batches[tenants[i]] = tb
+			res = append(res, tb)
+		}
+		tb.series = append(tb.series, s)
+	}
+	return res
+}
+
+// isRetryable reports whether err signals a transient condition of the store
+// that is worth retrying.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// splitBatch splits series into requests whose encoded size stays below
+// maxSize. Series with many samples are split across requests if necessary.
+// A single sample that exceeds maxSize on its own is sent in a request of its
+// own.
+func splitBatch(series []*profilestorepb.RawProfileSeries, maxSize int) []*profilestorepb.WriteRawRequest {
+	if maxSize <= 0 {
+		return []*profilestorepb.WriteRawRequest{{Series: series}}
+	}
+
+	var (
+		reqs []*profilestorepb.WriteRawRequest
+		cur  = &profilestorepb.WriteRawRequest{}
+		size = 0
+	)
+	for _, s := range series {
+		labelsSize := s.Labels.SizeVT() + messageOverhead
+
+		var part *profilestorepb.RawProfileSeries
+		for _, sample := range s.Samples {
+			sampleSize := sample.SizeVT() + messageOverhead
+
+			needed := sampleSize
+			if part == nil {
+				needed += labelsSize
+			}
+			if size > 0 && size+needed > maxSize {
+				reqs = append(reqs, cur)
+				cur = &profilestorepb.WriteRawRequest{}
+				size = 0
+				part = nil
+				needed = sampleSize + labelsSize
+			}
+			if part == nil {
+				part = &profilestorepb.RawProfileSeries{Labels: s.Labels}
+				cur.Series = append(cur.Series, part)
+			}
+			part.Samples = append(part.Samples, sample)
+			size += needed
+		}
+	}
+	if len(cur.Series) > 0 {
+		reqs = append(reqs, cur)
+	}
+	return reqs
+}
+
+func countSamples(series []*profilestorepb.RawProfileSeries) int {
+	n := 0
+	for _, s := range series {
+		n += len(s.Samples)
+	}
+	return n
 }
 
 func isEqualLabel(a, b *profilestorepb.LabelSet) bool {
@@ -118,29 +385,95 @@ func isEqualLabel(a, b *profilestorepb.LabelSet) bool {
 	return ret
 }
 
-func findIndex(arr []*profilestorepb.RawProfileSeries, p *profilestorepb.RawProfileSeries) (int, bool) {
-	for i, val := range arr {
-		if isEqualLabel(val.Labels, p.Labels) {
-			return i, true
+// sortedLabelSet returns a copy of ls with its labels sorted by name, so that
+// label sets built from maps compare and hash equally.
+func sortedLabelSet(ls *profilestorepb.LabelSet) *profilestorepb.LabelSet {
+	res := &profilestorepb.LabelSet{Labels: make([]*profilestorepb.Label, len(ls.GetLabels()))}
+	copy(res.Labels, ls.GetLabels())
+	sort.Slice(res.Labels, func(i, j int) bool {
+		return res.Labels[i].Name < res.Labels[j].Name
+	})
+	return res
+}
+
+// hashSeries hashes the tenant and sorted label set of a series.
+func hashSeries(tenant string, ls *profilestorepb.LabelSet) uint64 {
+	sep := []byte{'\xff'}
+	h := xxhash.New()
+	_, _ = h.WriteString(tenant)
+	_, _ = h.Write(sep)
+	for _, l := range ls.Labels {
+		_, _ = h.WriteString(l.Name)
+		_, _ = h.Write(sep)
+		_, _ = h.WriteString(l.Value)
+		_, _ = h.Write(sep)
+	}
+	return h.Sum64()
+}
+
+// findIndex returns the position of the series of the tenant with the given
+// sorted label set in the batch.
+func (b *Batcher) findIndex(tenant string, ls *profilestorepb.LabelSet) (uint64, int, bool) {
+	h := hashSeries(tenant, ls)
+	i, ok := b.index[h]
+	if !ok || b.tenants[i] != tenant || !isEqualLabel(b.series[i].Labels, ls) {
+		return h, -1, false
+	}
+	return h, i, true
+}
+
+// appendSeries adds the samples of s to the batch, dropping the ones that do
+// not fit into the configured limits. It returns the number of dropped
+// samples. The caller must hold the lock.
+func (b *Batcher) appendSeries(s *profilestorepb.RawProfileSeries, tenant, reason string) int {
+	ls := sortedLabelSet(s.Labels)
+	h, i, found := b.findIndex(tenant, ls)
+	if !found && b.maxSeries > 0 && len(b.series) >= b.maxSeries {
+		b.metrics.droppedSamples.WithLabelValues(reason).Add(float64(len(s.Samples)))
+		return len(s.Samples)
+	}
+
+	dropped := 0
+	for _, sample := range s.Samples {
+		size := len(sample.RawProfile)
+		if b.maxBytes > 0 && b.bytes+size > b.maxBytes {
+			dropped++
+			continue
 		}
+
+		if !found {
+			i = len(b.series)
+			b.series = append(b.series, &profilestorepb.RawProfileSeries{Labels: ls})
+			b.tenants = append(b.tenants, tenant)
+			b.index[h] = i
+			found = true
+		}
+		b.series[i].Samples = append(b.series[i].Samples, sample)
+		b.bytes += size
+	}
+	if dropped > 0 {
+		b.metrics.droppedSamples.WithLabelValues(reason).Add(float64(dropped))
 	}
-	return -1, false
+
+	b.metrics.queuedBytes.Set(float64(b.bytes))
+	b.metrics.queuedSeries.Set(float64(len(b.series)))
+	return dropped
 }
 
+// WriteRaw queues the samples of r to be sent with the next flush. Series of
+// different tenants are kept apart and sent in separate requests. If the
+// buffer is full, the samples that do not fit are dropped and a
+// ResourceExhausted error is returned to signal backpressure to the caller.
 func (b *Batcher) WriteRaw(ctx context.Context, r *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 
+	dropped := 0
 	for _, profileSeries := range r.Series {
-		if j, ok := findIndex(b.series, profileSeries); ok {
-			b.series[j].Samples = append(b.series[j].Samples, profileSeries.Samples...)
-			continue
-		}
-
-		b.series = append(b.series, &profilestorepb.RawProfileSeries{
-			Labels:  profileSeries.Labels,
-			Samples: profileSeries.Samples,
-		})
+		dropped += b.appendSeries(profileSeries, r.Tenant, "buffer_full")
+	}
+	if dropped > 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "batcher buffer is full, dropped %d samples", dropped)
 	}
 
 	return &profilestorepb.WriteRawResponse{}, nil
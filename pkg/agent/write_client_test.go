@@ -21,7 +21,12 @@ import (
 
 	"github.com/go-kit/log"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func isEqualSample(a, b []*profilestorepb.RawSample) bool {
@@ -54,7 +59,7 @@ func compareProfileSeries(a, b []*profilestorepb.RawProfileSeries) bool {
 
 func TestWriteClient(t *testing.T) {
 	wc := NewNoopProfileStoreClient()
-	batcher := NewBatchWriteClient(log.NewNopLogger(), wc, time.Second)
+	batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, time.Second, 0, 0, DefaultMaxMessageSize, BatchModeRaw)
 
 	labelset1 := profilestorepb.LabelSet{
 		Labels: []*profilestorepb.Label{{
@@ -137,3 +142,132 @@ func TestWriteClient(t *testing.T) {
 		require.Equal(t, true, compareProfileSeries(batcher.series, series))
 	})
 }
+
+func TestWriteClientLimits(t *testing.T) {
+	ctx := context.Background()
+
+	labelset1 := &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "n1", Value: "v1"}}}
+	labelset2 := &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "n2", Value: "v2"}}}
+
+	t.Run("maxBytes", func(t *testing.T) {
+		batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), NewNoopProfileStoreClient(), time.Second, 4, 0, 0, BatchModeRaw)
+
+		_, err := batcher.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+			Series: []*profilestorepb.RawProfileSeries{{
+				Labels:  labelset1,
+				Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1, 2, 3}}, {RawProfile: []byte{4, 5}}},
+			}},
+		})
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Equal(t, 1, len(batcher.series))
+		require.Equal(t, 1, len(batcher.series[0].Samples))
+		require.Equal(t, 3, batcher.bytes)
+		require.Equal(t, float64(1), testutil.ToFloat64(batcher.metrics.droppedSamples.WithLabelValues("buffer_full")))
+	})
+
+	t.Run("maxSeries", func(t *testing.T) {
+		batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), NewNoopProfileStoreClient(), time.Second, 0, 1, 0, BatchModeRaw)
+
+		_, err := batcher.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+			Series: []*profilestorepb.RawProfileSeries{
+				{Labels: labelset1, Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}}},
+				{Labels: labelset2, Samples: []*profilestorepb.RawSample{{RawProfile: []byte{2}}}},
+				{Labels: labelset1, Samples: []*profilestorepb.RawSample{{RawProfile: []byte{3}}}},
+			},
+		})
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Equal(t, 1, len(batcher.series))
+		require.Equal(t, 2, len(batcher.series[0].Samples))
+	})
+
+	t.Run("unorderedLabels", func(t *testing.T) {
+		batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), NewNoopProfileStoreClient(), time.Second, 0, 0, 0, BatchModeRaw)
+
+		for _, ls := range []*profilestorepb.LabelSet{
+			{Labels: []*profilestorepb.Label{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}},
+			{Labels: []*profilestorepb.Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}}},
+		} {
+			_, err := batcher.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
+				Series: []*profilestorepb.RawProfileSeries{{Labels: ls, Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}}}},
+			})
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, len(batcher.series))
+		require.Equal(t, 2, len(batcher.series[0].Samples))
+	})
+}
+
+func TestSplitBatch(t *testing.T) {
+	labelset := &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "n1", Value: "v1"}}}
+	series := []*profilestorepb.RawProfileSeries{{
+		Labels: labelset,
+		Samples: []*profilestorepb.RawSample{
+			{RawProfile: bytes.Repeat([]byte{1}, 100)},
+			{RawProfile: bytes.Repeat([]byte{2}, 100)},
+			{RawProfile: bytes.Repeat([]byte{3}, 100)},
+		},
+	}}
+
+	reqs := splitBatch(series, 0)
+	require.Equal(t, 1, len(reqs))
+
+	reqs = splitBatch(series, 300)
+	require.Equal(t, 2, len(reqs))
+	for _, req := range reqs {
+		require.LessOrEqual(t, req.SizeVT(), 300)
+	}
+	require.Equal(t, 3, countSamples(reqs[0].Series)+countSamples(reqs[1].Series))
+
+	// A sample larger than the limit is still sent on its own.
+	reqs = splitBatch(series, 50)
+	require.Equal(t, 3, len(reqs))
+}
+
+type fakeProfileStoreClient struct {
+	errs     []error
+	calls    int
+	requests []*profilestorepb.WriteRawRequest
+}
+
+func (c *fakeProfileStoreClient) WriteRaw(ctx context.Context, in *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	c.calls++
+	if len(c.errs) == 0 {
+		c.requests = append(c.requests, in)
+		return &profilestorepb.WriteRawResponse{}, nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return nil, err
+}
+
+func TestWriteClientRetries(t *testing.T) {
+	ctx := context.Background()
+	labelset := &profilestorepb.LabelSet{Labels: []*profilestorepb.Label{{Name: "n1", Value: "v1"}}}
+	req := &profilestorepb.WriteRawRequest{
+		Series: []*profilestorepb.RawProfileSeries{{Labels: labelset, Samples: []*profilestorepb.RawSample{{RawProfile: []byte{1}}}}},
+	}
+
+	t.Run("retryable", func(t *testing.T) {
+		wc := &fakeProfileStoreClient{errs: []error{status.Error(codes.Unavailable, "unavailable")}}
+		batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, 5*time.Second, 0, 0, 0, BatchModeRaw)
+
+		_, err := batcher.WriteRaw(ctx, req)
+		require.NoError(t, err)
+		require.NoError(t, batcher.batchLoop(ctx))
+		require.Equal(t, 2, wc.calls)
+		require.Equal(t, float64(1), testutil.ToFloat64(batcher.metrics.retries))
+		require.Equal(t, float64(1), testutil.ToFloat64(batcher.metrics.sentSamples))
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		wc := &fakeProfileStoreClient{errs: []error{status.Error(codes.InvalidArgument, "invalid")}}
+		batcher := NewBatchWriteClient(log.NewNopLogger(), prometheus.NewRegistry(), wc, 5*time.Second, 0, 0, 0, BatchModeRaw)
+
+		_, err := batcher.WriteRaw(ctx, req)
+		require.NoError(t, err)
+		require.Error(t, batcher.batchLoop(ctx))
+		require.Equal(t, 1, wc.calls)
+		require.Equal(t, 0, len(batcher.series))
+		require.Equal(t, float64(1), testutil.ToFloat64(batcher.metrics.droppedSamples.WithLabelValues("send_failed")))
+	})
+}
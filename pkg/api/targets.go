@@ -0,0 +1,252 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api implements the JSON HTTP API of the agent. Its format follows
+// the HTTP API of Prometheus.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+const (
+	statusSuccess = "success"
+	statusError   = "error"
+
+	errorBadData = "bad_data"
+
+	healthUp      = "up"
+	healthDown    = "down"
+	healthUnknown = "unknown"
+)
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// TargetLister lists the targets known to the agent, by the name of the
+// discovery configuration they were discovered by.
+type TargetLister interface {
+	ActiveTargets() map[string][]target.ActiveTarget
+	DroppedTargets() map[string][]*target.Target
+}
+
+// ActiveTarget is a target that is being profiled.
+type ActiveTarget struct {
+	// DiscoveredLabels are the labels before relabeling.
+	DiscoveredLabels map[string]string `json:"discoveredLabels"`
+	// Labels are the labels after relabeling, which are attached to the
+	// profiles of the target.
+	Labels map[string]string `json:"labels"`
+	// Discovery is the name of the discovery configuration the target was
+	// discovered by, and Source the target group within it.
+	Discovery          string    `json:"discovery"`
+	Source             string    `json:"source"`
+	LastProfile        time.Time `json:"lastProfile"`
+	LastError          string    `json:"lastError"`
+	LastProfileSamples int64     `json:"lastProfileSamples"`
+	LastProfileBytes   int       `json:"lastProfileBytes"`
+	Health             string    `json:"health"`
+}
+
+// DroppedTarget is a discovered target that is not profiled.
+type DroppedTarget struct {
+	DiscoveredLabels map[string]string `json:"discoveredLabels"`
+	Discovery        string            `json:"discovery"`
+	Source           string            `json:"source"`
+	// Error is why the cgroup or process of the target could not be looked
+	// up, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// TargetDiscovery is the response of the targets endpoint.
+type TargetDiscovery struct {
+	ActiveTargets  []*ActiveTarget  `json:"activeTargets"`
+	DroppedTargets []*DroppedTarget `json:"droppedTargets"`
+}
+
+// TargetsHandler serves the targets known to the agent as JSON. The state URL
+// parameter selects active, dropped or any targets, and the targets can be
+// filtered by one or more match[] series selectors. Active targets are
+// matched by their labels, dropped targets by their discovered labels.
+type TargetsHandler struct {
+	logger  log.Logger
+	targets TargetLister
+}
+
+func NewTargetsHandler(logger log.Logger, targets TargetLister) *TargetsHandler {
+	return &TargetsHandler{
+		logger:  logger,
+		targets: targets,
+	}
+}
+
+func (h *TargetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.respondError(w, fmt.Errorf("parse form: %w", err))
+		return
+	}
+
+	state := r.Form.Get("state")
+	if state == "" {
+		state = "any"
+	}
+	if state != "active" && state != "dropped" && state != "any" {
+		h.respondError(w, fmt.Errorf("invalid state %q, expected active, dropped or any", state))
+		return
+	}
+
+	var selectors [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			h.respondError(w, fmt.Errorf("invalid match[] %q: %w", s, err))
+			return
+		}
+		selectors = append(selectors, matchers)
+	}
+
+	res := &TargetDiscovery{
+		ActiveTargets:  []*ActiveTarget{},
+		DroppedTargets: []*DroppedTarget{},
+	}
+	if state == "active" || state == "any" {
+		for discovery, targets := range h.targets.ActiveTargets() {
+			for _, t := range targets {
+				ls := t.Labels()
+				if !matches(selectors, ls) {
+					continue
+				}
+				res.ActiveTargets = append(res.ActiveTargets, newActiveTarget(discovery, t, ls))
+			}
+		}
+	}
+	if state == "dropped" || state == "any" {
+		for discovery, targets := range h.targets.DroppedTargets() {
+			for _, t := range targets {
+				if !matches(selectors, t.DiscoveredLabels()) {
+					continue
+				}
+				res.DroppedTargets = append(res.DroppedTargets, &DroppedTarget{
+					DiscoveredLabels: labelsMap(t.DiscoveredLabels()),
+					Discovery:        discovery,
+					Source:           t.Source(),
+					Error:            t.Error(),
+				})
+			}
+		}
+	}
+
+	sort.Slice(res.ActiveTargets, func(i, j int) bool {
+		return lessLabels(res.ActiveTargets[i].Labels, res.ActiveTargets[j].Labels)
+	})
+	sort.Slice(res.DroppedTargets, func(i, j int) bool {
+		return lessLabels(res.DroppedTargets[i].DiscoveredLabels, res.DroppedTargets[j].DiscoveredLabels)
+	})
+
+	h.respond(w, http.StatusOK, &response{Status: statusSuccess, Data: res})
+}
+
+func newActiveTarget(discovery string, t target.ActiveTarget, ls model.LabelSet) *ActiveTarget {
+	at := &ActiveTarget{
+		DiscoveredLabels: labelsMap(t.DiscoveredLabels()),
+		Labels:           labelsMap(ls),
+		Discovery:        discovery,
+		Source:           t.Source(),
+		Health:           healthUnknown,
+	}
+	if t.Profiler == nil {
+		return at
+	}
+
+	at.LastProfile = t.Profiler.LastProfileTakenAt()
+	at.LastProfileSamples, at.LastProfileBytes = t.Profiler.LastProfileSize()
+	if err := t.Profiler.LastError(); err != nil {
+		at.LastError = err.Error()
+		at.Health = healthDown
+	} else if !at.LastProfile.IsZero() {
+		at.Health = healthUp
+	}
+	return at
+}
+
+// matches reports whether ls matches all matchers of at least one of the
+// selectors, or whether there are no selectors.
+func matches(selectors [][]*labels.Matcher, ls model.LabelSet) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, matchers := range selectors {
+		matched := true
+		for _, m := range matchers {
+			if !m.Matches(string(ls[model.LabelName(m.Name)])) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func labelsMap(ls model.LabelSet) map[string]string {
+	res := make(map[string]string, len(ls))
+	for name, value := range ls {
+		res[string(name)] = string(value)
+	}
+	return res
+}
+
+func lessLabels(a, b map[string]string) bool {
+	return labels.FromMap(a).String() < labels.FromMap(b).String()
+}
+
+func (h *TargetsHandler) respondError(w http.ResponseWriter, err error) {
+	h.respond(w, http.StatusBadRequest, &response{
+		Status:    statusError,
+		ErrorType: errorBadData,
+		Error:     err.Error(),
+	})
+}
+
+func (h *TargetsHandler) respond(w http.ResponseWriter, code int, res *response) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		level.Error(h.logger).Log("msg", "failed to marshal response", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		level.Error(h.logger).Log("msg", "failed to write response", "err", err)
+	}
+}
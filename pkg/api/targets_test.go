@@ -0,0 +1,143 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+type fakeProfiler struct {
+	lastProfile time.Time
+	lastError   error
+}
+
+func (p *fakeProfiler) Labels() model.LabelSet        { return nil }
+func (p *fakeProfiler) LastProfileTakenAt() time.Time { return p.lastProfile }
+func (p *fakeProfiler) LastProfileSize() (int64, int) { return 42, 1024 }
+func (p *fakeProfiler) LastError() error              { return p.lastError }
+func (p *fakeProfiler) Stop()                         {}
+
+type fakeTargetLister struct {
+	active  map[string][]target.ActiveTarget
+	dropped map[string][]*target.Target
+}
+
+func (l *fakeTargetLister) ActiveTargets() map[string][]target.ActiveTarget { return l.active }
+func (l *fakeTargetLister) DroppedTargets() map[string][]*target.Target     { return l.dropped }
+
+func TestTargetsHandler(t *testing.T) {
+	lastProfile := time.Unix(1000, 0).UTC()
+	lister := &fakeTargetLister{
+		active: map[string][]target.ActiveTarget{
+			"pod": {{
+				Target: target.NewTarget(
+					model.LabelSet{"__cgroup_path__": "/a", "pod": "a", "node": "n"},
+					model.LabelSet{"__cgroup_path__": "/a", "pod": "a"},
+					"pod/default/a",
+				),
+				Profiler: &fakeProfiler{lastProfile: lastProfile},
+			}, {
+				Target: target.NewTarget(
+					model.LabelSet{"__cgroup_path__": "/b", "pod": "b", "node": "n"},
+					model.LabelSet{"__cgroup_path__": "/b", "pod": "b"},
+					"pod/default/b",
+				),
+				Profiler: &fakeProfiler{lastProfile: lastProfile, lastError: errors.New("failed")},
+			}},
+		},
+		dropped: map[string][]*target.Target{
+			"pod": {
+				target.NewTarget(nil, model.LabelSet{"pod": "c"}, "pod/default/c"),
+				target.NewTarget(nil, model.LabelSet{"pod": "d", "__error__": "find pid: not found"}, "pod/default/d"),
+			},
+		},
+	}
+	h := NewTargetsHandler(log.NewNopLogger(), lister)
+
+	get := func(q url.Values) (int, *TargetDiscovery) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/targets?"+q.Encode(), nil))
+
+		res := struct {
+			Status string           `json:"status"`
+			Data   *TargetDiscovery `json:"data"`
+		}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, res.Data
+	}
+
+	code, res := get(url.Values{})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []*ActiveTarget{{
+		DiscoveredLabels:   map[string]string{"__cgroup_path__": "/a", "pod": "a"},
+		Labels:             map[string]string{"pod": "a", "node": "n"},
+		Discovery:          "pod",
+		Source:             "pod/default/a",
+		LastProfile:        lastProfile,
+		LastProfileSamples: 42,
+		LastProfileBytes:   1024,
+		Health:             "up",
+	}, {
+		DiscoveredLabels:   map[string]string{"__cgroup_path__": "/b", "pod": "b"},
+		Labels:             map[string]string{"pod": "b", "node": "n"},
+		Discovery:          "pod",
+		Source:             "pod/default/b",
+		LastProfile:        lastProfile,
+		LastError:          "failed",
+		LastProfileSamples: 42,
+		LastProfileBytes:   1024,
+		Health:             "down",
+	}}, res.ActiveTargets)
+	require.Equal(t, []*DroppedTarget{{
+		DiscoveredLabels: map[string]string{"pod": "d", "__error__": "find pid: not found"},
+		Discovery:        "pod",
+		Source:           "pod/default/d",
+		Error:            "find pid: not found",
+	}, {
+		DiscoveredLabels: map[string]string{"pod": "c"},
+		Discovery:        "pod",
+		Source:           "pod/default/c",
+	}}, res.DroppedTargets)
+
+	_, res = get(url.Values{"match[]": {`{pod="b"}`, `{pod="c"}`}})
+	require.Equal(t, 1, len(res.ActiveTargets))
+	require.Equal(t, "b", res.ActiveTargets[0].Labels["pod"])
+	require.Equal(t, 1, len(res.DroppedTargets))
+
+	_, res = get(url.Values{"state": {"active"}, "match[]": {`{pod=~"a|c"}`}})
+	require.Equal(t, 1, len(res.ActiveTargets))
+	require.Equal(t, 0, len(res.DroppedTargets))
+
+	_, res = get(url.Values{"state": {"dropped"}})
+	require.Equal(t, 0, len(res.ActiveTargets))
+	require.Equal(t, 2, len(res.DroppedTargets))
+
+	code, _ = get(url.Values{"state": {"unknown"}})
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = get(url.Values{"match[]": {`{pod=`}})
+	require.Equal(t, http.StatusBadRequest, code)
+}
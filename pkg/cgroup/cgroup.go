@@ -0,0 +1,332 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cgroup resolves the cgroups of processes to the paths perf events
+// are attached to, whether the node uses cgroup v1, cgroup v2 or both, and
+// whichever cgroup driver the kubelet uses.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/procfs"
+)
+
+// Mode is how the cgroup hierarchies of the node are set up.
+type Mode int
+
+const (
+	// ModeLegacy is cgroup v1 only.
+	ModeLegacy Mode = iota
+	// ModeHybrid is cgroup v1 for the controllers, with the cgroup v2
+	// hierarchy mounted without controllers, usually at
+	// /sys/fs/cgroup/unified.
+	ModeHybrid
+	// ModeUnified is cgroup v2 only.
+	ModeUnified
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeLegacy:
+		return "legacy"
+	case ModeHybrid:
+		return "hybrid"
+	case ModeUnified:
+		return "unified"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Driver is how the cgroups of containers are laid out, which is set by the
+// cgroup driver of the kubelet and the container runtime.
+type Driver string
+
+const (
+	// DriverCgroupfs lays out cgroups as plain directories, such as
+	// /kubepods/burstable/pod<uid>/<container id>.
+	DriverCgroupfs Driver = "cgroupfs"
+	// DriverSystemd lays out cgroups as systemd slices and scopes, such as
+	// /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<container id>.scope.
+	DriverSystemd Driver = "systemd"
+)
+
+// DetectDriver returns the driver that laid out the cgroup at the given path.
+func DetectDriver(cgroupPath string) Driver {
+	for _, part := range strings.Split(cgroupPath, "/") {
+		if strings.HasSuffix(part, ".slice") || strings.HasSuffix(part, ".scope") {
+			return DriverSystemd
+		}
+	}
+	return DriverCgroupfs
+}
+
+// Cgroup is the cgroup of a process that perf events are attached to.
+type Cgroup struct {
+	// Path is the path of the cgroup directory to open, including the mount
+	// point of its hierarchy.
+	Path string
+	// Mode is the mode of the hierarchies of the node.
+	Mode Mode
+	// Driver is the driver that laid out the cgroup.
+	Driver Driver
+}
+
+// mount is a mounted cgroup hierarchy.
+type mount struct {
+	// point is where the hierarchy is mounted.
+	point string
+	// root is the cgroup of the hierarchy that is mounted, which is not the
+	// root cgroup if the mount comes from a cgroup namespace. It is relative
+	// to the ancestor up levels above the root of the cgroup namespace of
+	// the agent, if the mount comes from outside of it.
+	root string
+	up   int
+}
+
+// newMount returns the hierarchy of a cgroup mount.
+func newMount(m *procfs.MountInfo) *mount {
+	up, root := splitUp(m.Root)
+	return &mount{point: m.MountPoint, root: root, up: up}
+}
+
+// splitUp splits a cgroup path as seen from the cgroup namespace of the agent,
+// such as /../../kubepods, into the number of levels it goes above the root of
+// the namespace, and the rest of the path from there.
+func splitUp(cgroupPath string) (int, string) {
+	up := 0
+	for cgroupPath == "/.." || strings.HasPrefix(cgroupPath, "/../") {
+		up++
+		cgroupPath = cgroupPath[len("/.."):]
+	}
+	return up, path.Clean("/" + cgroupPath)
+}
+
+// Resolver resolves the cgroups of processes to the paths perf events are
+// attached to.
+type Resolver struct {
+	fs   procfs.FS
+	mode Mode
+	// perfEvent is the cgroup v1 hierarchy of the perf_event controller, and
+	// unified the cgroup v2 hierarchy.
+	perfEvent *mount
+	unified   *mount
+}
+
+// NewResolver returns a resolver for the cgroup hierarchies mounted in the
+// mount namespace of the agent.
+func NewResolver() (*Resolver, error) {
+	fs, err := procfs.NewDefaultFS()
+	if err != nil {
+		return nil, fmt.Errorf("open procfs: %w", err)
+	}
+	self, err := fs.Self()
+	if err != nil {
+		return nil, fmt.Errorf("open own process: %w", err)
+	}
+	return newResolver(fs, self)
+}
+
+func newResolver(fs procfs.FS, self procfs.Proc) (*Resolver, error) {
+	mounts, err := self.MountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("read mountinfo: %w", err)
+	}
+
+	r := &Resolver{fs: fs}
+	hasV1 := false
+	for _, m := range mounts {
+		switch m.FSType {
+		case "cgroup":
+			hasV1 = true
+			if _, ok := m.SuperOptions["perf_event"]; ok && r.perfEvent == nil {
+				r.perfEvent = newMount(m)
+			}
+		case "cgroup2":
+			if r.unified == nil {
+				r.unified = newMount(m)
+			}
+		}
+	}
+
+	switch {
+	case hasV1 && r.unified != nil:
+		r.mode = ModeHybrid
+	case hasV1:
+		r.mode = ModeLegacy
+	case r.unified != nil:
+		r.mode = ModeUnified
+	default:
+		return nil, errors.New("no cgroup hierarchy mounted")
+	}
+	if r.mode != ModeUnified && r.perfEvent == nil {
+		return nil, fmt.Errorf("no perf_event cgroup hierarchy mounted in %s mode", r.mode)
+	}
+	return r, nil
+}
+
+// Mode returns the mode of the hierarchies of the node.
+func (r *Resolver) Mode() Mode {
+	return r.mode
+}
+
+// Resolve returns the cgroup of the process with the given PID that perf
+// events are attached to. This is the cgroup of the perf_event controller,
+// unless the node only uses cgroup v2.
+func (r *Resolver) Resolve(pid int) (Cgroup, error) {
+	p, err := r.fs.Proc(pid)
+	if err != nil {
+		return Cgroup{}, err
+	}
+	cgroups, err := p.Cgroups()
+	if err != nil {
+		return Cgroup{}, fmt.Errorf("read cgroups of process %d: %w", pid, err)
+	}
+
+	m, cgroupPath, err := r.perfEventCgroup(cgroups)
+	if err != nil {
+		return Cgroup{}, fmt.Errorf("process %d: %w", pid, err)
+	}
+	rel, err := m.relative(cgroupPath)
+	if err != nil {
+		return Cgroup{}, fmt.Errorf("process %d: %w", pid, err)
+	}
+
+	return Cgroup{
+		Path:   path.Join(m.point, rel),
+		Mode:   r.mode,
+		Driver: DetectDriver(cgroupPath),
+	}, nil
+}
+
+// PerfEventPath returns the path of the given cgroup, such as the cgroup a
+// container runtime reports for a container, in the hierarchy perf events are
+// attached to. The cgroup is assumed to have the same path in every
+// hierarchy.
+func (r *Resolver) PerfEventPath(cgroupPath string) (string, error) {
+	m := r.perfEvent
+	if r.mode == ModeUnified {
+		m = r.unified
+	}
+	// Mounts from above the cgroup namespace of the agent are taken to be
+	// of the root cgroup, which the given path is relative to.
+	root := m.root
+	if m.up > 0 {
+		root = "/"
+	}
+	rel, err := m.relativeTo(root, path.Clean(cgroupPath))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(m.point, rel), nil
+}
+
+// perfEventCgroup returns the hierarchy and path of the cgroup perf events
+// are attached to, out of the cgroups of a process.
+func (r *Resolver) perfEventCgroup(cgroups []procfs.Cgroup) (*mount, string, error) {
+	for _, c := range cgroups {
+		if r.mode == ModeUnified {
+			if c.HierarchyID == 0 {
+				return r.unified, c.Path, nil
+			}
+			continue
+		}
+		for _, controller := range c.Controllers {
+			if controller == "perf_event" {
+				return r.perfEvent, c.Path, nil
+			}
+		}
+	}
+	if r.mode == ModeUnified {
+		return nil, "", errors.New("no cgroup v2 hierarchy found")
+	}
+	return nil, "", errors.New("no perf_event cgroup found")
+}
+
+// relative returns the path of the cgroup, as seen from the cgroup namespace
+// of the agent, relative to the mount point of the hierarchy.
+func (m *mount) relative(cgroupPath string) (string, error) {
+	// Processes outside of the cgroup namespace of the agent have paths
+	// relative to the root of the namespace, such as /../../kubepods. They
+	// can only be resolved if the mount is of the ancestor the path goes up
+	// to, as the names of the ancestors in between are unknown. This is the
+	// case if the cgroup shares no ancestor with the agent, below the root
+	// of the mount.
+	up, rel := splitUp(cgroupPath)
+	if up > m.up {
+		return "", fmt.Errorf("cgroup %s is not visible from the hierarchy mounted at %s", cgroupPath, m.point)
+	}
+	if up < m.up {
+		return "", fmt.Errorf("cgroup %s shares an ancestor of unknown path with the cgroup namespace of the agent", cgroupPath)
+	}
+	return m.relativeTo(m.root, rel)
+}
+
+// relativeTo returns the path of the cgroup relative to the mount point of the
+// hierarchy, whose root is the given cgroup.
+func (m *mount) relativeTo(root, cgroupPath string) (string, error) {
+	if root == "/" {
+		return cgroupPath, nil
+	}
+	if cgroupPath == root {
+		return "/", nil
+	}
+	if strings.HasPrefix(cgroupPath, root+"/") {
+		return strings.TrimPrefix(cgroupPath, root), nil
+	}
+	return "", fmt.Errorf("cgroup %s is not visible from the hierarchy mounted at %s", cgroupPath, m.point)
+}
+
+var (
+	defaultResolver     *Resolver
+	defaultResolverErr  error
+	defaultResolverOnce sync.Once
+)
+
+func getDefaultResolver() (*Resolver, error) {
+	defaultResolverOnce.Do(func() {
+		defaultResolver, defaultResolverErr = NewResolver()
+	})
+	return defaultResolver, defaultResolverErr
+}
+
+// PerfEventCgroupPath returns the path of the cgroup of the process with the
+// given PID that perf events are attached to, using a resolver for the
+// hierarchies mounted in the mount namespace of the agent.
+func PerfEventCgroupPath(pid int) (string, error) {
+	r, err := getDefaultResolver()
+	if err != nil {
+		return "", err
+	}
+
+	c, err := r.Resolve(pid)
+	if err != nil {
+		return "", err
+	}
+	return c.Path, nil
+}
+
+// PerfEventPath returns the path of the given cgroup that perf events are
+// attached to, using a resolver for the hierarchies mounted in the mount
+// namespace of the agent.
+func PerfEventPath(cgroupPath string) (string, error) {
+	r, err := getDefaultResolver()
+	if err != nil {
+		return "", err
+	}
+	return r.PerfEventPath(cgroupPath)
+}
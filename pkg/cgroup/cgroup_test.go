@@ -0,0 +1,162 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgroup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	podUID      = "0f5c1f1e-7d2c-4a4f-9a51-3c9c1b2f3a4b"
+	podUIDSlice = "0f5c1f1e_7d2c_4a4f_9a51_3c9c1b2f3a4b"
+	containerID = "7a3f9c2e5d1b4a6f8e0c3b5d7f9a1c3e5b7d9f1a3c5e7b9d1f3a5c7e9b1d3f5a"
+)
+
+// testResolver returns a resolver for the proc tree of the fixture, in which
+// PID 1 is the agent.
+func testResolver(t *testing.T, fixture string) *Resolver {
+	t.Helper()
+
+	fs, err := procfs.NewFS(filepath.Join("testdata", fixture))
+	require.NoError(t, err)
+	self, err := fs.Proc(1)
+	require.NoError(t, err)
+	r, err := newResolver(fs, self)
+	require.NoError(t, err)
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	testCases := []struct {
+		fixture string
+		pid     int
+		want    Cgroup
+	}{
+		{
+			fixture: "ubuntu-20.04",
+			pid:     4242,
+			want: Cgroup{
+				Path:   "/sys/fs/cgroup/perf_event/kubepods/burstable/pod" + podUID + "/" + containerID,
+				Mode:   ModeHybrid,
+				Driver: DriverCgroupfs,
+			},
+		},
+		{
+			fixture: "ubuntu-22.04",
+			pid:     4242,
+			want: Cgroup{
+				Path:   "/sys/fs/cgroup/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + podUIDSlice + ".slice/cri-containerd-" + containerID + ".scope",
+				Mode:   ModeUnified,
+				Driver: DriverSystemd,
+			},
+		},
+		{
+			fixture: "centos-7",
+			pid:     4242,
+			want: Cgroup{
+				Path:   "/sys/fs/cgroup/perf_event/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + podUIDSlice + ".slice/docker-" + containerID + ".scope",
+				Mode:   ModeLegacy,
+				Driver: DriverSystemd,
+			},
+		},
+		{
+			// The agent runs in its own cgroup namespace, with the host
+			// hierarchy mounted.
+			fixture: "cgroupns",
+			pid:     4242,
+			want: Cgroup{
+				Path:   "/sys/fs/cgroup/kubepods/burstable/pod" + podUID + "/" + containerID,
+				Mode:   ModeUnified,
+				Driver: DriverCgroupfs,
+			},
+		},
+		{
+			// The agent only sees its own cgroup in the hierarchy.
+			fixture: "docker-private",
+			pid:     4242,
+			want: Cgroup{
+				Path:   "/sys/fs/cgroup/perf_event",
+				Mode:   ModeLegacy,
+				Driver: DriverCgroupfs,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.fixture, func(t *testing.T) {
+			r := testResolver(t, tc.fixture)
+			require.Equal(t, tc.want.Mode, r.Mode())
+
+			c, err := r.Resolve(tc.pid)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, c)
+		})
+	}
+}
+
+func TestResolveNotVisible(t *testing.T) {
+	r := testResolver(t, "docker-private")
+
+	_, err := r.Resolve(4343)
+	require.EqualError(t, err, "process 4343: cgroup /docker/def is not visible from the hierarchy mounted at /sys/fs/cgroup/perf_event")
+}
+
+func TestResolveSharedAncestor(t *testing.T) {
+	// The agent runs in its own cgroup namespace in a pod, under /kubepods
+	// like the target, with the host hierarchy mounted. The path of the
+	// target is relative to /kubepods, which is unknown to the agent.
+	r := testResolver(t, "cgroupns-shared")
+
+	_, err := r.Resolve(4242)
+	require.EqualError(t, err, "process 4242: cgroup /../../../burstable/pod"+podUID+"/"+containerID+" shares an ancestor of unknown path with the cgroup namespace of the agent")
+
+	// The cgroup the runtime reports is resolved instead.
+	path, err := r.PerfEventPath("/kubepods/burstable/pod" + podUID + "/" + containerID)
+	require.NoError(t, err)
+	require.Equal(t, "/sys/fs/cgroup/kubepods/burstable/pod"+podUID+"/"+containerID, path)
+}
+
+func TestResolveMissingProcess(t *testing.T) {
+	r := testResolver(t, "ubuntu-22.04")
+
+	_, err := r.Resolve(9999)
+	require.Error(t, err)
+}
+
+func TestPerfEventPath(t *testing.T) {
+	cgroupPath := "/kubepods/besteffort/pod" + podUID + "/" + containerID
+
+	path, err := testResolver(t, "ubuntu-20.04").PerfEventPath(cgroupPath)
+	require.NoError(t, err)
+	require.Equal(t, "/sys/fs/cgroup/perf_event"+cgroupPath, path)
+
+	path, err = testResolver(t, "ubuntu-22.04").PerfEventPath(cgroupPath)
+	require.NoError(t, err)
+	require.Equal(t, "/sys/fs/cgroup"+cgroupPath, path)
+
+	_, err = testResolver(t, "docker-private").PerfEventPath(cgroupPath)
+	require.Error(t, err)
+}
+
+func TestDetectDriver(t *testing.T) {
+	require.Equal(t, DriverSystemd, DetectDriver("/system.slice/docker-abc.scope"))
+	require.Equal(t, DriverSystemd, DetectDriver("/kubepods.slice/kubepods-pod1.slice/cri-containerd-abc.scope"))
+	require.Equal(t, DriverCgroupfs, DetectDriver("/kubepods/besteffort/pod1/abc"))
+	require.Equal(t, DriverCgroupfs, DetectDriver("/docker/abc"))
+}
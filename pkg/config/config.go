@@ -0,0 +1,558 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+	"github.com/parca-dev/parca-agent/pkg/discovery"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+var (
+	// DefaultConfig is the default top-level configuration.
+	DefaultConfig = Config{
+		Profiling: DefaultProfilingConfig,
+	}
+
+	// DefaultProfilingConfig is the default profiling configuration.
+	DefaultProfilingConfig = ProfilingConfig{
+		Duration: model.Duration(10 * time.Second),
+	}
+
+	// DefaultKubeletConfig is the default configuration to discover pods from
+	// the kubelet, with the token of the service account of the agent.
+	DefaultKubeletConfig = KubeletConfig{
+		URL:             "https://127.0.0.1:10250",
+		RefreshInterval: model.Duration(10 * time.Second),
+		HTTPClientConfig: commonconfig.HTTPClientConfig{
+			BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			TLSConfig: commonconfig.TLSConfig{
+				CAFile: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+			},
+			FollowRedirects: true,
+		},
+	}
+
+	// DefaultContainerdConfig is the default containerd discovery
+	// configuration.
+	DefaultContainerdConfig = ContainerdConfig{
+		RefreshInterval: model.Duration(5 * time.Second),
+	}
+
+	// DefaultProcessConfig is the default process discovery configuration.
+	DefaultProcessConfig = ProcessConfig{
+		RefreshInterval: model.Duration(5 * time.Second),
+	}
+
+	// DefaultFileConfig is the default file discovery configuration.
+	DefaultFileConfig = FileConfig{
+		RefreshInterval: model.Duration(5 * time.Minute),
+	}
+)
+
+// Config is the configuration of the agent that can be reloaded while it is
+// running.
+type Config struct {
+	// ExternalLabels are attached to all profiles.
+	ExternalLabels model.LabelSet `yaml:"external_labels,omitempty"`
+	// Profiling configures how targets are profiled.
+	Profiling ProfilingConfig `yaml:"profiling,omitempty"`
+	// Sampling selects the targets to profile, of the discovery
+	// configurations without their own.
+	Sampling *target.SamplingConfig `yaml:"sampling,omitempty"`
+	// Stores are the stores to send profiles to. Debug information is only
+	// uploaded to the first store.
+	Stores []*agent.StoreConfig `yaml:"stores,omitempty"`
+	// DiscoveryConfigs configure how the targets to profile are discovered.
+	DiscoveryConfigs []*DiscoveryConfig `yaml:"discovery_configs,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultConfig
+	type plain Config
+	return unmarshal((*plain)(c))
+}
+
+// Validate makes sure the configuration is complete and consistent.
+func (c *Config) Validate() error {
+	if err := c.ExternalLabels.Validate(); err != nil {
+		return fmt.Errorf("invalid external labels: %w", err)
+	}
+	if c.Profiling.Duration <= 0 {
+		return errors.New("profiling duration must be positive")
+	}
+	if c.Sampling != nil {
+		if err := c.Sampling.Validate(); err != nil {
+			return err
+		}
+	}
+	for i, s := range c.Stores {
+		if s == nil {
+			return fmt.Errorf("empty store config %d", i)
+		}
+	}
+	if err := agent.ValidateStoreConfigs(c.Stores); err != nil {
+		return err
+	}
+
+	names := map[string]struct{}{}
+	for i, dc := range c.DiscoveryConfigs {
+		if dc == nil {
+			return fmt.Errorf("empty discovery config %d", i)
+		}
+		if err := dc.Validate(); err != nil {
+			return fmt.Errorf("discovery config %q: %w", dc.Name, err)
+		}
+		if _, ok := names[dc.Name]; ok {
+			return fmt.Errorf("duplicate discovery config name %q", dc.Name)
+		}
+		names[dc.Name] = struct{}{}
+	}
+	return nil
+}
+
+// DiscoveryManagerConfigs returns the discovery configurations, by their
+// name, to apply to the discovery manager.
+func (c *Config) DiscoveryManagerConfigs(node string) map[string]discovery.Configs {
+	res := make(map[string]discovery.Configs, len(c.DiscoveryConfigs))
+	for _, dc := range c.DiscoveryConfigs {
+		res[dc.Name] = dc.configs(node)
+	}
+	return res
+}
+
+// RelabelConfigs returns the relabel configurations of the targets, by the
+// name of the discovery configuration they apply to.
+func (c *Config) RelabelConfigs() map[string][]*relabel.Config {
+	res := make(map[string][]*relabel.Config, len(c.DiscoveryConfigs))
+	for _, dc := range c.DiscoveryConfigs {
+		if len(dc.RelabelConfigs) > 0 {
+			res[dc.Name] = dc.RelabelConfigs
+		}
+	}
+	return res
+}
+
+// SamplingConfigs returns the sampling configurations of the targets, by the
+// name of the discovery configuration they apply to.
+func (c *Config) SamplingConfigs() map[string]*target.SamplingConfig {
+	res := make(map[string]*target.SamplingConfig, len(c.DiscoveryConfigs))
+	for _, dc := range c.DiscoveryConfigs {
+		if dc.Sampling != nil {
+			res[dc.Name] = dc.Sampling
+		} else if c.Sampling != nil {
+			res[dc.Name] = c.Sampling
+		}
+	}
+	return res
+}
+
+// ProfilingConfig configures how targets are profiled.
+type ProfilingConfig struct {
+	// Duration is how long each profile covers.
+	Duration model.Duration `yaml:"duration,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ProfilingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultProfilingConfig
+	type plain ProfilingConfig
+	return unmarshal((*plain)(c))
+}
+
+// DiscoveryConfig configures one discovery mechanism and the relabeling of
+// the targets it discovers. Exactly one mechanism must be set.
+type DiscoveryConfig struct {
+	// Name identifies the targets of the configuration, in the status page
+	// and the metrics of the agent.
+	Name string `yaml:"name"`
+
+	Kubernetes *KubernetesConfig `yaml:"kubernetes,omitempty"`
+	Systemd    *SystemdConfig    `yaml:"systemd,omitempty"`
+	Docker     *DockerConfig     `yaml:"docker,omitempty"`
+	Containerd *ContainerdConfig `yaml:"containerd,omitempty"`
+	Process    *ProcessConfig    `yaml:"process,omitempty"`
+	File       *FileConfig       `yaml:"file,omitempty"`
+
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// Sampling selects the targets to profile, instead of the top-level
+	// sampling configuration.
+	Sampling *target.SamplingConfig `yaml:"sampling,omitempty"`
+}
+
+// Validate makes sure exactly one discovery mechanism is set and that it is
+// valid.
+func (c *DiscoveryConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("name must not be empty")
+	}
+
+	set := 0
+	for _, ok := range []bool{
+		c.Kubernetes != nil,
+		c.Systemd != nil,
+		c.Docker != nil,
+		c.Containerd != nil,
+		c.Process != nil,
+		c.File != nil,
+	} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one discovery mechanism must be set, got %d", set)
+	}
+
+	switch {
+	case c.Kubernetes != nil:
+		if err := c.Kubernetes.validate(); err != nil {
+			return err
+		}
+	case c.Systemd != nil:
+		if len(c.Systemd.Units) == 0 {
+			return errors.New("systemd units must not be empty")
+		}
+	case c.Docker != nil:
+		if err := validateImageLabels(c.Docker.ImageLabels); err != nil {
+			return err
+		}
+	case c.Containerd != nil:
+		if err := validateImageLabels(c.Containerd.ImageLabels); err != nil {
+			return err
+		}
+		if len(c.Containerd.Namespaces) == 0 {
+			return errors.New("containerd namespaces must not be empty")
+		}
+		if c.Containerd.RefreshInterval <= 0 {
+			return errors.New("containerd refresh interval must be positive")
+		}
+	case c.Process != nil:
+		if err := c.Process.validate(); err != nil {
+			return err
+		}
+	case c.File != nil:
+		if len(c.File.Files) == 0 {
+			return errors.New("files must not be empty")
+		}
+		for _, pattern := range c.File.Files {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+			}
+		}
+		if c.File.RefreshInterval <= 0 {
+			return errors.New("file refresh interval must be positive")
+		}
+	}
+
+	for i, rc := range c.RelabelConfigs {
+		if rc == nil {
+			return fmt.Errorf("empty relabel config %d", i)
+		}
+	}
+	if c.Sampling != nil {
+		return c.Sampling.Validate()
+	}
+	return nil
+}
+
+func (c *DiscoveryConfig) configs(node string) discovery.Configs {
+	switch {
+	case c.Kubernetes != nil:
+		pod := discovery.NewPodConfig(
+			c.Kubernetes.PodLabelSelector,
+			c.Kubernetes.SocketPath,
+			node,
+			c.Kubernetes.PodLabels,
+			c.Kubernetes.PodAnnotations,
+			c.Kubernetes.OptIn,
+			c.Kubernetes.ImageLabels,
+		)
+		if k := c.Kubernetes.Kubelet; k != nil {
+			return discovery.Configs{discovery.NewKubeletConfig(
+				pod,
+				k.URL,
+				k.HTTPClientConfig,
+				time.Duration(k.RefreshInterval),
+			)}
+		}
+		return discovery.Configs{pod}
+	case c.Systemd != nil:
+		return discovery.Configs{discovery.NewSystemdConfig(
+			c.Systemd.Units,
+			c.Systemd.CgroupPath,
+		)}
+	case c.Docker != nil:
+		return discovery.Configs{discovery.NewDockerConfig(
+			c.Docker.SocketPath,
+			c.Docker.ContainerLabels,
+			c.Docker.ImageLabels,
+		)}
+	case c.Containerd != nil:
+		configs := make(discovery.Configs, 0, len(c.Containerd.Namespaces))
+		for _, namespace := range c.Containerd.Namespaces {
+			configs = append(configs, discovery.NewContainerdConfig(
+				c.Containerd.SocketPath,
+				namespace,
+				c.Containerd.ContainerLabels,
+				c.Containerd.ImageLabels,
+				time.Duration(c.Containerd.RefreshInterval),
+			))
+		}
+		return configs
+	case c.Process != nil:
+		return discovery.Configs{discovery.NewProcessConfig(
+			discovery.ProcessMatcher{
+				Executable: c.Process.Executable,
+				Cmdline:    c.Process.Cmdline,
+				User:       c.Process.User,
+				Parent:     c.Process.Parent,
+			},
+			time.Duration(c.Process.RefreshInterval),
+		)}
+	case c.File != nil:
+		return discovery.Configs{discovery.NewFileConfig(
+			c.File.Files,
+			time.Duration(c.File.RefreshInterval),
+		)}
+	}
+	return nil
+}
+
+// KubernetesConfig discovers the containers of the Pods running on the node.
+type KubernetesConfig struct {
+	PodLabelSelector string `yaml:"pod_label_selector,omitempty"`
+	SocketPath       string `yaml:"socket_path,omitempty"`
+	// PodLabels and PodAnnotations map the names of the pod labels and
+	// annotations to attach to the names of the labels they are attached as,
+	// which default to their sanitized names if empty.
+	PodLabels      map[string]string `yaml:"pod_labels,omitempty"`
+	PodAnnotations map[string]string `yaml:"pod_annotations,omitempty"`
+	// OptIn only profiles the pods annotated with parca.dev/profile: "true",
+	// instead of all pods not annotated with parca.dev/profile: "false".
+	OptIn bool `yaml:"opt_in,omitempty"`
+	// ImageLabels are the labels the images of containers are attached as,
+	// out of image, image_tag and image_digest.
+	ImageLabels []string `yaml:"image_labels"`
+	// Kubelet discovers the pods from the kubelet of the node, rather than
+	// from the API server.
+	Kubelet *KubeletConfig `yaml:"kubelet,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *KubernetesConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = KubernetesConfig{ImageLabels: discovery.DefaultImageLabels()}
+	type plain KubernetesConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *KubernetesConfig) validate() error {
+	if err := validateImageLabels(c.ImageLabels); err != nil {
+		return err
+	}
+	if c.Kubelet != nil {
+		if err := c.Kubelet.validate(); err != nil {
+			return fmt.Errorf("kubelet: %w", err)
+		}
+	}
+	for _, mapping := range []map[string]string{c.PodLabels, c.PodAnnotations} {
+		for name, labelName := range mapping {
+			if labelName != "" && !model.LabelName(labelName).IsValid() {
+				return fmt.Errorf("invalid label name %q for %q", labelName, name)
+			}
+		}
+	}
+	return nil
+}
+
+// KubeletConfig discovers pods from the /pods endpoint of a kubelet.
+type KubeletConfig struct {
+	URL             string         `yaml:"url"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+	// HTTPClientConfig configures the authentication and TLS of the requests
+	// to the kubelet.
+	HTTPClientConfig commonconfig.HTTPClientConfig `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *KubeletConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultKubeletConfig
+	type plain KubeletConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *KubeletConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL %q must be http or https", c.URL)
+	}
+	if c.RefreshInterval <= 0 {
+		return errors.New("refresh interval must be positive")
+	}
+	return c.HTTPClientConfig.Validate()
+}
+
+// validateImageLabels makes sure the images of containers can be attached as
+// the labels.
+func validateImageLabels(names []string) error {
+	for _, name := range names {
+		if !discovery.IsImageLabel(name) {
+			return fmt.Errorf("invalid image label %q, must be one of %s", name, strings.Join(discovery.DefaultImageLabels(), ", "))
+		}
+	}
+	return nil
+}
+
+// SystemdConfig discovers systemd units.
+type SystemdConfig struct {
+	Units      []string `yaml:"units"`
+	CgroupPath string   `yaml:"cgroup_path,omitempty"`
+}
+
+// DockerConfig discovers the containers of the Docker daemon.
+type DockerConfig struct {
+	SocketPath      string   `yaml:"socket_path,omitempty"`
+	ContainerLabels []string `yaml:"container_labels,omitempty"`
+	// ImageLabels are the labels the images of containers are attached as,
+	// out of image, image_tag and image_digest.
+	ImageLabels []string `yaml:"image_labels"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *DockerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DockerConfig{ImageLabels: discovery.DefaultImageLabels()}
+	type plain DockerConfig
+	return unmarshal((*plain)(c))
+}
+
+// ContainerdConfig discovers the containers of containerd namespaces.
+type ContainerdConfig struct {
+	SocketPath      string         `yaml:"socket_path,omitempty"`
+	Namespaces      []string       `yaml:"namespaces"`
+	ContainerLabels []string       `yaml:"container_labels,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+	// ImageLabels are the labels the images of containers are attached as,
+	// out of image, image_tag and image_digest.
+	ImageLabels []string `yaml:"image_labels"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ContainerdConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultContainerdConfig
+	c.ImageLabels = discovery.DefaultImageLabels()
+	type plain ContainerdConfig
+	return unmarshal((*plain)(c))
+}
+
+// ProcessConfig discovers the processes matching all of the non-empty
+// matchers.
+type ProcessConfig struct {
+	Executable      string         `yaml:"executable,omitempty"`
+	Cmdline         string         `yaml:"cmdline,omitempty"`
+	User            string         `yaml:"user,omitempty"`
+	Parent          string         `yaml:"parent,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ProcessConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultProcessConfig
+	type plain ProcessConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *ProcessConfig) validate() error {
+	if c.Executable == "" && c.Cmdline == "" && c.User == "" && c.Parent == "" {
+		return errors.New("process matcher must not be empty")
+	}
+	for _, pattern := range []string{c.Executable, c.Parent} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid executable pattern %q: %w", pattern, err)
+		}
+	}
+	if _, err := regexp.Compile(c.Cmdline); err != nil {
+		return fmt.Errorf("invalid cmdline regex: %w", err)
+	}
+	if c.RefreshInterval <= 0 {
+		return errors.New("process refresh interval must be positive")
+	}
+	return nil
+}
+
+// FileConfig discovers the targets listed in files.
+type FileConfig struct {
+	Files           []string       `yaml:"files"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *FileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultFileConfig
+	type plain FileConfig
+	return unmarshal((*plain)(c))
+}
+
+// Load reads and validates the configuration in the YAML file at filename.
+// Relative file paths are resolved against the directory of the file.
+func Load(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	cfg := DefaultConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", filename, err)
+	}
+
+	dir := filepath.Dir(filename)
+	for _, s := range cfg.Stores {
+		if s != nil {
+			s.SetDirectory(dir)
+		}
+	}
+	for _, dc := range cfg.DiscoveryConfigs {
+		if dc != nil && dc.Kubernetes != nil && dc.Kubernetes.Kubelet != nil {
+			dc.Kubernetes.Kubelet.HTTPClientConfig.SetDirectory(dir)
+		}
+		if dc != nil && dc.File != nil {
+			for i, f := range dc.File.Files {
+				dc.File.Files[i] = commonconfig.JoinDir(dir, f)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", filename, err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/discovery"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/config.yaml")
+	require.NoError(t, err)
+
+	require.Equal(t, model.LabelSet{"region": "eu-west-1"}, cfg.ExternalLabels)
+	require.Equal(t, model.Duration(20*time.Second), cfg.Profiling.Duration)
+	require.Equal(t, 1, len(cfg.Stores))
+	require.Equal(t, "testdata/token", cfg.Stores[0].BearerTokenFile)
+
+	require.Equal(t, 5, len(cfg.DiscoveryConfigs))
+	require.Equal(t, []string{"image", "image_tag"}, cfg.DiscoveryConfigs[0].Kubernetes.ImageLabels)
+	require.Equal(t, model.Duration(5*time.Second), cfg.DiscoveryConfigs[2].Containerd.RefreshInterval)
+	require.Equal(t, []string{"image"}, cfg.DiscoveryConfigs[2].Containerd.ImageLabels)
+	require.Equal(t, model.Duration(5*time.Second), cfg.DiscoveryConfigs[3].Process.RefreshInterval)
+	require.Equal(t, []string{"testdata/targets/*.yaml"}, cfg.DiscoveryConfigs[4].File.Files)
+	require.Equal(t, model.Duration(5*time.Minute), cfg.DiscoveryConfigs[4].File.RefreshInterval)
+
+	configs := cfg.DiscoveryManagerConfigs("node-a")
+	require.Equal(t, 5, len(configs))
+	require.Equal(t, 2, len(configs["runtimes"]), "one discoverer per containerd namespace")
+	require.Equal(t, "node-a", configs["pods"][0].Name())
+
+	samplingConfigs := cfg.SamplingConfigs()
+	require.Equal(t, 5, len(samplingConfigs))
+	require.Equal(t, 0.2, samplingConfigs["pods"].Ratio)
+	require.Equal(t, map[string]float64{"production": 1}, samplingConfigs["pods"].NamespaceRatios)
+	require.Equal(t, 0.5, samplingConfigs["services"].Ratio)
+	require.Equal(t, []string{"namespace", "deployment"}, samplingConfigs["services"].Labels)
+
+	relabelConfigs := cfg.RelabelConfigs()
+	require.Equal(t, 1, len(relabelConfigs))
+	require.Equal(t, relabel.Drop, relabelConfigs["pods"][0].Action)
+}
+
+func TestLoadKubelet(t *testing.T) {
+	filename := writeConfig(t, `
+discovery_configs:
+  - name: pods
+    kubernetes:
+      kubelet:
+        bearer_token_file: token
+        tls_config:
+          insecure_skip_verify: true
+`)
+	cfg, err := Load(filename)
+	require.NoError(t, err)
+
+	kubelet := cfg.DiscoveryConfigs[0].Kubernetes.Kubelet
+	require.Equal(t, "https://127.0.0.1:10250", kubelet.URL)
+	require.Equal(t, model.Duration(10*time.Second), kubelet.RefreshInterval)
+	require.Equal(t, filepath.Join(filepath.Dir(filename), "token"), kubelet.HTTPClientConfig.Authorization.CredentialsFile)
+	require.True(t, kubelet.HTTPClientConfig.TLSConfig.InsecureSkipVerify)
+
+	configs := cfg.DiscoveryManagerConfigs("node-a")
+	require.IsType(t, &discovery.KubeletConfig{}, configs["pods"][0])
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "{}"))
+	require.NoError(t, err)
+	require.Equal(t, DefaultProfilingConfig, cfg.Profiling)
+	require.Empty(t, cfg.DiscoveryConfigs)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "unknown field",
+			config: "scrape_configs: []",
+		},
+		{
+			name:   "invalid external label",
+			config: `external_labels: {"0node": a}`,
+		},
+		{
+			name:   "zero profiling duration",
+			config: "profiling: {duration: 0s}",
+		},
+		{
+			name:   "invalid sampling ratio",
+			config: "sampling: {ratio: 2}",
+		},
+		{
+			name:   "invalid discovery sampling ratio",
+			config: "discovery_configs: [{name: a, docker: {}, sampling: {ratio: -1}}]",
+		},
+		{
+			name:   "store without address",
+			config: "stores: [{name: default}]",
+		},
+		{
+			name:   "discovery without name",
+			config: "discovery_configs: [{systemd: {units: [a.service]}}]",
+		},
+		{
+			name:   "duplicate discovery name",
+			config: "discovery_configs: [{name: a, docker: {}}, {name: a, kubernetes: {}}]",
+		},
+		{
+			name:   "no discovery mechanism",
+			config: "discovery_configs: [{name: a}]",
+		},
+		{
+			name:   "several discovery mechanisms",
+			config: "discovery_configs: [{name: a, docker: {}, kubernetes: {}}]",
+		},
+		{
+			name:   "invalid pod label mapping",
+			config: "discovery_configs: [{name: a, kubernetes: {pod_labels: {app.kubernetes.io/name: app-name}}}]",
+		},
+		{
+			name:   "invalid image label",
+			config: "discovery_configs: [{name: a, kubernetes: {image_labels: [image_version]}}]",
+		},
+		{
+			name:   "invalid container image label",
+			config: "discovery_configs: [{name: a, docker: {image_labels: [image_version]}}]",
+		},
+		{
+			name:   "invalid kubelet URL",
+			config: "discovery_configs: [{name: a, kubernetes: {kubelet: {url: '127.0.0.1:10250'}}}]",
+		},
+		{
+			name:   "empty process matcher",
+			config: "discovery_configs: [{name: a, process: {}}]",
+		},
+		{
+			name:   "invalid cmdline",
+			config: "discovery_configs: [{name: a, process: {cmdline: '('}}]",
+		},
+		{
+			name:   "invalid relabel config",
+			config: "discovery_configs: [{name: a, docker: {}, relabel_configs: [{regex: '('}]}]",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tc.config))
+			require.Error(t, err)
+		})
+	}
+}
+
+func writeConfig(t *testing.T, config string) string {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(config), 0o644))
+	return filename
+}
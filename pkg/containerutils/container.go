@@ -0,0 +1,128 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package containerutils
+
+import "strings"
+
+// Container is a running container as reported by a container runtime.
+type Container struct {
+	ID     string
+	Name   string
+	Image  Image
+	PID    int
+	Labels map[string]string
+	// CgroupPath is the cgroup of the container as configured by the
+	// runtime, which is empty if the runtime does not report it.
+	CgroupPath string
+}
+
+// ContainerStatus is the status of a running container as reported by a
+// container runtime.
+type ContainerStatus struct {
+	PID   int
+	Image Image
+	// CgroupPath is the cgroup of the container as configured by the
+	// runtime, such as /kubepods/besteffort/pod<uid>/<container id>. It is
+	// empty if the runtime does not report it.
+	CgroupPath string
+}
+
+// Image is the image of a container.
+type Image struct {
+	// Name is the repository of the image, such as docker.io/library/nginx,
+	// or its ID if the container was started from an untagged image.
+	Name string
+	// Tag is the tag of the image, such as 1.21, if it was referenced by
+	// tag.
+	Tag string
+	// Digest is the digest of the manifest of the image, such as
+	// sha256:<hex>, if it is known.
+	Digest string
+}
+
+// ParseImage parses an image reference of the form name[:tag][@digest].
+// References without a repository, such as image IDs, are kept as the name.
+func ParseImage(ref string) Image {
+	var img Image
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref, img.Digest = ref[:i], ref[i+1:]
+	}
+	// The last colon separates the tag, unless it is the port of the
+	// registry.
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") && !isImageID(ref) {
+		ref, img.Tag = ref[:i], ref[i+1:]
+	}
+	img.Name = ref
+	return img
+}
+
+// isImageID reports whether the reference is an image ID rather than a
+// repository, such as sha256:<hex>.
+func isImageID(ref string) bool {
+	return strings.HasPrefix(ref, "sha256:") && !strings.Contains(ref, "/")
+}
+
+// Reference returns the reference of the image, of the form
+// name[:tag][@digest].
+func (i Image) Reference() string {
+	ref := i.Name
+	if i.Tag != "" {
+		ref += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		ref += "@" + i.Digest
+	}
+	return ref
+}
+
+// CgroupFromCgroupsPath returns the cgroup configured by the cgroupsPath of
+// an OCI runtime spec. With the systemd cgroup driver, it is of the form
+// slice:prefix:name, such as
+// kubepods-besteffort-pod<uid>.slice:cri-containerd:<container id>, which is
+// the cgroup
+// /kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/cri-containerd-<container id>.scope.
+func CgroupFromCgroupsPath(cgroupsPath string) string {
+	if cgroupsPath == "" || strings.HasPrefix(cgroupsPath, "/") {
+		return cgroupsPath
+	}
+
+	parts := strings.Split(cgroupsPath, ":")
+	if len(parts) != 3 {
+		// Relative cgroupfs paths are relative to a cgroup the runtime
+		// chooses, so they are of no use.
+		return ""
+	}
+	slice, prefix, name := parts[0], parts[1], parts[2]
+
+	// Each dash in the name of a slice is a level of the hierarchy, and the
+	// -.slice is the root.
+	var cgroup strings.Builder
+	if slice != "-.slice" && slice != "" {
+		sliceName := strings.TrimSuffix(slice, ".slice")
+		components := strings.Split(sliceName, "-")
+		for i := range components {
+			cgroup.WriteString("/" + strings.Join(components[:i+1], "-") + ".slice")
+		}
+	}
+
+	unit := name
+	if !strings.HasSuffix(name, ".slice") {
+		if prefix != "" {
+			unit = prefix + "-" + name
+		}
+		unit += ".scope"
+	}
+	cgroup.WriteString("/" + unit)
+	return cgroup.String()
+}
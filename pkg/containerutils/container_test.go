@@ -0,0 +1,98 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package containerutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImage(t *testing.T) {
+	const digest = "sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31"
+
+	for _, tc := range []struct {
+		ref      string
+		expected Image
+	}{
+		{
+			ref:      "nginx",
+			expected: Image{Name: "nginx"},
+		},
+		{
+			ref:      "nginx:1.21",
+			expected: Image{Name: "nginx", Tag: "1.21"},
+		},
+		{
+			ref:      "docker.io/library/nginx:1.21@" + digest,
+			expected: Image{Name: "docker.io/library/nginx", Tag: "1.21", Digest: digest},
+		},
+		{
+			ref:      "docker.io/library/nginx@" + digest,
+			expected: Image{Name: "docker.io/library/nginx", Digest: digest},
+		},
+		{
+			ref:      "localhost:5000/app",
+			expected: Image{Name: "localhost:5000/app"},
+		},
+		{
+			ref:      "localhost:5000/app:v2",
+			expected: Image{Name: "localhost:5000/app", Tag: "v2"},
+		},
+		{
+			ref:      digest,
+			expected: Image{Name: digest},
+		},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			img := ParseImage(tc.ref)
+			require.Equal(t, tc.expected, img)
+			require.Equal(t, tc.ref, img.Reference())
+		})
+	}
+}
+
+func TestCgroupFromCgroupsPath(t *testing.T) {
+	for _, tc := range []struct {
+		cgroupsPath string
+		expected    string
+	}{
+		{
+			cgroupsPath: "/kubepods/burstable/pod1/abc",
+			expected:    "/kubepods/burstable/pod1/abc",
+		},
+		{
+			cgroupsPath: "kubepods-burstable-pod1.slice:crio:abc",
+			expected:    "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1.slice/crio-abc.scope",
+		},
+		{
+			cgroupsPath: "system.slice:docker:abc",
+			expected:    "/system.slice/docker-abc.scope",
+		},
+		{
+			cgroupsPath: "-.slice::abc.slice",
+			expected:    "/abc.slice",
+		},
+		{
+			cgroupsPath: "relative/abc",
+			expected:    "",
+		},
+		{
+			cgroupsPath: "",
+			expected:    "",
+		},
+	} {
+		require.Equal(t, tc.expected, CgroupFromCgroupsPath(tc.cgroupsPath), tc.cgroupsPath)
+	}
+}
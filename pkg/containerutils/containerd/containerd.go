@@ -18,23 +18,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
-	pb "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
 )
 
 const (
 	DefaultSocketPath    = "/run/containerd/containerd.sock"
 	DefaultK3SSocketPath = "/run/k3s/containerd/containerd.sock"
 	DefaultTimeout       = 2 * time.Second
+
+	// namespaceHeader is the gRPC metadata key containerd reads the
+	// namespace of a request from.
+	namespaceHeader = "containerd-namespace"
+	// nameLabel is the label nerdctl stores the name of a container in.
+	nameLabel = "nerdctl/name"
+
+	// Topics of the events of tasks starting and exiting.
+	taskStartTopic = "/tasks/start"
+	taskExitTopic  = "/tasks/exit"
 )
 
 type Client struct {
-	conn   *grpc.ClientConn
-	client pb.RuntimeServiceClient
+	conn *grpc.ClientConn
 }
 
 func NewContainerdClient(path string) (*Client, error) {
@@ -55,10 +72,8 @@ func NewContainerdClient(path string) (*Client, error) {
 		return nil, err
 	}
 
-	client := pb.NewRuntimeServiceClient(conn)
 	return &Client{
-		conn:   conn,
-		client: client,
+		conn: conn,
 	}, nil
 }
 
@@ -70,32 +85,114 @@ func (c *Client) Close() error {
 	return nil
 }
 
-func (c *Client) PIDFromContainerID(containerID string) (int, error) {
-	if !strings.HasPrefix(containerID, "containerd://") {
-		return -1, fmt.Errorf("Invalid CRI %s, it should be containerd", containerID)
-	}
+func (c *Client) RunningContainers(ctx context.Context, namespace string) ([]containerutils.Container, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, namespaceHeader, namespace)
 
-	containerID = strings.TrimPrefix(containerID, "containerd://")
-
-	request := &pb.ContainerStatusRequest{
-		ContainerId: containerID,
-		Verbose:     true,
+	tasks, err := tasksapi.NewTasksClient(c.conn).List(ctx, &tasksapi.ListTasksRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list tasks: %w", err)
 	}
 
-	status, err := c.client.ContainerStatus(context.Background(), request)
-	if err != nil {
-		return -1, err
+	containersClient := containersapi.NewContainersClient(c.conn)
+	containers := make([]containerutils.Container, 0, len(tasks.Tasks))
+	for _, t := range tasks.Tasks {
+		if t.Status != task.StatusRunning {
+			continue
+		}
+
+		resp, err := containersClient.Get(ctx, &containersapi.GetContainerRequest{ID: t.ContainerID})
+		if status.Code(err) == codes.NotFound {
+			// The container was removed since its task was listed.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get container %s: %w", t.ContainerID, err)
+		}
+
+		name := resp.Container.Labels[nameLabel]
+		if name == "" {
+			name = resp.Container.ID
+		}
+		containers = append(containers, containerutils.Container{
+			ID:     resp.Container.ID,
+			Name:   name,
+			Image:  c.image(ctx, resp.Container.Image),
+			PID:    int(t.Pid),
+			Labels: resp.Container.Labels,
+
+			CgroupPath: cgroupPath(&resp.Container),
+		})
 	}
+	return containers, nil
+}
+
+// TaskEvents returns the events of tasks starting and exiting in the given
+// namespace. The error channel receives an error when the stream of events
+// ends.
+func (c *Client) TaskEvents(ctx context.Context, namespace string) (<-chan *eventsapi.Envelope, <-chan error) {
+	events := make(chan *eventsapi.Envelope)
+	errs := make(chan error, 1)
+	go func() {
+		stream, err := eventsapi.NewEventsClient(c.conn).Subscribe(ctx, &eventsapi.SubscribeRequest{
+			// Filters match if any of them does, and the fields of a filter
+			// if all of them do.
+			Filters: []string{
+				fmt.Sprintf("namespace==%q,topic==%q", namespace, taskStartTopic),
+				fmt.Sprintf("namespace==%q,topic==%q", namespace, taskExitTopic),
+			},
+		})
+		if err != nil {
+			errs <- fmt.Errorf("subscribe to events: %w", err)
+			return
+		}
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				errs <- fmt.Errorf("receive event: %w", err)
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return events, errs
+}
 
-	info, ok := status.Info["info"]
-	if !ok {
-		return -1, fmt.Errorf("container status reply from runtime doesn't contain 'info'")
+// cgroupPath returns the cgroup configured by the OCI runtime spec of the
+// container, or an empty string if it has none.
+func cgroupPath(c *containersapi.Container) string {
+	if c.Spec == nil {
+		return ""
+	}
+	var spec struct {
+		Linux *struct {
+			CgroupsPath string `json:"cgroupsPath"`
+		} `json:"linux"`
 	}
+	if err := json.Unmarshal(c.Spec.Value, &spec); err != nil || spec.Linux == nil {
+		return ""
+	}
+	return containerutils.CgroupFromCgroupsPath(spec.Linux.CgroupsPath)
+}
 
-	containerdInspect := struct{ PID int }{}
-	if err := json.Unmarshal([]byte(info), &containerdInspect); err != nil {
-		return -1, err
+// image returns the image with the given reference, with the digest of its
+// manifest if it is still known to containerd.
+func (c *Client) image(ctx context.Context, ref string) containerutils.Image {
+	img := containerutils.ParseImage(ref)
+	if img.Digest != "" {
+		return img
 	}
 
-	return containerdInspect.PID, nil
+	resp, err := imagesapi.NewImagesClient(c.conn).Get(ctx, &imagesapi.GetImageRequest{Name: ref})
+	if err != nil || resp.Image == nil {
+		// The image might have been removed since the container was
+		// created.
+		return img
+	}
+	img.Digest = resp.Image.Target.Digest.String()
+	return img
 }
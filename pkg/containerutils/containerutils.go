@@ -15,6 +15,7 @@ package containerutils
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -74,9 +75,12 @@ uint64_t get_cgroupid(char *path) {
 */
 import "C"
 
+// CRIClient looks up the containers of pods in the container runtime of the
+// node. Container IDs are the ones of pod statuses, prefixed with the name of
+// the runtime, such as containerd://<container id>.
 type CRIClient interface {
 	Close() error
-	PIDFromContainerID(containerID string) (int, error)
+	ContainerStatus(ctx context.Context, containerID string) (ContainerStatus, error)
 }
 
 func CgroupPathV2AddMountpoint(path string) (string, error) {
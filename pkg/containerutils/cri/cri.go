@@ -0,0 +1,249 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cri looks up containers through the Container Runtime Interface,
+// which is served by all runtimes Kubernetes supports.
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	pb "k8s.io/cri-api/pkg/apis/runtime/v1"
+	pbv1alpha2 "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+	// maxReconnectDelay is the longest the client waits between attempts to
+	// reconnect to a runtime that restarted.
+	maxReconnectDelay = 5 * time.Second
+)
+
+// serviceConfig makes requests wait for the connection to be ready and
+// retries the ones that failed because the connection was lost, so that
+// requests made while the runtime restarts succeed once it is back, rather
+// than failing at once.
+const serviceConfig = `{
+	"methodConfig": [{
+		"name": [
+			{"service": "runtime.v1.RuntimeService"},
+			{"service": "runtime.v1alpha2.RuntimeService"}
+		],
+		"waitForReady": true,
+		"retryPolicy": {
+			"maxAttempts": 5,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// DefaultSocketPaths are the sockets of the CRI runtimes that are looked for
+// when no socket is given, in order.
+var DefaultSocketPaths = []string{
+	"/run/containerd/containerd.sock",
+	"/run/k3s/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/run/cri-dockerd.sock",
+}
+
+// DefaultSocketPath returns the first of the default sockets that exists.
+func DefaultSocketPath() (string, error) {
+	for _, path := range DefaultSocketPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no CRI socket found in %s", strings.Join(DefaultSocketPaths, ", "))
+}
+
+// Client looks up containers through the CRI socket of a runtime. It
+// reconnects to the runtime when it restarts. The v1 API of the CRI is used,
+// or the v1alpha2 API if the runtime does not serve v1, as runtimes that
+// predate it.
+type Client struct {
+	conn           *grpc.ClientConn
+	client         pb.RuntimeServiceClient
+	v1alpha2Client pbv1alpha2.RuntimeServiceClient
+
+	mtx sync.Mutex
+	// v1alpha2 is set once the runtime turned out not to serve the v1 API.
+	v1alpha2 bool
+}
+
+func NewClient(path string) (*Client, error) {
+	conn, err := grpc.Dial(
+		path,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond,
+				Multiplier: backoff.DefaultConfig.Multiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   maxReconnectDelay,
+			},
+			MinConnectTimeout: DefaultTimeout,
+		}),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:           conn,
+		client:         pb.NewRuntimeServiceClient(conn),
+		v1alpha2Client: pbv1alpha2.NewRuntimeServiceClient(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+
+	return nil
+}
+
+// containerInfo is the part of the verbose info of a container status that
+// containerd and CRI-O both report.
+type containerInfo struct {
+	PID         int `json:"pid"`
+	RuntimeSpec struct {
+		Linux *struct {
+			CgroupsPath string `json:"cgroupsPath"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// ContainerStatus returns the status of the container with the given ID,
+// prefixed with the name of the runtime or not.
+func (c *Client) ContainerStatus(ctx context.Context, containerID string) (containerutils.ContainerStatus, error) {
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		containerID = containerID[i+len("://"):]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	resp, err := c.containerStatus(ctx, &pb.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     true,
+	})
+	if err != nil {
+		return containerutils.ContainerStatus{}, fmt.Errorf("get status of container %s: %w", containerID, err)
+	}
+
+	info, ok := resp.Info["info"]
+	if !ok {
+		return containerutils.ContainerStatus{}, errors.New("container status reply from runtime does not contain 'info'")
+	}
+	var ci containerInfo
+	if err := json.Unmarshal([]byte(info), &ci); err != nil {
+		return containerutils.ContainerStatus{}, fmt.Errorf("unmarshal info of container %s: %w", containerID, err)
+	}
+	if ci.PID == 0 {
+		return containerutils.ContainerStatus{}, fmt.Errorf("container %s is not running", containerID)
+	}
+
+	status := containerutils.ContainerStatus{
+		PID:   ci.PID,
+		Image: imageFromStatus(resp.Status),
+	}
+	if ci.RuntimeSpec.Linux != nil {
+		status.CgroupPath = containerutils.CgroupFromCgroupsPath(ci.RuntimeSpec.Linux.CgroupsPath)
+	}
+	return status, nil
+}
+
+// containerStatus requests the status of a container with the v1 API, or the
+// v1alpha2 API if the runtime does not serve v1.
+func (c *Client) containerStatus(ctx context.Context, req *pb.ContainerStatusRequest) (*pb.ContainerStatusResponse, error) {
+	c.mtx.Lock()
+	v1alpha2 := c.v1alpha2
+	c.mtx.Unlock()
+
+	if !v1alpha2 {
+		resp, err := c.client.ContainerStatus(ctx, req)
+		if status.Code(err) != codes.Unimplemented {
+			return resp, err
+		}
+		c.mtx.Lock()
+		c.v1alpha2 = true
+		c.mtx.Unlock()
+	}
+
+	resp, err := c.v1alpha2Client.ContainerStatus(ctx, &pbv1alpha2.ContainerStatusRequest{
+		ContainerId: req.ContainerId,
+		Verbose:     req.Verbose,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The messages of both APIs are the same on the wire.
+	data, err := resp.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	v1Resp := &pb.ContainerStatusResponse{}
+	if err := v1Resp.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return v1Resp, nil
+}
+
+// imageFromStatus returns the image of a container from the image it was
+// created from and the reference of the image it runs.
+func imageFromStatus(s *pb.ContainerStatus) containerutils.Image {
+	if s == nil {
+		return containerutils.Image{}
+	}
+
+	var img containerutils.Image
+	if s.Image != nil {
+		img = containerutils.ParseImage(s.Image.Image)
+	}
+	// The image reference is the repository digest the image was pulled by,
+	// if it was pulled from a registry, or its ID otherwise.
+	ref := containerutils.ParseImage(s.ImageRef)
+	if img.Digest == "" {
+		img.Digest = ref.Digest
+	}
+	// Some runtimes report the ID of the image the container was created
+	// from rather than its name.
+	if (img.Name == "" || strings.HasPrefix(img.Name, "sha256:")) && ref.Digest != "" {
+		img.Name = ref.Name
+	}
+	return img
+}
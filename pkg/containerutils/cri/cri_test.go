@@ -0,0 +1,221 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cri
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "k8s.io/cri-api/pkg/apis/runtime/v1"
+	pbv1alpha2 "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
+)
+
+// fakeRuntime is a CRI runtime serving the verbose info of its containers,
+// with the v1 API, the v1alpha2 API or both.
+type fakeRuntime struct {
+	pb.UnimplementedRuntimeServiceServer
+	infos map[string]string
+
+	noV1, noV1alpha2 bool
+	// v1alpha2Calls counts the requests with the v1alpha2 API.
+	v1alpha2Calls int32
+}
+
+func (r *fakeRuntime) ContainerStatus(ctx context.Context, req *pb.ContainerStatusRequest) (*pb.ContainerStatusResponse, error) {
+	info, ok := r.infos[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	resp := &pb.ContainerStatusResponse{
+		Status: &pb.ContainerStatus{Id: req.ContainerId, State: pb.ContainerState_CONTAINER_RUNNING},
+	}
+	if req.Verbose {
+		resp.Info = map[string]string{"info": info}
+	}
+	return resp, nil
+}
+
+// fakeRuntimeV1alpha2 serves a fake runtime with the v1alpha2 API.
+type fakeRuntimeV1alpha2 struct {
+	pbv1alpha2.UnimplementedRuntimeServiceServer
+	r *fakeRuntime
+}
+
+func (r *fakeRuntimeV1alpha2) ContainerStatus(ctx context.Context, req *pbv1alpha2.ContainerStatusRequest) (*pbv1alpha2.ContainerStatusResponse, error) {
+	atomic.AddInt32(&r.r.v1alpha2Calls, 1)
+	resp, err := r.r.ContainerStatus(ctx, &pb.ContainerStatusRequest{ContainerId: req.ContainerId, Verbose: req.Verbose})
+	if err != nil {
+		return nil, err
+	}
+	return &pbv1alpha2.ContainerStatusResponse{
+		Status: &pbv1alpha2.ContainerStatus{Id: resp.Status.Id, State: pbv1alpha2.ContainerState_CONTAINER_RUNNING},
+		Info:   resp.Info,
+	}, nil
+}
+
+// serve serves the runtime on the socket until the test ends, or the
+// returned server is stopped.
+func serve(t *testing.T, socketPath string, r *fakeRuntime) *grpc.Server {
+	t.Helper()
+
+	l, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	if !r.noV1 {
+		pb.RegisterRuntimeServiceServer(s, r)
+	}
+	if !r.noV1alpha2 {
+		pbv1alpha2.RegisterRuntimeServiceServer(s, &fakeRuntimeV1alpha2{r: r})
+	}
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestClientContainerStatus(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "cri.sock")
+	serve(t, socketPath, &fakeRuntime{infos: map[string]string{
+		"cgroupfs": `{"sandboxID":"s1","pid":42,"runtimeSpec":{"linux":{"cgroupsPath":"/kubepods/besteffort/pod1/cgroupfs"}}}`,
+		"systemd":  `{"sandboxID":"s2","pid":43,"runtimeSpec":{"linux":{"cgroupsPath":"kubepods-besteffort-pod1.slice:cri-containerd:systemd"}}}`,
+		"nospec":   `{"pid":44}`,
+		"stopped":  `{"pid":0}`,
+	}})
+
+	c, err := NewClient(socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	s, err := c.ContainerStatus(ctx, "containerd://cgroupfs")
+	require.NoError(t, err)
+	require.Equal(t, containerutils.ContainerStatus{PID: 42, CgroupPath: "/kubepods/besteffort/pod1/cgroupfs"}, s)
+
+	s, err = c.ContainerStatus(ctx, "cri-o://systemd")
+	require.NoError(t, err)
+	require.Equal(t, containerutils.ContainerStatus{
+		PID:        43,
+		CgroupPath: "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1.slice/cri-containerd-systemd.scope",
+	}, s)
+
+	s, err = c.ContainerStatus(ctx, "nospec")
+	require.NoError(t, err)
+	require.Equal(t, containerutils.ContainerStatus{PID: 44}, s)
+
+	_, err = c.ContainerStatus(ctx, "containerd://stopped")
+	require.EqualError(t, err, "container stopped is not running")
+
+	_, err = c.ContainerStatus(ctx, "containerd://unknown")
+	require.Equal(t, codes.NotFound, status.Code(errors.Unwrap(err)))
+}
+
+func TestClientAPIVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		runtime       *fakeRuntime
+		v1alpha2Calls int32
+	}{
+		{name: "v1 and v1alpha2", runtime: &fakeRuntime{}},
+		{name: "v1", runtime: &fakeRuntime{noV1alpha2: true}},
+		// The client falls back to v1alpha2 once, and keeps using it.
+		{name: "v1alpha2", runtime: &fakeRuntime{noV1: true}, v1alpha2Calls: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "cri.sock")
+			tc.runtime.infos = map[string]string{"abc": `{"pid":42,"runtimeSpec":{"linux":{"cgroupsPath":"/kubepods/besteffort/pod1/abc"}}}`}
+			serve(t, socketPath, tc.runtime)
+
+			c, err := NewClient(socketPath)
+			require.NoError(t, err)
+			t.Cleanup(func() { c.Close() })
+
+			for i := 0; i < 2; i++ {
+				s, err := c.ContainerStatus(context.Background(), "containerd://abc")
+				require.NoError(t, err)
+				require.Equal(t, containerutils.ContainerStatus{PID: 42, CgroupPath: "/kubepods/besteffort/pod1/abc"}, s)
+			}
+			require.Equal(t, tc.v1alpha2Calls, atomic.LoadInt32(&tc.runtime.v1alpha2Calls))
+		})
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "cri.sock")
+	r := &fakeRuntime{infos: map[string]string{"abc": `{"pid":42}`}}
+	s := serve(t, socketPath, r)
+
+	c, err := NewClient(socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	_, err = c.ContainerStatus(ctx, "containerd://abc")
+	require.NoError(t, err)
+
+	// The runtime restarts, listening on a new socket at the same path.
+	s.Stop()
+	serve(t, socketPath, r)
+
+	status, err := c.ContainerStatus(ctx, "containerd://abc")
+	require.NoError(t, err)
+	require.Equal(t, 42, status.PID)
+}
+
+func TestImageFromStatus(t *testing.T) {
+	const digest = "sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31"
+
+	for _, tc := range []struct {
+		name     string
+		status   *pb.ContainerStatus
+		expected containerutils.Image
+	}{
+		{
+			name: "pulled by tag",
+			status: &pb.ContainerStatus{
+				Image:    &pb.ImageSpec{Image: "docker.io/library/nginx:1.21"},
+				ImageRef: "docker.io/library/nginx@" + digest,
+			},
+			expected: containerutils.Image{Name: "docker.io/library/nginx", Tag: "1.21", Digest: digest},
+		},
+		{
+			name: "created from image ID",
+			status: &pb.ContainerStatus{
+				Image:    &pb.ImageSpec{Image: "sha256:abc"},
+				ImageRef: "docker.io/library/nginx@" + digest,
+			},
+			expected: containerutils.Image{Name: "docker.io/library/nginx", Digest: digest},
+		},
+		{
+			name: "built locally",
+			status: &pb.ContainerStatus{
+				Image:    &pb.ImageSpec{Image: "shop/web:dev"},
+				ImageRef: "sha256:abc",
+			},
+			expected: containerutils.Image{Name: "shop/web", Tag: "dev"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, imageFromStatus(tc.status))
+		})
+	}
+}
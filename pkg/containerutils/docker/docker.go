@@ -20,7 +20,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
 )
 
 const (
@@ -56,21 +61,96 @@ func (c *Client) Close() error {
 	return nil
 }
 
-func (c *Client) PIDFromContainerID(containerID string) (int, error) {
+func (c *Client) ContainerStatus(ctx context.Context, containerID string) (containerutils.ContainerStatus, error) {
 	if !strings.HasPrefix(containerID, "docker://") {
-		return -1, fmt.Errorf("Invalid CRI %s, it should be docker", containerID)
+		return containerutils.ContainerStatus{}, fmt.Errorf("Invalid CRI %s, it should be docker", containerID)
 	}
 
 	containerID = strings.TrimPrefix(containerID, "docker://")
 
-	containerJSON, err := c.client.ContainerInspect(context.Background(), containerID)
+	containerJSON, err := c.client.ContainerInspect(ctx, containerID)
 	if err != nil {
-		return -1, err
+		return containerutils.ContainerStatus{}, err
 	}
 
 	if containerJSON.State == nil {
-		return -1, fmt.Errorf("Container state is nil")
+		return containerutils.ContainerStatus{}, fmt.Errorf("Container state is nil")
+	}
+
+	ref := containerJSON.Image
+	if containerJSON.Config != nil {
+		ref = containerJSON.Config.Image
+	}
+	return containerutils.ContainerStatus{
+		PID:   containerJSON.State.Pid,
+		Image: c.image(ctx, ref, containerJSON.Image),
+	}, nil
+}
+
+// image returns the image the container was created from by the given
+// reference, with the digest of the image it runs if it was pulled from a
+// registry.
+func (c *Client) image(ctx context.Context, ref, imageID string) containerutils.Image {
+	img := containerutils.ParseImage(ref)
+	if img.Digest != "" {
+		return img
+	}
+
+	inspect, _, err := c.client.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		// The image might have been removed, and images that were built
+		// locally have no digest anyway.
+		return img
 	}
+	for _, repoDigest := range inspect.RepoDigests {
+		d := containerutils.ParseImage(repoDigest)
+		if d.Name == img.Name || img.Digest == "" {
+			img.Digest = d.Digest
+		}
+	}
+	return img
+}
+
+// RunningContainers returns the containers that are currently running.
+func (c *Client) RunningContainers(ctx context.Context) ([]containerutils.Container, error) {
+	list, err := c.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+
+	containers := make([]containerutils.Container, 0, len(list))
+	for _, l := range list {
+		containerJSON, err := c.client.ContainerInspect(ctx, l.ID)
+		if client.IsErrNotFound(err) {
+			// The container was removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inspect container %s: %w", l.ID, err)
+		}
+		if containerJSON.State == nil || !containerJSON.State.Running {
+			continue
+		}
+
+		containers = append(containers, containerutils.Container{
+			ID:     containerJSON.ID,
+			Name:   strings.TrimPrefix(containerJSON.Name, "/"),
+			Image:  c.image(ctx, l.Image, l.ImageID),
+			PID:    containerJSON.State.Pid,
+			Labels: l.Labels,
+		})
+	}
+	return containers, nil
+}
 
-	return containerJSON.State.Pid, nil
+// ContainerEvents returns the events of containers starting and stopping.
+// The error channel receives an error when the stream of events ends.
+func (c *Client) ContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	return c.client.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", events.ContainerEventType),
+			filters.Arg("event", "start"),
+			filters.Arg("event", "die"),
+		),
+	})
 }
@@ -0,0 +1,179 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/strutil"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+const (
+	// Labels Docker Compose, and nerdctl compose, set on the containers they create.
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+
+	// containerLabelPrefix is the prefix of the labels holding the values of
+	// the selected labels of a container.
+	containerLabelPrefix = "container_label_"
+
+	// Labels the image of a container is attached as.
+	ImageLabel       = "image"
+	ImageTagLabel    = "image_tag"
+	ImageDigestLabel = "image_digest"
+)
+
+// DefaultImageLabels returns the labels the image of a container is attached
+// as by default, which are all of them.
+func DefaultImageLabels() []string {
+	return []string{ImageLabel, ImageTagLabel, ImageDigestLabel}
+}
+
+// IsImageLabel reports whether the image of a container can be attached as
+// the label with the given name.
+func IsImageLabel(name string) bool {
+	switch name {
+	case ImageLabel, ImageTagLabel, ImageDigestLabel:
+		return true
+	}
+	return false
+}
+
+// containerTargets builds target groups of running containers, and clears the
+// groups of containers that stopped running.
+type containerTargets struct {
+	logger log.Logger
+
+	// sourcePrefix identifies the runtime in the sources of the target groups.
+	sourcePrefix string
+	// labels are the container labels to attach as target labels, and
+	// imageLabels the labels the image is attached as.
+	labels      []string
+	imageLabels []string
+	// cgroupPath returns the cgroup of a container's process, and
+	// perfEventPath the cgroup perf events are attached to of the cgroup a
+	// runtime reports.
+	cgroupPath    func(pid int) (string, error)
+	perfEventPath func(cgroupPath string) (string, error)
+
+	sources map[string]struct{}
+}
+
+func newContainerTargets(logger log.Logger, sourcePrefix string, labels, imageLabels []string) *containerTargets {
+	return &containerTargets{
+		logger:        logger,
+		sourcePrefix:  sourcePrefix,
+		labels:        labels,
+		imageLabels:   imageLabels,
+		cgroupPath:    cgroup.PerfEventCgroupPath,
+		perfEventPath: cgroup.PerfEventPath,
+		sources:       map[string]struct{}{},
+	}
+}
+
+// update sends the target groups of the given containers, with the given
+// labels common to all of them, along with empty target groups for the
+// containers that are no longer running.
+func (t *containerTargets) update(ctx context.Context, up chan<- []*target.Group, containers []containerutils.Container, commonLabels model.LabelSet) {
+	sources := make(map[string]struct{}, len(containers))
+	groups := make([]*target.Group, 0, len(containers))
+	for _, c := range containers {
+		cgroupPath, err := t.containerCgroupPath(c)
+		if err != nil {
+			// The container might have stopped since it was listed, in which
+			// case its group is cleared below.
+			level.Debug(t.logger).Log("msg", "failed to resolve cgroup of container", "container", c.ID, "err", err)
+			continue
+		}
+
+		source := t.sourcePrefix + c.ID
+		sources[source] = struct{}{}
+		groups = append(groups, &target.Group{
+			Targets: []model.LabelSet{{agent.CgroupPathLabelName: model.LabelValue(cgroupPath)}},
+			Labels:  t.containerLabels(c).Merge(commonLabels),
+			Source:  source,
+		})
+	}
+
+	for source := range t.sources {
+		if _, ok := sources[source]; !ok {
+			groups = append(groups, &target.Group{Source: source})
+		}
+	}
+	t.sources = sources
+
+	select {
+	case up <- groups:
+	case <-ctx.Done():
+	}
+}
+
+// containerCgroupPath returns the cgroup of the container that perf events
+// are attached to, preferring the cgroup the runtime reports over the one of
+// the container's process.
+func (t *containerTargets) containerCgroupPath(c containerutils.Container) (string, error) {
+	if c.CgroupPath != "" {
+		if path, err := t.perfEventPath(c.CgroupPath); err == nil {
+			return path, nil
+		}
+	}
+	return t.cgroupPath(c.PID)
+}
+
+func (t *containerTargets) containerLabels(c containerutils.Container) model.LabelSet {
+	ls := model.LabelSet{
+		"container":   model.LabelValue(c.Name),
+		"containerid": model.LabelValue(c.ID),
+	}
+	addImageLabels(ls, c.Image, t.imageLabels)
+	if project := c.Labels[composeProjectLabel]; project != "" {
+		ls["compose_project"] = model.LabelValue(project)
+	}
+	if service := c.Labels[composeServiceLabel]; service != "" {
+		ls["compose_service"] = model.LabelValue(service)
+	}
+	for _, name := range t.labels {
+		if value, ok := c.Labels[name]; ok {
+			ls[model.LabelName(containerLabelPrefix+strutil.SanitizeLabelName(name))] = model.LabelValue(value)
+		}
+	}
+	return ls
+}
+
+// addImageLabels sets the given image labels to the parts of the image they
+// hold, leaving out the parts that are not known.
+func addImageLabels(ls model.LabelSet, img containerutils.Image, names []string) {
+	for _, name := range names {
+		var value string
+		switch name {
+		case ImageLabel:
+			value = img.Name
+		case ImageTagLabel:
+			value = img.Tag
+		case ImageDigestLabel:
+			value = img.Digest
+		}
+		if value != "" {
+			ls[model.LabelName(name)] = model.LabelValue(value)
+		}
+	}
+}
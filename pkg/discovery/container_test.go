@@ -0,0 +1,117 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+func TestContainerTargets(t *testing.T) {
+	ct := newContainerTargets(log.NewNopLogger(), "docker/", []string{"com.example/team"}, DefaultImageLabels())
+	ct.cgroupPath = func(pid int) (string, error) {
+		if pid == 0 {
+			return "", errors.New("no such process")
+		}
+		return fmt.Sprintf("/sys/fs/cgroup/system.slice/docker-%d.scope", pid), nil
+	}
+	ct.perfEventPath = func(cgroupPath string) (string, error) {
+		return "/sys/fs/cgroup" + cgroupPath, nil
+	}
+
+	ctx := context.Background()
+	up := make(chan []*target.Group, 1)
+
+	web := containerutils.Container{
+		ID:    "abc",
+		Name:  "shop_web_1",
+		Image: containerutils.Image{Name: "shop/web", Tag: "1.0", Digest: "sha256:0123"},
+		PID:   42,
+		Labels: map[string]string{
+			"com.docker.compose.project": "shop",
+			"com.docker.compose.service": "web",
+			"com.example/team":           "checkout",
+			"com.example/other":          "ignored",
+		},
+	}
+	db := containerutils.Container{ID: "def", Name: "db", Image: containerutils.Image{Name: "postgres"}, PID: 43}
+
+	ct.update(ctx, up, []containerutils.Container{web, db}, model.LabelSet{"env": "prod"})
+	require.Equal(t, []*target.Group{
+		{
+			Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/system.slice/docker-42.scope"}},
+			Labels: model.LabelSet{
+				"container":                        "shop_web_1",
+				"containerid":                      "abc",
+				"image":                            "shop/web",
+				"image_tag":                        "1.0",
+				"image_digest":                     "sha256:0123",
+				"compose_project":                  "shop",
+				"compose_service":                  "web",
+				"container_label_com_example_team": "checkout",
+				"env":                              "prod",
+			},
+			Source: "docker/abc",
+		},
+		{
+			Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/system.slice/docker-43.scope"}},
+			Labels: model.LabelSet{
+				"container":   "db",
+				"containerid": "def",
+				"image":       "postgres",
+				"env":         "prod",
+			},
+			Source: "docker/def",
+		},
+	}, <-up)
+
+	// A stopped container and a container whose process is gone are cleared.
+	db.PID = 0
+	ct.update(ctx, up, []containerutils.Container{db}, nil)
+	groups := <-up
+	require.ElementsMatch(t, []*target.Group{{Source: "docker/abc"}, {Source: "docker/def"}}, groups)
+
+	// The cgroup the runtime reports is preferred over the one of the
+	// container's process.
+	db.PID = 43
+	db.CgroupPath = "/kubepods/besteffort/pod1/def"
+	ct.update(ctx, up, []containerutils.Container{db}, nil)
+	groups = <-up
+	require.Equal(t, model.LabelValue("/sys/fs/cgroup/kubepods/besteffort/pod1/def"), groups[0].Targets[0]["__cgroup_path__"])
+}
+
+func TestContainerTargetsImageLabels(t *testing.T) {
+	ct := newContainerTargets(log.NewNopLogger(), "containerd/default/", nil, []string{ImageLabel, ImageTagLabel})
+
+	ls := ct.containerLabels(containerutils.Container{
+		ID:    "abc",
+		Name:  "web",
+		Image: containerutils.Image{Name: "nginx", Tag: "1.21", Digest: "sha256:0123"},
+	})
+	require.Equal(t, model.LabelSet{
+		"container":   "web",
+		"containerid": "abc",
+		"image":       "nginx",
+		"image_tag":   "1.21",
+	}, ls)
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils/containerd"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+type ContainerdConfig struct {
+	socketPath      string
+	namespace       string
+	labels          []string
+	imageLabels     []string
+	refreshInterval time.Duration
+}
+
+func (c *ContainerdConfig) Name() string {
+	return "containerd/" + c.namespace
+}
+
+// NewContainerdConfig returns a config to discover the containers with a
+// running task in the given containerd namespace, labeled with the given
+// container labels and image labels. The containers are listed whenever a
+// task starts or exits, and every refreshInterval in case events are missed.
+func NewContainerdConfig(socketPath, namespace string, labels, imageLabels []string, refreshInterval time.Duration) *ContainerdConfig {
+	if socketPath == "" {
+		socketPath = containerd.DefaultSocketPath
+	}
+	return &ContainerdConfig{
+		socketPath:      socketPath,
+		namespace:       namespace,
+		labels:          labels,
+		imageLabels:     imageLabels,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *ContainerdConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	client, err := containerd.NewContainerdClient(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create containerd client: %w", err)
+	}
+	return &ContainerdDiscoverer{
+		logger:          d.Logger,
+		client:          client,
+		namespace:       c.namespace,
+		refreshInterval: c.refreshInterval,
+		targets:         newContainerTargets(d.Logger, "containerd/"+c.namespace+"/", c.labels, c.imageLabels),
+	}, nil
+}
+
+// ContainerdDiscoverer discovers the running containers of a containerd
+// namespace. The containers are listed whenever a task starts or exits, and
+// every refresh interval.
+type ContainerdDiscoverer struct {
+	logger          log.Logger
+	client          *containerd.Client
+	namespace       string
+	refreshInterval time.Duration
+	targets         *containerTargets
+}
+
+func (d *ContainerdDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	defer d.client.Close()
+
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	var (
+		events <-chan *eventsapi.Envelope
+		errs   <-chan error
+		cancel = func() {}
+	)
+	defer func() { cancel() }()
+
+	for {
+		// Subscribe before listing, so that no task started in between is
+		// missed.
+		if events == nil {
+			events, errs, cancel = d.watch(ctx)
+		}
+
+		containers, err := d.client.RunningContainers(ctx, d.namespace)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to list containerd containers", "namespace", d.namespace, "err", err)
+		} else {
+			d.targets.update(ctx, up, containers, model.LabelSet{"containerd_namespace": model.LabelValue(d.namespace)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-events:
+		case <-ticker.C:
+		case err := <-errs:
+			// The containers are only listed every refresh interval until
+			// the events are subscribed to again.
+			level.Warn(d.logger).Log("msg", "failed to watch containerd tasks, retrying", "namespace", d.namespace, "err", err)
+			cancel()
+			events, errs = nil, nil
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// watch subscribes to the events of tasks starting and exiting, until the
+// returned function is called.
+func (d *ContainerdDiscoverer) watch(ctx context.Context) (<-chan *eventsapi.Envelope, <-chan error, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	events, errs := d.client.TaskEvents(ctx, d.namespace)
+	return events, errs, cancel
+}
@@ -78,8 +78,15 @@ type poolKey struct {
 type provider struct {
 	name   string
 	d      Discoverer
-	subs   []string
 	config interface{}
+
+	// subs are the names of the target sets the provider discovers targets
+	// for, and newSubs those of the configuration being applied.
+	subs    map[string]struct{}
+	newSubs map[string]struct{}
+
+	// cancel stops the provider, it is nil until the provider is started.
+	cancel context.CancelFunc
 }
 
 // NewManager is the Discovery Manager constructor.
@@ -88,14 +95,13 @@ func NewManager(ctx context.Context, logger log.Logger, reg prometheus.Registere
 		logger = log.NewNopLogger()
 	}
 	mgr := &Manager{
-		logger:         logger,
-		ctx:            ctx,
-		syncCh:         make(chan map[string][]*target.Group),
-		Targets:        make(map[poolKey]map[string]*target.Group),
-		discoverCancel: []context.CancelFunc{},
-		metrics:        newMetrics(reg),
-		updatert:       5 * time.Second,
-		triggerSend:    make(chan struct{}, 1),
+		logger:      logger,
+		ctx:         ctx,
+		syncCh:      make(chan map[string][]*target.Group),
+		Targets:     make(map[poolKey]map[string]*target.Group),
+		metrics:     newMetrics(reg),
+		updatert:    5 * time.Second,
+		triggerSend: make(chan struct{}, 1),
 	}
 	for _, option := range options {
 		option(mgr)
@@ -106,10 +112,9 @@ func NewManager(ctx context.Context, logger log.Logger, reg prometheus.Registere
 // Manager maintains a set of discovery providers and sends each update to a map channel.
 // Targets are grouped by the target set name.
 type Manager struct {
-	logger         log.Logger
-	mtx            sync.RWMutex
-	ctx            context.Context
-	discoverCancel []context.CancelFunc
+	logger log.Logger
+	mtx    sync.RWMutex
+	ctx    context.Context
 
 	metrics *metrics
 
@@ -118,6 +123,9 @@ type Manager struct {
 	Targets map[poolKey]map[string]*target.Group
 	// providers keeps track of SD providers.
 	providers []*provider
+	// lastProvider numbers the providers, to give them unique names across
+	// configuration changes.
+	lastProvider int
 	// The sync channel sends the updates as a map where the key is the job value from the scrape config.
 	syncCh chan map[string][]*target.Group
 
@@ -144,7 +152,9 @@ func (m *Manager) SyncCh() <-chan map[string][]*target.Group {
 	return m.syncCh
 }
 
-// ApplyConfig removes all running discovery providers and starts new ones using the provided config.
+// ApplyConfig applies the provided config. Providers whose configuration did
+// not change keep running, along with the targets they discovered. The others
+// are stopped, and new ones are started.
 func (m *Manager) ApplyConfig(cfg map[string]Configs) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -154,31 +164,104 @@ func (m *Manager) ApplyConfig(cfg map[string]Configs) error {
 			m.metrics.discoveredTargets.DeleteLabelValues(pk.setName)
 		}
 	}
-	m.cancelDiscoverers()
-	m.Targets = make(map[poolKey]map[string]*target.Group)
-	m.providers = nil
-	m.discoverCancel = nil
 
+	for _, p := range m.providers {
+		p.newSubs = map[string]struct{}{}
+	}
 	failedCount := 0
 	for name, scfg := range cfg {
 		failedCount += m.registerProviders(scfg, name)
-		m.metrics.discoveredTargets.WithLabelValues(name).Set(0)
 	}
 	m.metrics.failedConfigs.Set(float64(failedCount))
 
-	for _, prov := range m.providers {
-		m.startProvider(m.ctx, prov)
+	var (
+		providers []*provider
+		changed   bool
+	)
+	for _, p := range m.providers {
+		if len(p.newSubs) == 0 {
+			// The provider is not used by any target set anymore.
+			if p.cancel != nil {
+				p.cancel()
+			}
+			for s := range p.subs {
+				delete(m.Targets, poolKey{setName: s, provider: p.name})
+			}
+			changed = true
+			continue
+		}
+		providers = append(providers, p)
+
+		if p.cancel == nil {
+			p.subs = p.newSubs
+			m.startProvider(m.ctx, p)
+			continue
+		}
+
+		// The provider keeps running, so its targets are copied to the target
+		// sets it was added to, and removed from the ones it was removed from.
+		var refTargets map[string]*target.Group
+		for s := range p.subs {
+			refTargets = m.Targets[poolKey{setName: s, provider: p.name}]
+			break
+		}
+		for s := range p.newSubs {
+			if _, ok := p.subs[s]; !ok {
+				if refTargets != nil {
+					m.Targets[poolKey{setName: s, provider: p.name}] = copyTargets(refTargets)
+				}
+				changed = true
+			}
+		}
+		for s := range p.subs {
+			if _, ok := p.newSubs[s]; !ok {
+				delete(m.Targets, poolKey{setName: s, provider: p.name})
+				changed = true
+			}
+		}
+		p.subs = p.newSubs
+	}
+	m.providers = providers
+
+	for name := range cfg {
+		n := 0
+		for pk, tgs := range m.Targets {
+			if pk.setName != name {
+				continue
+			}
+			for _, tg := range tgs {
+				n += len(tg.Targets)
+			}
+		}
+		m.metrics.discoveredTargets.WithLabelValues(name).Set(float64(n))
+	}
+
+	// Target sets of removed providers, or that providers were added to, are
+	// sent right away as no update might come from their providers.
+	if changed {
+		select {
+		case m.triggerSend <- struct{}{}:
+		default:
+		}
 	}
 
 	return nil
 }
 
+func copyTargets(targets map[string]*target.Group) map[string]*target.Group {
+	res := make(map[string]*target.Group, len(targets))
+	for source, tg := range targets {
+		res[source] = tg
+	}
+	return res
+}
+
 // StartCustomProvider is used for sdtool. Only use this if you know what you're doing.
 func (m *Manager) StartCustomProvider(ctx context.Context, name string, worker Discoverer) {
 	p := &provider{
 		name: name,
 		d:    worker,
-		subs: []string{name},
+		subs: map[string]struct{}{name: {}},
 	}
 	m.providers = append(m.providers, p)
 	m.startProvider(ctx, p)
@@ -189,7 +272,7 @@ func (m *Manager) startProvider(ctx context.Context, p *provider) {
 	ctx, cancel := context.WithCancel(ctx)
 	updates := make(chan []*target.Group)
 
-	m.discoverCancel = append(m.discoverCancel, cancel)
+	p.cancel = cancel
 
 	go func() {
 		err := p.d.Run(ctx, updates)
@@ -211,9 +294,7 @@ func (m *Manager) updater(ctx context.Context, p *provider, updates chan []*targ
 				return
 			}
 
-			for _, s := range p.subs {
-				m.updateGroup(poolKey{setName: s, provider: p.name}, tgs)
-			}
+			m.updateGroup(p, tgs)
 
 			select {
 			case m.triggerSend <- struct{}{}:
@@ -252,21 +333,31 @@ func (m *Manager) sender() {
 }
 
 func (m *Manager) cancelDiscoverers() {
-	for _, c := range m.discoverCancel {
-		c()
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, p := range m.providers {
+		if p.cancel != nil {
+			p.cancel()
+		}
 	}
 }
 
-func (m *Manager) updateGroup(poolKey poolKey, tgs []*target.Group) {
+// updateGroup updates the targets of the target sets the provider discovers
+// targets for.
+func (m *Manager) updateGroup(p *provider, tgs []*target.Group) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if _, ok := m.Targets[poolKey]; !ok {
-		m.Targets[poolKey] = make(map[string]*target.Group)
-	}
-	for _, tg := range tgs {
-		if tg != nil { // Some Discoverers send nil target group so need to check for it to avoid panics.
-			m.Targets[poolKey][tg.Source] = tg
+	for s := range p.subs {
+		pk := poolKey{setName: s, provider: p.name}
+		if _, ok := m.Targets[pk]; !ok {
+			m.Targets[pk] = make(map[string]*target.Group)
+		}
+		for _, tg := range tgs {
+			if tg != nil { // Some Discoverers send nil target group so need to check for it to avoid panics.
+				m.Targets[pk][tg.Source] = tg
+			}
 		}
 	}
 }
@@ -297,7 +388,7 @@ func (m *Manager) registerProviders(cfgs Configs, setName string) int {
 	add := func(cfg Config) {
 		for _, p := range m.providers {
 			if reflect.DeepEqual(cfg, p.config) {
-				p.subs = append(p.subs, setName)
+				p.newSubs[setName] = struct{}{}
 				return
 			}
 		}
@@ -310,13 +401,13 @@ func (m *Manager) registerProviders(cfgs Configs, setName string) int {
 			failed++
 			return
 		}
+		m.lastProvider++
 		m.providers = append(m.providers, &provider{
-			name:   fmt.Sprintf("%s/%d", typ, len(m.providers)),
-			d:      d,
-			config: cfg,
-			subs:   []string{setName},
+			name:    fmt.Sprintf("%s/%d", typ, m.lastProvider),
+			d:       d,
+			config:  cfg,
+			newSubs: map[string]struct{}{setName: {}},
 		})
-		//	added = true
 	}
 	for _, cfg := range cfgs {
 		add(cfg)
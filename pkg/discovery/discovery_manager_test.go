@@ -0,0 +1,131 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// staticConfig discovers a single target, and counts the discoverers created
+// for each target.
+type staticConfig struct {
+	cgroupPath string
+	started    *startCounter
+}
+
+type startCounter struct {
+	mtx sync.Mutex
+	n   map[string]int
+}
+
+func (c *startCounter) get(cgroupPath string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.n[cgroupPath]
+}
+
+func (c *staticConfig) Name() string {
+	return "static"
+}
+
+func (c *staticConfig) NewDiscoverer(DiscovererOptions) (Discoverer, error) {
+	c.started.mtx.Lock()
+	c.started.n[c.cgroupPath]++
+	c.started.mtx.Unlock()
+	return c, nil
+}
+
+func (c *staticConfig) Run(ctx context.Context, up chan<- []*target.Group) error {
+	select {
+	case up <- []*target.Group{{
+		Targets: []model.LabelSet{{"__cgroup_path__": model.LabelValue(c.cgroupPath)}},
+		Source:  c.cgroupPath,
+	}}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestManagerApplyConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewManager(ctx, log.NewNopLogger(), prometheus.NewRegistry(), func(m *Manager) {
+		m.updatert = 10 * time.Millisecond
+	})
+	go m.Run()
+
+	started := &startCounter{n: map[string]int{}}
+	newConfig := func(cgroupPath string) *staticConfig {
+		return &staticConfig{cgroupPath: cgroupPath, started: started}
+	}
+
+	// waitFor returns the cgroups of each target set, once they are the
+	// expected ones.
+	waitFor := func(expected map[string][]string) {
+		require.Eventually(t, func() bool {
+			for {
+				select {
+				case groups := <-m.SyncCh():
+					got := map[string][]string{}
+					for name, tgs := range groups {
+						for _, tg := range tgs {
+							for _, t := range tg.Targets {
+								got[name] = append(got[name], string(t["__cgroup_path__"]))
+							}
+						}
+						sort.Strings(got[name])
+					}
+					if reflect.DeepEqual(expected, got) {
+						return true
+					}
+				case <-time.After(50 * time.Millisecond):
+					return false
+				}
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	require.NoError(t, m.ApplyConfig(map[string]Configs{
+		"a": {newConfig("/a")},
+		"b": {newConfig("/b")},
+	}))
+	waitFor(map[string][]string{"a": {"/a"}, "b": {"/b"}})
+
+	// The provider of "a" keeps running and is shared with "c", while "b" is
+	// removed and "/d" is started.
+	require.NoError(t, m.ApplyConfig(map[string]Configs{
+		"a": {newConfig("/a")},
+		"c": {newConfig("/a"), newConfig("/d")},
+	}))
+	waitFor(map[string][]string{"a": {"/a"}, "c": {"/a", "/d"}})
+
+	require.Equal(t, 1, started.get("/a"))
+	require.Equal(t, 1, started.get("/b"))
+	require.Equal(t, 1, started.get("/d"))
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils/docker"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// dockerRetryInterval is the time to wait before listing the containers again
+// after a Docker API request failed.
+const dockerRetryInterval = 5 * time.Second
+
+type DockerConfig struct {
+	socketPath  string
+	labels      []string
+	imageLabels []string
+}
+
+func (c *DockerConfig) Name() string {
+	return "docker"
+}
+
+// NewDockerConfig returns a config to discover the running containers of the
+// Docker daemon listening on the given socket, labeled with the given
+// container labels and image labels.
+func NewDockerConfig(socketPath string, labels, imageLabels []string) *DockerConfig {
+	if socketPath == "" {
+		socketPath = docker.DefaultSocketPath
+	}
+	return &DockerConfig{
+		socketPath:  socketPath,
+		labels:      labels,
+		imageLabels: imageLabels,
+	}
+}
+
+func (c *DockerConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	client, err := docker.NewDockerClient(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create docker client: %w", err)
+	}
+	return &DockerDiscoverer{
+		logger:  d.Logger,
+		client:  client,
+		targets: newContainerTargets(d.Logger, "docker/", c.labels, c.imageLabels),
+	}, nil
+}
+
+// DockerDiscoverer discovers the running containers of a Docker daemon. The
+// containers are listed whenever a container starts or stops.
+type DockerDiscoverer struct {
+	logger  log.Logger
+	client  *docker.Client
+	targets *containerTargets
+}
+
+func (d *DockerDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	defer d.client.Close()
+
+	for {
+		err := d.watch(ctx, up)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		level.Warn(d.logger).Log("msg", "failed to watch docker containers, retrying", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dockerRetryInterval):
+		}
+	}
+}
+
+// watch lists the running containers whenever a container starts or stops,
+// until the stream of events ends.
+func (d *DockerDiscoverer) watch(ctx context.Context, up chan<- []*target.Group) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before listing, so that no container started in between is missed.
+	events, errs := d.client.ContainerEvents(ctx)
+	if err := d.refresh(ctx, up); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-events:
+			if err := d.refresh(ctx, up); err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (d *DockerDiscoverer) refresh(ctx context.Context, up chan<- []*target.Group) error {
+	containers, err := d.client.RunningContainers(ctx)
+	if err != nil {
+		return err
+	}
+	d.targets.update(ctx, up, containers, nil)
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// fileSDFilepathLabel is the name of the label holding the path of the file
+// a target was read from.
+const fileSDFilepathLabel = model.MetaLabelPrefix + "filepath"
+
+type FileConfig struct {
+	files           []string
+	refreshInterval time.Duration
+}
+
+func (c *FileConfig) Name() string {
+	return "file"
+}
+
+// NewFileConfig returns a config to read target groups from the files
+// matching the given glob patterns, re-reading them when they change and at
+// least every refreshInterval.
+func NewFileConfig(files []string, refreshInterval time.Duration) *FileConfig {
+	return &FileConfig{
+		files:           files,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *FileConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	for _, pattern := range c.files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+		}
+		if !isFileSDExtension(pattern) {
+			return nil, fmt.Errorf("file pattern %q must end in .json, .yml or .yaml", pattern)
+		}
+	}
+	return &FileDiscoverer{
+		files:           c.files,
+		refreshInterval: c.refreshInterval,
+		logger:          d.Logger,
+		lastRefresh:     map[string]int{},
+	}, nil
+}
+
+// FileDiscoverer reads target groups from YAML or JSON files in the format of
+// Prometheus' file_sd_configs. Each target is a label set that must contain
+// the __cgroup_path__ label.
+type FileDiscoverer struct {
+	files           []string
+	refreshInterval time.Duration
+	logger          log.Logger
+
+	// lastRefresh maps each file to the number of target groups it contained
+	// in the last refresh, to clear the groups of files that shrunk or are gone.
+	lastRefresh map[string]int
+}
+
+func (d *FileDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "failed to create file watcher, falling back to polling", "err", err)
+	} else {
+		defer watcher.Close()
+		for _, dir := range d.watchDirs() {
+			if err := watcher.Add(dir); err != nil {
+				level.Warn(d.logger).Log("msg", "failed to watch directory, falling back to polling", "dir", dir, "err", err)
+			}
+		}
+	}
+
+	// A nil channel blocks forever, so only the ticker triggers refreshes
+	// when there is no watcher.
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	d.refresh(ctx, up)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-events:
+			// Changes of permissions do not change the targets.
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+		case err := <-errs:
+			level.Warn(d.logger).Log("msg", "file watcher error", "err", err)
+			continue
+		case <-ticker.C:
+		}
+		d.refresh(ctx, up)
+	}
+}
+
+// watchDirs returns the directories of the file patterns. Directories are
+// watched rather than the files, so that files matching the patterns are
+// picked up when they are created.
+func (d *FileDiscoverer) watchDirs() []string {
+	seen := map[string]struct{}{}
+	var dirs []string
+	for _, pattern := range d.files {
+		dir, _ := filepath.Split(pattern)
+		if dir == "" {
+			dir = "./"
+		}
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// listFiles returns the files currently matching the file patterns.
+func (d *FileDiscoverer) listFiles() []string {
+	var paths []string
+	for _, pattern := range d.files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			level.Error(d.logger).Log("msg", "failed to expand file pattern", "pattern", pattern, "err", err)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// refresh reads all files and sends their target groups, along with empty
+// target groups for the sources that no longer exist.
+func (d *FileDiscoverer) refresh(ctx context.Context, up chan<- []*target.Group) {
+	ref := map[string]int{}
+	var groups []*target.Group
+	for _, p := range d.listFiles() {
+		tgs, err := readFileSDFile(p)
+		if err != nil {
+			level.Error(d.logger).Log("msg", "failed to read targets file", "path", p, "err", err)
+			// Keep the targets of the last successful read.
+			ref[p] = d.lastRefresh[p]
+			continue
+		}
+		groups = append(groups, tgs...)
+		ref[p] = len(tgs)
+	}
+
+	for f, n := range d.lastRefresh {
+		for i := ref[f]; i < n; i++ {
+			groups = append(groups, &target.Group{Source: fileSDSource(f, i)})
+		}
+	}
+	d.lastRefresh = ref
+
+	select {
+	case up <- groups:
+	case <-ctx.Done():
+	}
+}
+
+// fileSDGroup is the representation of a target group in a file.
+type fileSDGroup struct {
+	Targets []model.LabelSet `yaml:"targets" json:"targets"`
+	Labels  model.LabelSet   `yaml:"labels" json:"labels"`
+}
+
+// readFileSDFile reads the target groups of a YAML or JSON file.
+func readFileSDFile(path string) ([]*target.Group, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileGroups []fileSDGroup
+	switch ext := filepath.Ext(path); strings.ToLower(ext) {
+	case ".json":
+		if err := json.Unmarshal(content, &fileGroups); err != nil {
+			return nil, fmt.Errorf("parse JSON: %w", err)
+		}
+	case ".yml", ".yaml":
+		if err := yaml.UnmarshalStrict(content, &fileGroups); err != nil {
+			return nil, fmt.Errorf("parse YAML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q", ext)
+	}
+
+	groups := make([]*target.Group, 0, len(fileGroups))
+	for i, fg := range fileGroups {
+		for j, t := range fg.Targets {
+			if t[agent.CgroupPathLabelName] == "" && fg.Labels[agent.CgroupPathLabelName] == "" {
+				return nil, fmt.Errorf("target %d of group %d has no %s label", j, i, agent.CgroupPathLabelName)
+			}
+		}
+
+		labels := fg.Labels.Clone()
+		labels[fileSDFilepathLabel] = model.LabelValue(path)
+
+		groups = append(groups, &target.Group{
+			Targets: fg.Targets,
+			Labels:  labels,
+			Source:  fileSDSource(path, i),
+		})
+	}
+	return groups, nil
+}
+
+func fileSDSource(path string, i int) string {
+	return fmt.Sprintf("%s:%d", path, i)
+}
+
+func isFileSDExtension(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yml", ".yaml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+func TestReadFileSDFile(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "targets.yaml")
+	require.NoError(t, ioutil.WriteFile(yamlPath, []byte(`
+- targets:
+  - __cgroup_path__: /sys/fs/cgroup/machine.slice/vm1
+    vm: vm1
+  - __cgroup_path__: /sys/fs/cgroup/machine.slice/vm2
+    vm: vm2
+  labels:
+    env: prod
+`), 0o600))
+
+	groups, err := readFileSDFile(yamlPath)
+	require.NoError(t, err)
+	require.Equal(t, []*target.Group{{
+		Targets: []model.LabelSet{
+			{"__cgroup_path__": "/sys/fs/cgroup/machine.slice/vm1", "vm": "vm1"},
+			{"__cgroup_path__": "/sys/fs/cgroup/machine.slice/vm2", "vm": "vm2"},
+		},
+		Labels: model.LabelSet{"env": "prod", fileSDFilepathLabel: model.LabelValue(yamlPath)},
+		Source: yamlPath + ":0",
+	}}, groups)
+
+	jsonPath := filepath.Join(dir, "targets.json")
+	require.NoError(t, ioutil.WriteFile(jsonPath, []byte(`[{"targets": [{"__cgroup_path__": "/sys/fs/cgroup/a"}]}]`), 0o600))
+	groups, err = readFileSDFile(jsonPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(groups))
+	require.Equal(t, model.LabelValue("/sys/fs/cgroup/a"), groups[0].Targets[0]["__cgroup_path__"])
+
+	require.NoError(t, ioutil.WriteFile(jsonPath, []byte(`[{"targets": [{"vm": "vm1"}]}]`), 0o600))
+	_, err = readFileSDFile(jsonPath)
+	require.Error(t, err)
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.yml")
+	write := func(content string) {
+		// Write and rename the file, like configuration management does, so
+		// that it is never read half-written.
+		tmp := filepath.Join(dir, ".targets.tmp")
+		require.NoError(t, ioutil.WriteFile(tmp, []byte(content), 0o600))
+		require.NoError(t, os.Rename(tmp, path))
+	}
+	write(`
+- targets: [{__cgroup_path__: /a}]
+- targets: [{__cgroup_path__: /b}]
+`)
+
+	d, err := NewFileConfig([]string{filepath.Join(dir, "*.yml")}, time.Hour).NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []*target.Group)
+	go d.Run(ctx, up)
+
+	// next returns the next update that satisfies ok, skipping the updates of
+	// intermediate file system events.
+	next := func(ok func([]*target.Group) bool) []*target.Group {
+		for {
+			select {
+			case groups := <-up:
+				if ok(groups) {
+					return groups
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for target groups")
+			}
+		}
+	}
+	cgroupPath := func(groups []*target.Group) model.LabelValue {
+		return groups[0].Targets[0]["__cgroup_path__"]
+	}
+
+	groups := next(func(groups []*target.Group) bool { return len(groups) == 2 })
+	require.Equal(t, path+":0", groups[0].Source)
+	require.Equal(t, path+":1", groups[1].Source)
+
+	// Removing a group sends an empty group for its source.
+	write(`
+- targets: [{__cgroup_path__: /c}]
+`)
+	groups = next(func(groups []*target.Group) bool { return cgroupPath(groups) == "/c" })
+	require.Equal(t, 2, len(groups))
+	require.Equal(t, &target.Group{Source: path + ":1"}, groups[1])
+
+	require.NoError(t, os.Remove(path))
+	groups = next(func(groups []*target.Group) bool { return len(groups) > 0 && len(groups[0].Targets) == 0 })
+	require.Equal(t, 1, len(groups))
+	require.Equal(t, &target.Group{Source: path + ":0"}, groups[0])
+}
@@ -0,0 +1,262 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	commonconfig "github.com/prometheus/common/config"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/parca-dev/parca-agent/pkg/k8s"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// KubeletConfig discovers the containers of the pods of the node from the
+// /pods endpoint of the kubelet, rather than from the API server.
+type KubeletConfig struct {
+	pod              *PodConfig
+	url              string
+	httpClientConfig commonconfig.HTTPClientConfig
+	refreshInterval  time.Duration
+}
+
+// NewKubeletConfig returns a config to discover the pods of the given pod
+// config from the kubelet at the given URL, such as https://127.0.0.1:10250,
+// every refreshInterval.
+func NewKubeletConfig(pod *PodConfig, url string, httpClientConfig commonconfig.HTTPClientConfig, refreshInterval time.Duration) *KubeletConfig {
+	return &KubeletConfig{
+		pod:              pod,
+		url:              url,
+		httpClientConfig: httpClientConfig,
+		refreshInterval:  refreshInterval,
+	}
+}
+
+func (c *KubeletConfig) Name() string {
+	return c.pod.Name()
+}
+
+func (c *KubeletConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	selector, err := labels.Parse(c.pod.podLabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("parse pod label selector: %w", err)
+	}
+
+	httpClientConfig := c.httpClientConfig
+	if err := httpClientConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid kubelet client config: %w", err)
+	}
+	client, err := commonconfig.NewClientFromConfig(httpClientConfig, "kubelet")
+	if err != nil {
+		return nil, fmt.Errorf("create kubelet client: %w", err)
+	}
+
+	// The kubelet has no owners to resolve workloads from, so they are
+	// resolved from the owner references of pods.
+	kd := &KubeletDiscoverer{
+		logger:          d.Logger,
+		podTargets:      c.pod.podTargets(nil),
+		client:          client,
+		url:             strings.TrimSuffix(c.url, "/") + "/pods",
+		selector:        selector,
+		refreshInterval: c.refreshInterval,
+		nodeName:        c.pod.nodeName,
+		socketPath:      c.pod.socketPath,
+		lastPods:        map[string]kubeletPod{},
+	}
+	kd.containers = kd.podContainers
+	return kd, nil
+}
+
+// KubeletDiscoverer polls the pods of the node from the kubelet. The
+// containers of pods are looked up in the container runtime once, and again
+// when they change or some of them could not be looked up.
+type KubeletDiscoverer struct {
+	logger log.Logger
+	podTargets
+
+	client          *http.Client
+	url             string
+	selector        labels.Selector
+	refreshInterval time.Duration
+	nodeName        string
+	socketPath      string
+
+	// containers looks up the running containers of a pod.
+	containers func(ctx context.Context, pod *v1.Pod) []*k8s.ContainerDefinition
+	// k8sClient is created for the runtime of the first container found.
+	k8sClient *k8s.Client
+
+	// lastPods are the pods of the last refresh by source, to clear the
+	// groups of pods that are gone and to not look up the same containers
+	// again.
+	lastPods map[string]kubeletPod
+}
+
+// kubeletPod is a pod of the last refresh.
+type kubeletPod struct {
+	// containerIDs are the running containers of the pod, which are only
+	// set if all of them were looked up.
+	containerIDs string
+	containers   []*k8s.ContainerDefinition
+}
+
+func (d *KubeletDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	defer func() {
+		if d.k8sClient != nil {
+			d.k8sClient.CloseCRI()
+		}
+	}()
+
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		d.refresh(ctx, up)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh sends the target groups of the pods of the node, along with empty
+// target groups for the pods that are gone.
+func (d *KubeletDiscoverer) refresh(ctx context.Context, up chan<- []*target.Group) {
+	pods, err := d.pods(ctx)
+	if err != nil {
+		// The targets of the last refresh are kept until the kubelet is
+		// reachable again.
+		level.Error(d.logger).Log("msg", "failed to list pods from the kubelet", "url", d.url, "err", err)
+		return
+	}
+
+	lastPods := make(map[string]kubeletPod, len(pods))
+	groups := make([]*target.Group, 0, len(pods))
+	for i := range pods {
+		pod := &pods[i]
+		if !d.selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		source := podSourceFromNamespaceAndName(pod.Namespace, pod.Name)
+
+		// The containers of pods that are not profiled are not looked up,
+		// and their group is cleared in case they were opted out.
+		var containers []*k8s.ContainerDefinition
+		if d.profiled(pod) {
+			ids := runningContainerIDs(pod)
+			key := strings.Join(ids, ",")
+			if last, ok := d.lastPods[source]; ok && last.containerIDs != "" && last.containerIDs == key {
+				containers = last.containers
+			} else {
+				containers = d.containers(ctx, pod)
+			}
+			p := kubeletPod{containers: containers}
+			if len(ids) > 0 && len(containers) == len(ids) && !k8s.Failed(containers) {
+				p.containerIDs = key
+			}
+			lastPods[source] = p
+		} else {
+			lastPods[source] = kubeletPod{}
+		}
+		groups = append(groups, d.buildPod(pod, containers))
+	}
+
+	for source := range d.lastPods {
+		if _, ok := lastPods[source]; !ok {
+			groups = append(groups, &target.Group{Source: source})
+		}
+	}
+	d.lastPods = lastPods
+
+	select {
+	case up <- groups:
+	case <-ctx.Done():
+	}
+}
+
+// pods returns the pods of the node, as listed by the kubelet.
+func (d *KubeletDiscoverer) pods(ctx context.Context) ([]v1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.refreshInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var pods v1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("decode pods: %w", err)
+	}
+	return pods.Items, nil
+}
+
+// podContainers looks up the running containers of the pod in the container
+// runtime, which is the one its container IDs are prefixed with.
+func (d *KubeletDiscoverer) podContainers(ctx context.Context, pod *v1.Pod) []*k8s.ContainerDefinition {
+	if d.k8sClient == nil {
+		runtime := ""
+		for _, s := range pod.Status.ContainerStatuses {
+			if i := strings.Index(s.ContainerID, "://"); i > 0 {
+				runtime = s.ContainerID[:i]
+				break
+			}
+		}
+		if runtime == "" {
+			return nil
+		}
+
+		c, err := k8s.NewCRIClient(d.logger, d.nodeName, runtime, d.socketPath)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to create client for container runtime", "runtime", runtime, "err", err)
+			return nil
+		}
+		d.k8sClient = c
+	}
+	return d.k8sClient.PodToContainers(ctx, pod)
+}
+
+// runningContainerIDs returns the sorted IDs of the running containers of
+// the pod.
+func runningContainerIDs(pod *v1.Pod) []string {
+	var ids []string
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.ContainerID != "" && s.State.Running != nil {
+			ids = append(ids, s.ContainerID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/parca-dev/parca-agent/pkg/k8s"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// fakeKubelet serves the /pods endpoint of a kubelet to clients with the
+// token.
+type fakeKubelet struct {
+	mtx  sync.Mutex
+	pods []v1.Pod
+}
+
+func (k *fakeKubelet) setPods(pods ...v1.Pod) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.pods = pods
+}
+
+func (k *fakeKubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	json.NewEncoder(w).Encode(v1.PodList{Items: k.pods}) //nolint:errcheck
+}
+
+func kubeletPodWithContainer(name, containerID string, labels map[string]string) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name, Labels: labels},
+		Status: v1.PodStatus{
+			PodIP: "10.0.0.1",
+			ContainerStatuses: []v1.ContainerStatus{{
+				Name:        "app",
+				ContainerID: containerID,
+				State:       v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+			}},
+		},
+	}
+}
+
+func TestKubeletDiscoverer(t *testing.T) {
+	kubelet := &fakeKubelet{}
+	server := httptest.NewTLSServer(kubelet)
+	defer server.Close()
+
+	pod := NewPodConfig("tier=web", "", "node-a", nil, nil, false, DefaultImageLabels())
+	c := NewKubeletConfig(pod, server.URL, commonconfig.HTTPClientConfig{
+		BearerToken: "secret",
+		TLSConfig:   commonconfig.TLSConfig{InsecureSkipVerify: true},
+	}, time.Minute)
+	d, err := c.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+	kd := d.(*KubeletDiscoverer)
+
+	lookups := 0
+	var lookupErr error
+	kd.containers = func(ctx context.Context, pod *v1.Pod) []*k8s.ContainerDefinition {
+		lookups++
+		s := pod.Status.ContainerStatuses[0]
+		if lookupErr != nil {
+			return []*k8s.ContainerDefinition{{ContainerName: s.Name, ContainerID: s.ContainerID, Err: lookupErr}}
+		}
+		return []*k8s.ContainerDefinition{{
+			ContainerName:       s.Name,
+			ContainerID:         s.ContainerID,
+			PerfEventCgroupPath: "/sys/fs/cgroup/kubepods/" + s.ContainerID[len("containerd://"):],
+		}}
+	}
+
+	ctx := context.Background()
+	up := make(chan []*target.Group, 1)
+
+	web := kubeletPodWithContainer("web", "containerd://abc", map[string]string{"tier": "web"})
+	db := kubeletPodWithContainer("db", "containerd://def", map[string]string{"tier": "db"})
+	kubelet.setPods(web, db)
+
+	// Only the pods matching the label selector are discovered.
+	kd.refresh(ctx, up)
+	require.Equal(t, []*target.Group{{
+		Targets: []model.LabelSet{{
+			"container":       "app",
+			"containerid":     "containerd://abc",
+			"__cgroup_path__": "/sys/fs/cgroup/kubepods/abc",
+		}},
+		Labels: model.LabelSet{
+			"namespace":                        "shop",
+			"pod":                              "web",
+			"__meta_kubernetes_pod_label_tier": "web",
+		},
+		Source: "pod/shop/web",
+	}}, <-up)
+	require.Equal(t, 1, lookups)
+
+	// The containers of pods are not looked up again until they change.
+	kd.refresh(ctx, up)
+	require.Len(t, <-up, 1)
+	require.Equal(t, 1, lookups)
+
+	// Containers that could not be looked up are looked up again on the
+	// next refresh.
+	web.Status.ContainerStatuses[0].ContainerID = "containerd://ghi"
+	kubelet.setPods(web)
+	lookupErr = errors.New("find pid: not found")
+	kd.refresh(ctx, up)
+	groups := <-up
+	require.Equal(t, 2, lookups)
+	require.Equal(t, model.LabelValue("find pid: not found"), groups[0].Targets[0]["__error__"])
+
+	lookupErr = nil
+	kd.refresh(ctx, up)
+	groups = <-up
+	require.Equal(t, 3, lookups)
+	require.Equal(t, model.LabelValue("/sys/fs/cgroup/kubepods/ghi"), groups[0].Targets[0]["__cgroup_path__"])
+
+	// The groups of pods that are gone are cleared.
+	kubelet.setPods()
+	kd.refresh(ctx, up)
+	require.Equal(t, []*target.Group{{Source: "pod/shop/web"}}, <-up)
+}
+
+func TestKubeletDiscovererUnauthorized(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeKubelet{})
+	defer server.Close()
+
+	pod := NewPodConfig("", "", "node-a", nil, nil, false, nil)
+	c := NewKubeletConfig(pod, server.URL, commonconfig.HTTPClientConfig{
+		TLSConfig: commonconfig.TLSConfig{InsecureSkipVerify: true},
+	}, time.Minute)
+	d, err := c.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+
+	_, err = d.(*KubeletDiscoverer).pods(context.Background())
+	require.EqualError(t, err, "unexpected status 401 Unauthorized")
+}
@@ -16,9 +16,12 @@ package discovery
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/strutil"
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/parca-dev/parca-agent/pkg/agent"
@@ -26,14 +29,43 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/target"
 )
 
+const (
+	// ProfileAnnotation opts a pod in or out of being profiled, with the
+	// "true" or "false" value.
+	ProfileAnnotation = "parca.dev/profile"
+
+	podMetaLabelPrefix       = model.MetaLabelPrefix + "kubernetes_pod_"
+	podLabelMetaLabelPrefix  = podMetaLabelPrefix + "label_"
+	podAnnotationLabelPrefix = podMetaLabelPrefix + "annotation_"
+	profileAnnotationOptIn   = "true"
+	profileAnnotationOptOut  = "false"
+
+	// ownerCacheSyncTimeout is how long pods wait for the owners of pods to be
+	// cached before they are discovered without their workload.
+	ownerCacheSyncTimeout = 30 * time.Second
+)
+
 type PodConfig struct {
 	podLabelSelector string
 	socketPath       string
 	nodeName         string
+
+	// podLabels and podAnnotations map the names of the pod labels and
+	// annotations to attach to the names of the target labels. The sanitized
+	// name of the pod label or annotation is used if the target label name
+	// is empty.
+	podLabels      map[string]string
+	podAnnotations map[string]string
+	// optIn only profiles the pods with the profile annotation set to
+	// "true", instead of all pods without it set to "false".
+	optIn bool
+	// imageLabels are the labels the images of containers are attached as.
+	imageLabels []string
 }
 
 type PodDiscoverer struct {
 	logger log.Logger
+	podTargets
 
 	podInformer *k8s.PodInformer
 	createdChan chan *v1.Pod
@@ -41,15 +73,44 @@ type PodDiscoverer struct {
 	k8sClient   *k8s.Client
 }
 
+// podTargets builds the target groups of pods, whether they are discovered
+// from the API server or from the kubelet.
+type podTargets struct {
+	podLabels      map[string]string
+	podAnnotations map[string]string
+	optIn          bool
+	imageLabels    []string
+	// owners resolves the workloads of pods, from their owner references
+	// only if nil.
+	owners *k8s.OwnerResolver
+}
+
+func (c *PodConfig) podTargets(owners *k8s.OwnerResolver) podTargets {
+	return podTargets{
+		podLabels:      c.podLabels,
+		podAnnotations: c.podAnnotations,
+		optIn:          c.optIn,
+		imageLabels:    c.imageLabels,
+		owners:         owners,
+	}
+}
+
 func (c *PodConfig) Name() string {
 	return c.nodeName
 }
 
-func NewPodConfig(podLabel, socketPath, nodeName string) *PodConfig {
+// NewPodConfig returns a config to discover the containers of the pods of
+// the node, with the given pod labels and annotations, and image labels,
+// attached to them.
+func NewPodConfig(podLabel, socketPath, nodeName string, podLabels, podAnnotations map[string]string, optIn bool, imageLabels []string) *PodConfig {
 	return &PodConfig{
 		podLabelSelector: podLabel,
 		socketPath:       socketPath,
 		nodeName:         nodeName,
+		podLabels:        podLabels,
+		podAnnotations:   podAnnotations,
+		optIn:            optIn,
+		imageLabels:      imageLabels,
 	}
 }
 
@@ -68,6 +129,7 @@ func (c *PodConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
 	}
 	g := &PodDiscoverer{
 		logger:      d.Logger,
+		podTargets:  c.podTargets(k8s.NewOwnerResolver(k8sClient.Clientset())),
 		podInformer: podInformer,
 		createdChan: createdChan,
 		deletedChan: deletedChan,
@@ -77,6 +139,20 @@ func (c *PodConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
 }
 
 func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	defer g.k8sClient.CloseCRI()
+	// The discoverer is stopped when its configuration changes, so its
+	// watch of the pods must not outlive it.
+	defer g.podInformer.Stop()
+
+	g.owners.Start(ctx)
+	syncCtx, cancel := context.WithTimeout(ctx, ownerCacheSyncTimeout)
+	if err := g.owners.WaitForCacheSync(syncCtx); err != nil {
+		// Without the caches, the ReplicaSets and Jobs of pods are their
+		// workloads, for instance if the agent is not allowed to list them.
+		level.Warn(g.logger).Log("msg", "failed to cache the owners of pods", "err", err)
+	}
+	cancel()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -90,8 +166,20 @@ func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) erro
 			case up <- group:
 			}
 		case pod := <-g.createdChan:
-			containers := g.k8sClient.PodToContainers(pod)
-			groups := []*target.Group{buildPod(pod, containers)}
+			// The containers of pods that are not profiled are not looked up,
+			// and their group is cleared in case they were opted out.
+			var containers []*k8s.ContainerDefinition
+			if g.profiled(pod) {
+				containers = g.k8sClient.PodToContainers(ctx, pod)
+			}
+			// Pods are only retried when they change, so the ones with
+			// containers that could not be looked up are retried with backoff.
+			if k8s.Failed(containers) {
+				g.podInformer.Retry(pod)
+			} else {
+				g.podInformer.Forget(pod)
+			}
+			groups := []*target.Group{g.buildPod(pod, containers)}
 
 			select {
 			case <-ctx.Done():
@@ -102,30 +190,81 @@ func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) erro
 	}
 }
 
-func buildPod(pod *v1.Pod, containers []*k8s.ContainerDefinition) *target.Group {
+// profiled reports whether the pod is opted in, or not opted out, of being
+// profiled with the profile annotation.
+func (g *podTargets) profiled(pod *v1.Pod) bool {
+	value, ok := pod.ObjectMeta.Annotations[ProfileAnnotation]
+	if g.optIn {
+		return ok && value == profileAnnotationOptIn
+	}
+	return !ok || value != profileAnnotationOptOut
+}
+
+func (g *podTargets) buildPod(pod *v1.Pod, containers []*k8s.ContainerDefinition) *target.Group {
 	tg := &target.Group{
 		Source: podSourceFromNamespaceAndName(pod.Namespace, pod.Name),
 		Labels: model.LabelSet{},
 	}
 	// PodIP can be empty when a pod is starting or has been evicted.
-	if len(pod.Status.PodIP) == 0 {
+	if len(pod.Status.PodIP) == 0 || len(containers) == 0 {
 		return tg
 	}
 
+	// All labels and annotations are available to relabeling.
+	for name, value := range pod.ObjectMeta.Labels {
+		tg.Labels[model.LabelName(podLabelMetaLabelPrefix+strutil.SanitizeLabelName(name))] = model.LabelValue(value)
+	}
+	for name, value := range pod.ObjectMeta.Annotations {
+		tg.Labels[model.LabelName(podAnnotationLabelPrefix+strutil.SanitizeLabelName(name))] = model.LabelValue(value)
+	}
+	addMappedLabels(tg.Labels, pod.ObjectMeta.Labels, g.podLabels)
+	addMappedLabels(tg.Labels, pod.ObjectMeta.Annotations, g.podAnnotations)
+
 	tg.Labels["namespace"] = model.LabelValue(pod.ObjectMeta.Namespace)
 	tg.Labels["pod"] = model.LabelValue(pod.ObjectMeta.Name)
+	if w, ok := g.owners.Workload(pod); ok {
+		tg.Labels["workload_kind"] = model.LabelValue(w.Kind)
+		tg.Labels["workload_name"] = model.LabelValue(w.Name)
+	}
 
 	for _, container := range containers {
-		tg.Targets = append(tg.Targets, model.LabelSet{
+		// Containers that could not be looked up have no cgroup, and are
+		// dropped with their error.
+		if container.Err != nil {
+			tg.Targets = append(tg.Targets, model.LabelSet{
+				"container":          model.LabelValue(container.ContainerName),
+				"containerid":        model.LabelValue(container.ContainerID),
+				agent.ErrorLabelName: model.LabelValue(container.Err.Error()),
+			})
+			continue
+		}
+		ls := model.LabelSet{
 			"container":               model.LabelValue(container.ContainerName),
 			"containerid":             model.LabelValue(container.ContainerID),
-			agent.CgroupPathLabelName: model.LabelValue(container.PerfEventCgroupPath()),
-		})
+			agent.CgroupPathLabelName: model.LabelValue(container.PerfEventCgroupPath),
+		}
+		addImageLabels(ls, container.Image, g.imageLabels)
+		tg.Targets = append(tg.Targets, ls)
 	}
 
 	return tg
 }
 
+// addMappedLabels sets the labels the values of the mapped pod labels or
+// annotations are attached as.
+func addMappedLabels(ls model.LabelSet, values, mapping map[string]string) {
+	for name, labelName := range mapping {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if labelName == "" {
+			labelName = strutil.SanitizeLabelName(name)
+		}
+		ls[model.LabelName(labelName)] = model.LabelValue(value)
+	}
+}
+
 func podSourceFromNamespaceAndName(namespace, name string) string {
 	return "pod/" + namespace + "/" + name
 }
@@ -0,0 +1,131 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/parca-dev/parca-agent/pkg/containerutils"
+	"github.com/parca-dev/parca-agent/pkg/k8s"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+func TestPodDiscovererBuildPod(t *testing.T) {
+	controller := true
+	owners := k8s.NewOwnerResolver(fake.NewSimpleClientset(&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "shop",
+		Name:            "web-6d4cf56db6",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &controller}},
+	}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	owners.Start(ctx)
+	require.NoError(t, owners.WaitForCacheSync(ctx))
+
+	g := &podTargets{
+		podLabels:      map[string]string{"app.kubernetes.io/name": "app", "team": ""},
+		podAnnotations: map[string]string{"example.com/owner": ""},
+		imageLabels:    []string{ImageLabel, ImageTagLabel},
+		owners:         owners,
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            "web-6d4cf56db6-x7z2k",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-6d4cf56db6", Controller: &controller}},
+			Labels: map[string]string{
+				"app.kubernetes.io/name": "web",
+				"team":                   "checkout",
+				"pod-template-hash":      "abc",
+			},
+			Annotations: map[string]string{"example.com/owner": "alice"},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	containers := []*k8s.ContainerDefinition{{
+		ContainerName: "web",
+		ContainerID:   "containerd://abc",
+
+		PerfEventCgroupPath: "/sys/fs/cgroup/perf_event/kubepods/pod1/abc",
+		Image:               containerutils.Image{Name: "shop/web", Tag: "1.0", Digest: "sha256:0123"},
+	}}
+
+	require.Equal(t, &target.Group{
+		Targets: []model.LabelSet{{
+			"container":       "web",
+			"containerid":     "containerd://abc",
+			"__cgroup_path__": "/sys/fs/cgroup/perf_event/kubepods/pod1/abc",
+			"image":           "shop/web",
+			"image_tag":       "1.0",
+		}},
+		Labels: model.LabelSet{
+			"namespace":         "shop",
+			"pod":               "web-6d4cf56db6-x7z2k",
+			"workload_kind":     "Deployment",
+			"workload_name":     "web",
+			"app":               "web",
+			"team":              "checkout",
+			"example_com_owner": "alice",
+			"__meta_kubernetes_pod_label_app_kubernetes_io_name": "web",
+			"__meta_kubernetes_pod_label_team":                   "checkout",
+			"__meta_kubernetes_pod_label_pod_template_hash":      "abc",
+			"__meta_kubernetes_pod_annotation_example_com_owner": "alice",
+		},
+		Source: "pod/shop/web-6d4cf56db6-x7z2k",
+	}, g.buildPod(pod, containers))
+
+	// Containers that could not be looked up are targets with their error,
+	// along with the ones that could.
+	containers = append(containers, &k8s.ContainerDefinition{
+		ContainerName: "sidecar",
+		ContainerID:   "containerd://def",
+		Err:           errors.New("find pid: not found"),
+	})
+	require.Equal(t, []model.LabelSet{
+		g.buildPod(pod, containers[:1]).Targets[0],
+		{
+			"container":   "sidecar",
+			"containerid": "containerd://def",
+			"__error__":   "find pid: not found",
+		},
+	}, g.buildPod(pod, containers).Targets)
+
+	// Pods that are not profiled have their group cleared.
+	require.Equal(t, &target.Group{Source: "pod/shop/web-6d4cf56db6-x7z2k", Labels: model.LabelSet{}}, g.buildPod(pod, nil))
+}
+
+func TestPodDiscovererProfiled(t *testing.T) {
+	pod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+	optOut := &podTargets{}
+	optIn := &podTargets{optIn: true}
+
+	require.True(t, optOut.profiled(pod(nil)))
+	require.True(t, optOut.profiled(pod(map[string]string{ProfileAnnotation: "true"})))
+	require.False(t, optOut.profiled(pod(map[string]string{ProfileAnnotation: "false"})))
+
+	require.False(t, optIn.profiled(pod(nil)))
+	require.True(t, optIn.profiled(pod(map[string]string{ProfileAnnotation: "true"})))
+	require.False(t, optIn.profiled(pod(map[string]string{ProfileAnnotation: "false"})))
+}
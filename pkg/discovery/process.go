@@ -0,0 +1,300 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+const (
+	processMetaLabelPrefix = model.MetaLabelPrefix + "process_"
+	processCmdlineLabel    = processMetaLabelPrefix + "cmdline"
+	processUserLabel       = processMetaLabelPrefix + "user"
+	processParentPIDLabel  = processMetaLabelPrefix + "parent_pid"
+)
+
+// ProcessMatcher selects the processes to profile. A process is selected if
+// it matches all of the non-empty fields.
+type ProcessMatcher struct {
+	// Executable is a glob pattern matched against the path of the
+	// executable of the process.
+	Executable string
+	// Cmdline is a regular expression matched against the space separated
+	// command line of the process.
+	Cmdline string
+	// User is the name or the ID of the real user of the process.
+	User string
+	// Parent is a glob pattern matched against the path of the executable of
+	// the parent process.
+	Parent string
+}
+
+type ProcessConfig struct {
+	procPath        string
+	matcher         ProcessMatcher
+	refreshInterval time.Duration
+}
+
+func (c *ProcessConfig) Name() string {
+	return "process"
+}
+
+// NewProcessConfig returns a config to discover the processes selected by
+// the matcher, scanning /proc every refreshInterval.
+func NewProcessConfig(matcher ProcessMatcher, refreshInterval time.Duration) *ProcessConfig {
+	return &ProcessConfig{
+		procPath:        procfs.DefaultMountPoint,
+		matcher:         matcher,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *ProcessConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	m := c.matcher
+	if m.Executable == "" && m.Cmdline == "" && m.User == "" && m.Parent == "" {
+		return nil, errors.New("process matcher must not be empty")
+	}
+	for _, pattern := range []string{m.Executable, m.Parent} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid executable pattern %q: %w", pattern, err)
+		}
+	}
+
+	var cmdline *regexp.Regexp
+	if m.Cmdline != "" {
+		var err error
+		cmdline, err = regexp.Compile(m.Cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cmdline regex: %w", err)
+		}
+	}
+
+	uid := m.User
+	if m.User != "" {
+		if _, err := strconv.Atoi(m.User); err != nil {
+			u, err := user.Lookup(m.User)
+			if err != nil {
+				return nil, fmt.Errorf("lookup user: %w", err)
+			}
+			uid = u.Uid
+		}
+	}
+
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		return nil, fmt.Errorf("open procfs: %w", err)
+	}
+
+	return &ProcessDiscoverer{
+		logger:          d.Logger,
+		fs:              fs,
+		executable:      m.Executable,
+		cmdline:         cmdline,
+		uid:             uid,
+		parent:          m.Parent,
+		refreshInterval: c.refreshInterval,
+		sources:         map[string]struct{}{},
+	}, nil
+}
+
+// ProcessDiscoverer discovers processes by scanning /proc. Each process is a
+// target with the __pid__ label, so that it is profiled on its own, including
+// the threads and processes it creates.
+type ProcessDiscoverer struct {
+	logger log.Logger
+	fs     procfs.FS
+
+	executable string
+	cmdline    *regexp.Regexp
+	uid        string
+	parent     string
+
+	refreshInterval time.Duration
+	sources         map[string]struct{}
+}
+
+// process is the information of a process used for matching.
+type process struct {
+	pid        int
+	ppid       int
+	executable string
+	cmdline    string
+	uid        string
+}
+
+func (d *ProcessDiscoverer) Run(ctx context.Context, up chan<- []*target.Group) error {
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		groups, err := d.refresh()
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to scan processes", "err", err)
+		} else {
+			select {
+			case up <- groups:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh returns the target groups of the matching processes, along with
+// empty target groups for the processes that exited or no longer match.
+func (d *ProcessDiscoverer) refresh() ([]*target.Group, error) {
+	procs, err := d.processes()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[int]bool{}
+	for pid, p := range procs {
+		matched[pid] = d.matches(p, procs)
+	}
+
+	sources := map[string]struct{}{}
+	var groups []*target.Group
+	for pid, p := range procs {
+		// Processes created by a matching process are sampled by the perf
+		// events inherited from it, so they are not targets on their own.
+		if !matched[pid] || hasMatchedAncestor(p, procs, matched) {
+			continue
+		}
+
+		source := fmt.Sprintf("process/%d", pid)
+		sources[source] = struct{}{}
+		groups = append(groups, &target.Group{
+			Targets: []model.LabelSet{{
+				agent.PIDLabelName:    model.LabelValue(strconv.Itoa(pid)),
+				"pid":                 model.LabelValue(strconv.Itoa(pid)),
+				"executable":          model.LabelValue(p.executable),
+				processCmdlineLabel:   model.LabelValue(p.cmdline),
+				processUserLabel:      model.LabelValue(p.uid),
+				processParentPIDLabel: model.LabelValue(strconv.Itoa(p.ppid)),
+			}},
+			Source: source,
+		})
+	}
+
+	for source := range d.sources {
+		if _, ok := sources[source]; !ok {
+			groups = append(groups, &target.Group{Source: source})
+		}
+	}
+	d.sources = sources
+
+	return groups, nil
+}
+
+// processes returns the user space processes, by PID.
+func (d *ProcessDiscoverer) processes() (map[int]process, error) {
+	all, err := d.fs.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+
+	procs := make(map[int]process, len(all))
+	for _, p := range all {
+		// Kernel threads have no executable, and processes might exit while
+		// they are read, so errors are skipped.
+		executable, err := p.Executable()
+		if err != nil || executable == "" {
+			continue
+		}
+		stat, err := p.Stat()
+		if err != nil {
+			continue
+		}
+		status, err := p.NewStatus()
+		if err != nil {
+			continue
+		}
+		cmdline, err := p.CmdLine()
+		if err != nil {
+			continue
+		}
+
+		procs[p.PID] = process{
+			pid:        p.PID,
+			ppid:       stat.PPID,
+			executable: executable,
+			cmdline:    strings.Join(cmdline, " "),
+			uid:        status.UIDs[0],
+		}
+	}
+	return procs, nil
+}
+
+func (d *ProcessDiscoverer) matches(p process, procs map[int]process) bool {
+	if d.executable != "" {
+		if ok, _ := filepath.Match(d.executable, p.executable); !ok {
+			return false
+		}
+	}
+	if d.cmdline != nil && !d.cmdline.MatchString(p.cmdline) {
+		return false
+	}
+	if d.uid != "" && d.uid != p.uid {
+		return false
+	}
+	if d.parent != "" {
+		parent, ok := procs[p.ppid]
+		if !ok {
+			return false
+		}
+		if ok, _ := filepath.Match(d.parent, parent.executable); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func hasMatchedAncestor(p process, procs map[int]process, matched map[int]bool) bool {
+	// The number of ancestors is bounded to not loop on PIDs that were
+	// reused while /proc was read.
+	for i := 0; i < len(procs); i++ {
+		parent, ok := procs[p.ppid]
+		if !ok {
+			return false
+		}
+		if matched[parent.pid] {
+			return true
+		}
+		p = parent
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/target"
+)
+
+// writeProc writes the files of a process that the process discoverer reads
+// to a fake /proc.
+func writeProc(t *testing.T, procPath string, pid, ppid, uid int, exe string, args ...string) {
+	dir := filepath.Join(procPath, fmt.Sprint(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.Symlink(exe, filepath.Join(dir, "exe")))
+
+	comm := filepath.Base(exe)
+	stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 1000 0 0 0 10 5 0 0 20 0 1 0 100 1000000 100 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0\n", pid, comm, ppid, pid, pid)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644))
+
+	status := fmt.Sprintf("Name:\t%s\nPid:\t%d\nPPid:\t%d\nUid:\t%d\t%d\t%d\t%d\n", comm, pid, ppid, uid, uid, uid, uid)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0o644))
+
+	cmdline := strings.Join(append([]string{exe}, args...), "\x00") + "\x00"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0o644))
+}
+
+func TestProcessDiscoverer(t *testing.T) {
+	procPath := t.TempDir()
+	writeProc(t, procPath, 1, 0, 0, "/sbin/init")
+	writeProc(t, procPath, 100, 1, 1000, "/usr/bin/java", "-jar", "app.jar")
+	writeProc(t, procPath, 101, 100, 1000, "/usr/bin/java", "-jar", "worker.jar")
+	writeProc(t, procPath, 200, 1, 0, "/usr/bin/java", "-jar", "other.jar")
+	writeProc(t, procPath, 300, 1, 1000, "/usr/bin/python3", "app.jar")
+
+	newDiscoverer := func(m ProcessMatcher) *ProcessDiscoverer {
+		c := NewProcessConfig(m, time.Second)
+		c.procPath = procPath
+		d, err := c.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+		require.NoError(t, err)
+		return d.(*ProcessDiscoverer)
+	}
+	pids := func(groups []*target.Group) []string {
+		var res []string
+		for _, g := range groups {
+			if len(g.Targets) > 0 {
+				res = append(res, string(g.Targets[0]["__pid__"]))
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	for _, tc := range []struct {
+		name     string
+		matcher  ProcessMatcher
+		expected []string
+	}{
+		{
+			name: "executable",
+			// The child of 100 is sampled by the events inherited from it.
+			matcher:  ProcessMatcher{Executable: "/usr/bin/java*"},
+			expected: []string{"100", "200"},
+		},
+		{
+			name:     "cmdline",
+			matcher:  ProcessMatcher{Cmdline: `-jar (app|other)\.jar`},
+			expected: []string{"100", "200"},
+		},
+		{
+			name:     "user",
+			matcher:  ProcessMatcher{Executable: "/usr/bin/java", User: "1000"},
+			expected: []string{"100"},
+		},
+		{
+			name:     "parent",
+			matcher:  ProcessMatcher{Parent: "/usr/bin/java"},
+			expected: []string{"101"},
+		},
+		{
+			name:    "none",
+			matcher: ProcessMatcher{Executable: "/usr/bin/ruby"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			groups, err := newDiscoverer(tc.matcher).refresh()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, pids(groups))
+		})
+	}
+
+	d := newDiscoverer(ProcessMatcher{Cmdline: "app.jar"})
+	groups, err := d.refresh()
+	require.NoError(t, err)
+	require.Equal(t, []*target.Group{{
+		Targets: []model.LabelSet{{
+			"__pid__":                   "100",
+			"pid":                       "100",
+			"executable":                "/usr/bin/java",
+			"__meta_process_cmdline":    "/usr/bin/java -jar app.jar",
+			"__meta_process_user":       "1000",
+			"__meta_process_parent_pid": "1",
+		}},
+		Source: "process/100",
+	}, {
+		Targets: []model.LabelSet{{
+			"__pid__":                   "300",
+			"pid":                       "300",
+			"executable":                "/usr/bin/python3",
+			"__meta_process_cmdline":    "/usr/bin/python3 app.jar",
+			"__meta_process_user":       "1000",
+			"__meta_process_parent_pid": "1",
+		}},
+		Source: "process/300",
+	}}, sortGroups(groups))
+
+	// Exited processes are cleared.
+	require.NoError(t, os.RemoveAll(filepath.Join(procPath, "300")))
+	groups, err = d.refresh()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(groups))
+	require.Equal(t, &target.Group{Source: "process/300"}, sortGroups(groups)[1])
+
+	_, err = NewProcessConfig(ProcessMatcher{}, time.Second).NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.Error(t, err)
+}
+
+func sortGroups(groups []*target.Group) []*target.Group {
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Source < groups[j].Source })
+	return groups
+}
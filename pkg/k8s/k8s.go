@@ -29,9 +29,9 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
 	"github.com/parca-dev/parca-agent/pkg/containerutils"
-	"github.com/parca-dev/parca-agent/pkg/containerutils/containerd"
-	"github.com/parca-dev/parca-agent/pkg/containerutils/crio"
+	"github.com/parca-dev/parca-agent/pkg/containerutils/cri"
 	"github.com/parca-dev/parca-agent/pkg/containerutils/docker"
 )
 
@@ -76,8 +76,8 @@ func NewK8sClient(logger log.Logger, nodeName, socketPath string) (*Client, erro
 	}
 
 	// get a CRI client to talk to the CRI handling pods in this node
-	// TODO: when to close it?
-	criClient, err := newCRIClient(logger, node, socketPath)
+	criType := strings.SplitN(node.Status.NodeInfo.ContainerRuntimeVersion, "://", 2)[0]
+	criClient, err := newCRIClient(criType, socketPath)
 	if err != nil {
 		return nil, fmt.Errorf("create CRI client: %w", err)
 	}
@@ -91,43 +91,51 @@ func NewK8sClient(logger log.Logger, nodeName, socketPath string) (*Client, erro
 	}, nil
 }
 
-func (c *Client) Clientset() kubernetes.Interface {
-	return c.clientset
+// NewCRIClient returns a client that only looks up the containers of pods in
+// the container runtime of the node, for when pods are not discovered from
+// the API server. The runtime is the name container IDs are prefixed with,
+// such as containerd.
+func NewCRIClient(logger log.Logger, nodeName, runtime, socketPath string) (*Client, error) {
+	criClient, err := newCRIClient(runtime, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create CRI client: %w", err)
+	}
+
+	return &Client{
+		logger:    logger,
+		nodeName:  nodeName,
+		criClient: criClient,
+	}, nil
 }
 
-func newCRIClient(logger log.Logger, node *v1.Node, socketPath string) (containerutils.CRIClient, error) {
-	criVersion := node.Status.NodeInfo.ContainerRuntimeVersion
-	list := strings.Split(criVersion, "://")
-	if len(list) < 1 {
-		return nil, fmt.Errorf("Impossible to get CRI type from %s", criVersion)
+// Clientset returns the clientset of the API server, which is nil for
+// clients created with NewCRIClient.
+func (c *Client) Clientset() kubernetes.Interface {
+	if c.clientset == nil {
+		return nil
 	}
+	return c.clientset
+}
 
-	criType := list[0]
-
-	switch criType {
-	case "docker":
+// newCRIClient returns a client for the container runtime with the given
+// name. Docker is looked up through the Docker API, and all other runtimes
+// through CRI.
+func newCRIClient(criType, socketPath string) (containerutils.CRIClient, error) {
+	if criType == "docker" {
 		if socketPath == "" {
 			socketPath = docker.DefaultSocketPath
 		}
 		return docker.NewDockerClient(socketPath)
-	case "containerd":
-		if socketPath == "" {
-			if _, err := os.Stat(containerd.DefaultSocketPath); err == nil {
-				socketPath = containerd.DefaultSocketPath
-			}
-			if _, err := os.Stat(containerd.DefaultK3SSocketPath); err == nil {
-				socketPath = containerd.DefaultK3SSocketPath
-			}
-		}
-		return containerd.NewContainerdClient(socketPath)
-	case "cri-o":
-		if socketPath == "" {
-			socketPath = crio.DefaultSocketPath
+	}
+
+	if socketPath == "" {
+		var err error
+		socketPath, err = cri.DefaultSocketPath()
+		if err != nil {
+			return nil, fmt.Errorf("find socket of %q runtime: %w", criType, err)
 		}
-		return crio.NewCrioClient(logger, socketPath)
-	default:
-		return nil, fmt.Errorf("unknown '%s' cri", criType)
 	}
+	return cri.NewClient(socketPath)
 }
 
 func (c *Client) CloseCRI() {
@@ -148,6 +156,14 @@ type ContainerDefinition struct {
 	CgroupV2      string
 	MountSources  []string
 	PID           int
+
+	// PerfEventCgroupPath is the path of the cgroup of the container that
+	// perf events are attached to.
+	PerfEventCgroupPath string
+	// Image is the image the container runs.
+	Image containerutils.Image
+	// Err is why the container could not be looked up, if it could not.
+	Err error
 }
 
 func (c *ContainerDefinition) Labels() []*profilestorepb.Label {
@@ -169,27 +185,11 @@ func (c *ContainerDefinition) Labels() []*profilestorepb.Label {
 	}}
 }
 
-func (c *ContainerDefinition) PerfEventCgroupPath() string {
-	// This is so hacky I'm thoroughly ashamed of it, but cgroup setups are so
-	// inconsistent that this is a "works most of the time" heuristic.
-	parts := strings.Split(c.CgroupV1, "/")
-	kubepodsFound := false
-	keep := []string{}
-	for _, part := range parts {
-		if strings.HasPrefix(part, "kubepods") {
-			kubepodsFound = true
-		}
-		if kubepodsFound {
-			keep = append(keep, part)
-		}
-	}
-
-	return "/sys/fs/cgroup/perf_event/" + strings.Join(keep, "/")
-}
-
 // PodToContainers return a list of the containers of a given Pod.
 // Containers that are not running or don't have an ID are not considered.
-func (c *Client) PodToContainers(pod *v1.Pod) []*ContainerDefinition {
+// Containers that could not be looked up, for instance because they are
+// still starting, are returned with only their name and ID, and the error.
+func (c *Client) PodToContainers(ctx context.Context, pod *v1.Pod) []*ContainerDefinition {
 	containers := []*ContainerDefinition{}
 
 	for _, s := range pod.Status.ContainerStatuses {
@@ -200,37 +200,19 @@ func (c *Client) PodToContainers(pod *v1.Pod) []*ContainerDefinition {
 			continue
 		}
 
-		pid, err := c.criClient.PIDFromContainerID(s.ContainerID)
-		if err != nil {
-			level.Warn(c.logger).Log("msg", "skipping pod, cannot find pid", "namespace", pod.GetNamespace(), "pod", pod.GetName(), "err", err)
-			continue
-		}
-		cgroupPathV1, cgroupPathV2, err := containerutils.GetCgroupPaths(pid)
+		containerDef, err := c.containerDefinition(ctx, pod, s)
 		if err != nil {
-			level.Warn(c.logger).Log("msg", "skipping pod, cannot find cgroup path", "namespace", pod.GetNamespace(), "pod", pod.GetName(), "err", err)
-			continue
-		}
-		cgroupPathV2WithMountpoint, _ := containerutils.CgroupPathV2AddMountpoint(cgroupPathV2)
-		cgroupID, _ := containerutils.GetCgroupID(cgroupPathV2WithMountpoint)
-		mntns, err := containerutils.GetMntNs(pid)
-		if err != nil {
-			level.Warn(c.logger).Log("msg", "skipping pod, cannot find mnt namespace", "namespace", pod.GetNamespace(), "pod", pod.GetName(), "err", err)
-			continue
-		}
+			level.Warn(c.logger).Log("msg", "failed to look up container", "namespace", pod.GetNamespace(), "pod", pod.GetName(), "container", s.Name, "err", err)
+			containerDef = &ContainerDefinition{
+				NodeName:      c.nodeName,
+				ContainerID:   s.ContainerID,
+				Namespace:     pod.GetNamespace(),
+				PodName:       pod.GetName(),
+				ContainerName: s.Name,
+				PodLabels:     pod.ObjectMeta.Labels,
 
-		containerDef := &ContainerDefinition{
-			NodeName:      c.nodeName,
-			ContainerID:   s.ContainerID,
-			CgroupPath:    cgroupPathV2WithMountpoint,
-			CgroupID:      cgroupID,
-			Mntns:         mntns,
-			Namespace:     pod.GetNamespace(),
-			PodName:       pod.GetName(),
-			ContainerName: s.Name,
-			PodLabels:     pod.ObjectMeta.Labels,
-			PID:           pid,
-			CgroupV1:      cgroupPathV1,
-			CgroupV2:      cgroupPathV2,
+				Err: err,
+			}
 		}
 		containers = append(containers, containerDef)
 	}
@@ -238,6 +220,70 @@ func (c *Client) PodToContainers(pod *v1.Pod) []*ContainerDefinition {
 	return containers
 }
 
+// containerDefinition looks up the running container of the pod with the
+// given status in the container runtime and the host.
+func (c *Client) containerDefinition(ctx context.Context, pod *v1.Pod, s v1.ContainerStatus) (*ContainerDefinition, error) {
+	status, err := c.criClient.ContainerStatus(ctx, s.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("find pid: %w", err)
+	}
+	pid := status.PID
+	cgroupPathV1, cgroupPathV2, err := containerutils.GetCgroupPaths(pid)
+	if err != nil {
+		return nil, fmt.Errorf("find cgroup path: %w", err)
+	}
+	perfEventCgroupPath, err := perfEventCgroupPath(status)
+	if err != nil {
+		return nil, fmt.Errorf("resolve perf_event cgroup: %w", err)
+	}
+	cgroupPathV2WithMountpoint, _ := containerutils.CgroupPathV2AddMountpoint(cgroupPathV2)
+	cgroupID, _ := containerutils.GetCgroupID(cgroupPathV2WithMountpoint)
+	mntns, err := containerutils.GetMntNs(pid)
+	if err != nil {
+		return nil, fmt.Errorf("find mnt namespace: %w", err)
+	}
+
+	return &ContainerDefinition{
+		NodeName:      c.nodeName,
+		ContainerID:   s.ContainerID,
+		CgroupPath:    cgroupPathV2WithMountpoint,
+		CgroupID:      cgroupID,
+		Mntns:         mntns,
+		Namespace:     pod.GetNamespace(),
+		PodName:       pod.GetName(),
+		ContainerName: s.Name,
+		PodLabels:     pod.ObjectMeta.Labels,
+		PID:           pid,
+		CgroupV1:      cgroupPathV1,
+		CgroupV2:      cgroupPathV2,
+
+		PerfEventCgroupPath: perfEventCgroupPath,
+		Image:               status.Image,
+	}, nil
+}
+
+// Failed reports whether some of the containers could not be looked up.
+func Failed(containers []*ContainerDefinition) bool {
+	for _, c := range containers {
+		if c.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// perfEventCgroupPath returns the path of the cgroup of the container that
+// perf events are attached to, preferring the cgroup the runtime reports over
+// the one of the container's process.
+func perfEventCgroupPath(status containerutils.ContainerStatus) (string, error) {
+	if status.CgroupPath != "" {
+		if path, err := cgroup.PerfEventPath(status.CgroupPath); err == nil {
+			return path, nil
+		}
+	}
+	return cgroup.PerfEventCgroupPath(status.PID)
+}
+
 // ListContainers return a list of the current containers that are
 // running in the node.
 func (c *Client) ListContainers() (arr []*ContainerDefinition, err error) {
@@ -250,8 +296,11 @@ func (c *Client) ListContainers() (arr []*ContainerDefinition, err error) {
 	}
 
 	for _, pod := range pods.Items {
-		containers := c.PodToContainers(&pod)
-		arr = append(arr, containers...)
+		for _, container := range c.PodToContainers(context.TODO(), &pod) {
+			if container.Err == nil {
+				arr = append(arr, container)
+			}
+		}
 	}
 	return arr, nil
 }
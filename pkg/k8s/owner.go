@@ -0,0 +1,162 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	batchv1listers "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// maxCronJobDelay is how long after the time a CronJob scheduled a Job at the
+// pods of the Job are assumed to be created, when the CronJob is resolved
+// from the name of the Job.
+const maxCronJobDelay = 24 * time.Hour
+
+// Workload is the top-level controller of a pod, such as a Deployment.
+type Workload struct {
+	Kind string
+	Name string
+}
+
+// OwnerResolver resolves the workloads pods belong to, following the owner
+// references of the ReplicaSets and Jobs that are in between, which are
+// cached by informers.
+type OwnerResolver struct {
+	factory          informers.SharedInformerFactory
+	replicaSetLister appsv1listers.ReplicaSetLister
+	jobLister        batchv1listers.JobLister
+	synced           []cache.InformerSynced
+}
+
+// NewOwnerResolver returns a resolver caching the ReplicaSets and Jobs of the
+// cluster. It must be started with Start before it is used.
+func NewOwnerResolver(clientset kubernetes.Interface) *OwnerResolver {
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	replicaSets := factory.Apps().V1().ReplicaSets()
+	jobs := factory.Batch().V1().Jobs()
+
+	return &OwnerResolver{
+		factory:          factory,
+		replicaSetLister: replicaSets.Lister(),
+		jobLister:        jobs.Lister(),
+		synced:           []cache.InformerSynced{replicaSets.Informer().HasSynced, jobs.Informer().HasSynced},
+	}
+}
+
+// Start starts the informers, which stop when the context is canceled.
+func (r *OwnerResolver) Start(ctx context.Context) {
+	r.factory.Start(ctx.Done())
+}
+
+// WaitForCacheSync waits for the caches of the informers to be filled, until
+// the context is canceled.
+func (r *OwnerResolver) WaitForCacheSync(ctx context.Context) error {
+	if !cache.WaitForCacheSync(ctx.Done(), r.synced...) {
+		return errors.New("failed to sync replica set and job caches")
+	}
+	return nil
+}
+
+// Workload returns the workload the pod belongs to. Pods without a
+// controller have no workload. If an intermediate ReplicaSet or Job has no
+// controller itself, it is the workload. ReplicaSets that are not known, or
+// all of them if the resolver is nil, are resolved to their Deployment by the
+// pod template hash the Deployment labels their pods with, and Jobs to their
+// CronJob by the scheduled time the CronJob names them with.
+func (r *OwnerResolver) Workload(pod *v1.Pod) (Workload, bool) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return Workload{}, false
+	}
+
+	var (
+		ownerOfOwner *metav1.OwnerReference
+		known        bool
+	)
+	switch owner.Kind {
+	case "ReplicaSet":
+		if r != nil {
+			rs, err := r.replicaSetLister.ReplicaSets(pod.Namespace).Get(owner.Name)
+			if err == nil {
+				ownerOfOwner, known = metav1.GetControllerOf(rs), true
+			}
+		}
+		if !known {
+			if name, ok := deploymentName(pod, owner.Name); ok {
+				ownerOfOwner = &metav1.OwnerReference{Kind: "Deployment", Name: name}
+			}
+		}
+	case "Job":
+		if r != nil {
+			job, err := r.jobLister.Jobs(pod.Namespace).Get(owner.Name)
+			if err == nil {
+				ownerOfOwner, known = metav1.GetControllerOf(job), true
+			}
+		}
+		if !known {
+			if name, ok := cronJobName(pod, owner.Name); ok {
+				ownerOfOwner = &metav1.OwnerReference{Kind: "CronJob", Name: name}
+			}
+		}
+	}
+	if ownerOfOwner != nil {
+		owner = ownerOfOwner
+	}
+
+	return Workload{Kind: owner.Kind, Name: owner.Name}, true
+}
+
+// deploymentName returns the name of the Deployment of the pod from the name
+// of its ReplicaSet, which is the name of the Deployment followed by the pod
+// template hash.
+func deploymentName(pod *v1.Pod, replicaSet string) (string, bool) {
+	hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" || !strings.HasSuffix(replicaSet, "-"+hash) {
+		return "", false
+	}
+	return strings.TrimSuffix(replicaSet, "-"+hash), true
+}
+
+// cronJobName returns the name of the CronJob of the pod from the name of its
+// Job, which is the name of the CronJob followed by the time the Job was
+// scheduled at, in minutes since the epoch. As Jobs created by hand can be
+// named alike, the pod must have been created shortly after that time.
+func cronJobName(pod *v1.Pod, job string) (string, bool) {
+	i := strings.LastIndex(job, "-")
+	if i <= 0 {
+		return "", false
+	}
+	minutes, err := strconv.ParseUint(job[i+1:], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	scheduled := time.Unix(int64(minutes)*60, 0)
+	created := pod.CreationTimestamp.Time
+	if created.Before(scheduled) || created.Sub(scheduled) > maxCronJobDelay {
+		return "", false
+	}
+	return job[:i], true
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func TestOwnerResolverWorkload(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            "web-6d4cf56db6",
+			OwnerReferences: controlledBy("Deployment", "web"),
+		}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "shop",
+			Name:      "standalone",
+		}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            "report-27500000",
+			OwnerReferences: controlledBy("CronJob", "report"),
+		}},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewOwnerResolver(clientset)
+	r.Start(ctx)
+	require.NoError(t, r.WaitForCacheSync(ctx))
+
+	pod := func(owners []metav1.OwnerReference) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "pod", OwnerReferences: owners}}
+	}
+	for _, tc := range []struct {
+		name     string
+		owners   []metav1.OwnerReference
+		expected Workload
+		ok       bool
+	}{
+		{
+			name:     "deployment",
+			owners:   controlledBy("ReplicaSet", "web-6d4cf56db6"),
+			expected: Workload{Kind: "Deployment", Name: "web"},
+			ok:       true,
+		},
+		{
+			name:     "replica set without controller",
+			owners:   controlledBy("ReplicaSet", "standalone"),
+			expected: Workload{Kind: "ReplicaSet", Name: "standalone"},
+			ok:       true,
+		},
+		{
+			name:     "unknown replica set",
+			owners:   controlledBy("ReplicaSet", "gone"),
+			expected: Workload{Kind: "ReplicaSet", Name: "gone"},
+			ok:       true,
+		},
+		{
+			name:     "cron job",
+			owners:   controlledBy("Job", "report-27500000"),
+			expected: Workload{Kind: "CronJob", Name: "report"},
+			ok:       true,
+		},
+		{
+			name:     "stateful set",
+			owners:   controlledBy("StatefulSet", "db"),
+			expected: Workload{Kind: "StatefulSet", Name: "db"},
+			ok:       true,
+		},
+		{
+			name:     "daemon set",
+			owners:   controlledBy("DaemonSet", "agent"),
+			expected: Workload{Kind: "DaemonSet", Name: "agent"},
+			ok:       true,
+		},
+		{
+			name:   "no controller",
+			owners: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-6d4cf56db6"}},
+		},
+		{
+			name: "standalone pod",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, ok := r.Workload(pod(tc.owners))
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.expected, w)
+		})
+	}
+}
+
+func TestWorkloadWithoutResolver(t *testing.T) {
+	var r *OwnerResolver
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "shop",
+		Name:            "web-6d4cf56db6-x7z2k",
+		Labels:          map[string]string{"pod-template-hash": "6d4cf56db6"},
+		OwnerReferences: controlledBy("ReplicaSet", "web-6d4cf56db6"),
+	}}
+	w, ok := r.Workload(pod)
+	require.True(t, ok)
+	require.Equal(t, Workload{Kind: "Deployment", Name: "web"}, w)
+
+	// ReplicaSets that are not created by a Deployment have no pod template
+	// hash.
+	pod.Labels = nil
+	w, ok = r.Workload(pod)
+	require.True(t, ok)
+	require.Equal(t, Workload{Kind: "ReplicaSet", Name: "web-6d4cf56db6"}, w)
+
+	// Jobs are resolved to their CronJob by the time they were scheduled
+	// at, 27500000 minutes since the epoch, if their pods were created
+	// shortly after.
+	pod.OwnerReferences = controlledBy("Job", "report-27500000")
+	pod.CreationTimestamp = metav1.NewTime(time.Unix(27500000*60, 0).Add(10 * time.Second))
+	w, ok = r.Workload(pod)
+	require.True(t, ok)
+	require.Equal(t, Workload{Kind: "CronJob", Name: "report"}, w)
+
+	pod.CreationTimestamp = metav1.NewTime(time.Unix(27500000*60, 0).Add(48 * time.Hour))
+	w, ok = r.Workload(pod)
+	require.True(t, ok)
+	require.Equal(t, Workload{Kind: "Job", Name: "report-27500000"}, w)
+
+	pod.OwnerReferences = controlledBy("Job", "migrate-v2")
+	w, ok = r.Workload(pod)
+	require.True(t, ok)
+	require.Equal(t, Workload{Kind: "Job", Name: "migrate-v2"}, w)
+}
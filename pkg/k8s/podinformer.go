@@ -32,6 +32,11 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
 
+// maxRetries is the number of times a pod is retried before giving up, which
+// spans a few minutes with the backoff of the queue. Pods are still processed
+// again when they change.
+const maxRetries = 15
+
 type PodInformer struct {
 	logger log.Logger
 
@@ -119,23 +124,58 @@ func (p *PodInformer) processNextItem() bool {
 	return true
 }
 
-// notifyChans passes the event to the channels configured by the user.
+// notifyChans passes the event to the channels configured by the user, unless
+// the informer is stopped. The receiver of created pods either retries or
+// forgets them.
 func (p *PodInformer) notifyChans(key string) error {
 	obj, exists, err := p.indexer.GetByKey(key)
 	if err != nil {
+		p.queue.Forget(key)
 		return fmt.Errorf("fetch object with key %s from store: %w", key, err)
 	}
-	defer p.queue.Forget(key)
 
 	if !exists {
-		p.deletedPodChan <- key
+		p.queue.Forget(key)
+		select {
+		case p.deletedPodChan <- key:
+		case <-p.stop:
+		}
 		return nil
 	}
 
-	p.createdPodChan <- obj.(*v1.Pod)
+	select {
+	case p.createdPodChan <- obj.(*v1.Pod):
+	case <-p.stop:
+	}
 	return nil
 }
 
+// Retry passes the pod to the created pods channel again after a rate-limited
+// backoff, for instance because some of its containers could not be looked up
+// yet. Pods are retried up to maxRetries times in a row.
+func (p *PodInformer) Retry(pod *v1.Pod) {
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		return
+	}
+	if p.queue.NumRequeues(key) >= maxRetries {
+		level.Warn(p.logger).Log("msg", "giving up on retrying pod", "pod", key, "retries", maxRetries)
+		p.queue.Forget(key)
+		return
+	}
+	p.queue.AddRateLimited(key)
+}
+
+// Forget resets the backoff of the pod, once it no longer needs to be
+// retried.
+func (p *PodInformer) Forget(pod *v1.Pod) {
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		return
+	}
+	p.queue.Forget(key)
+}
+
 func (p *PodInformer) Run(threadiness int, stopCh chan struct{}) {
 	defer runtime.HandleCrash()
 
@@ -0,0 +1,63 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPodInformerRetry(t *testing.T) {
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	p := &PodInformer{logger: log.NewNopLogger(), queue: queue}
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	for i := 0; i < maxRetries; i++ {
+		p.Retry(pod)
+	}
+	require.Equal(t, maxRetries, queue.NumRequeues("default/web"))
+
+	// The pod is given up on, and gets a fresh budget of retries when it
+	// changes.
+	p.Retry(pod)
+	require.Equal(t, 0, queue.NumRequeues("default/web"))
+}
+
+func TestPodInformerNotifyAfterStop(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, indexer.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}))
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	p := &PodInformer{
+		logger:         log.NewNopLogger(),
+		indexer:        indexer,
+		queue:          queue,
+		stop:           make(chan struct{}),
+		createdPodChan: make(chan *v1.Pod),
+		deletedPodChan: make(chan string),
+	}
+	p.Stop()
+
+	// Nobody receives from the channels of a stopped informer, which must
+	// not block on them.
+	require.NoError(t, p.notifyChans("default/web"))
+	require.NoError(t, p.notifyChans("default/gone"))
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprofui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+)
+
+// ErrNoBase is returned by FetchProfile if a diff is required but no base
+// profile was selected.
+var ErrNoBase = errors.New("a base_query, base_start or base_end parameter is required")
+
+// badRequestError is an error caused by invalid request parameters.
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string { return e.err.Error() }
+func (e badRequestError) Unwrap() error { return e.err }
+
+// FetchProfile returns the profile selected by the query, start and end URL
+// parameters of r.
+//
+// If any of the base_query, base_start or base_end parameters is set, the
+// profile selected by them is subtracted, with the semantics of the
+// -diff_base option of pprof: the base samples are negated and tagged so that
+// reports show percentages relative to the base. The base_query parameter
+// defaults to query, so that the same series can be compared between two
+// time ranges. With normalize=true the selected profile is scaled to the
+// total of the base first, which allows comparing time ranges of different
+// lengths. If requireBase is set, ErrNoBase is returned for requests that do
+// not select a base.
+func FetchProfile(q Querier, r *http.Request, requireBase bool) (*profile.Profile, error) {
+	matchers, start, end, err := ParseQuery(r)
+	if err != nil {
+		return nil, badRequestError{err}
+	}
+
+	params := r.URL.Query()
+	diff := params.Get("base_query") != "" || params.Get("base_start") != "" || params.Get("base_end") != ""
+	if !diff {
+		if requireBase {
+			return nil, badRequestError{ErrNoBase}
+		}
+		return q.Query(matchers, start, end)
+	}
+
+	base := url.Values{
+		"query": {params.Get("base_query")},
+		"start": {params.Get("base_start")},
+		"end":   {params.Get("base_end")},
+	}
+	if base.Get("query") == "" {
+		base.Set("query", params.Get("query"))
+	}
+	baseMatchers, baseStart, baseEnd, err := ParseQuery(&http.Request{URL: &url.URL{RawQuery: base.Encode()}})
+	if err != nil {
+		return nil, badRequestError{fmt.Errorf("base: %w", err)}
+	}
+
+	normalize := false
+	if v := params.Get("normalize"); v != "" {
+		normalize, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, badRequestError{fmt.Errorf("invalid normalize %q", v)}
+		}
+	}
+
+	p, err := q.Query(matchers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	pbase, err := q.Query(baseMatchers, baseStart, baseEnd)
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+	return diffProfiles(p, pbase, normalize)
+}
+
+// diffProfiles subtracts base from p like pprof's -diff_base option does.
+func diffProfiles(p, base *profile.Profile, normalize bool) (*profile.Profile, error) {
+	base.SetLabel("pprof::base", []string{"true"})
+	if normalize {
+		if err := p.Normalize(base); err != nil {
+			return nil, badRequestError{fmt.Errorf("normalize: %w", err)}
+		}
+	}
+	base.Scale(-1)
+
+	diff, err := profile.Merge([]*profile.Profile{p, base})
+	if err != nil {
+		return nil, badRequestError{fmt.Errorf("profiles cannot be compared: %w", err)}
+	}
+	return diff, nil
+}
+
+// WriteError replies to a request with the given error returned by
+// FetchProfile and a matching HTTP status code.
+func WriteError(w http.ResponseWriter, err error) {
+	var bre badRequestError
+	switch {
+	case errors.As(err, &bre), errors.Is(err, agent.ErrMixedSampleTypes):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, agent.ErrNoMatchingProfiles):
+		http.Error(w, "No recent profile matches the requested label-matchers query in the requested time range. "+
+			"Either the profiler matching the label-set has stopped profiling, or the label-set was incorrect.",
+			http.StatusNotFound)
+	default:
+		http.Error(w, "Unexpected error occurred: "+err.Error(), http.StatusInternalServerError)
+	}
+}
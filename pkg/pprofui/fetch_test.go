@@ -0,0 +1,133 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprofui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+)
+
+// windowQuerier returns a profile of two functions, whose values depend on
+// the start of the queried time range.
+type windowQuerier map[int64][2]int64
+
+func (q windowQuerier) Query(_ []*labels.Matcher, start, _ time.Time) (*profile.Profile, error) {
+	values, ok := q[start.Unix()]
+	if !ok {
+		return nil, agent.ErrNoMatchingProfiles
+	}
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+	for i, name := range []string{"main.old", "main.new"} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: name}
+		loc := &profile.Location{ID: uint64(i + 1), Address: uint64(0x1000 * (i + 1)), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Value: []int64{values[i]}, Location: []*profile.Location{loc}})
+	}
+	return p, nil
+}
+
+func TestFetchProfile(t *testing.T) {
+	q := windowQuerier{
+		100: {30, 10},
+		200: {10, 40},
+	}
+
+	fetch := func(requireBase bool, params ...string) (*profile.Profile, error) {
+		v := url.Values{"query": {`{pod="a"}`}}
+		for i := 0; i < len(params); i += 2 {
+			v.Set(params[i], params[i+1])
+		}
+		return FetchProfile(q, httptest.NewRequest(http.MethodGet, "/?"+v.Encode(), nil), requireBase)
+	}
+	values := func(p *profile.Profile) map[string]int64 {
+		res := map[string]int64{}
+		for _, s := range p.Sample {
+			res[s.Location[0].Line[0].Function.Name] += s.Value[0]
+		}
+		return res
+	}
+
+	p, err := fetch(false, "start", "200")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"main.old": 10, "main.new": 40}, values(p))
+
+	p, err = fetch(true, "start", "200", "base_start", "100")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"main.old": -20, "main.new": 30}, values(p))
+	for _, s := range p.Sample {
+		if s.Value[0] < 0 {
+			require.True(t, s.DiffBaseSample())
+		}
+	}
+
+	// The selected profile is scaled from its total of 40 to the total of the
+	// base of 50, before the base is subtracted.
+	p, err = fetch(true, "start", "100", "base_start", "200", "normalize", "true")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"main.old": 28, "main.new": -27}, values(p))
+
+	_, err = fetch(true, "start", "200")
+	require.True(t, errors.Is(err, ErrNoBase))
+
+	_, err = fetch(false, "start", "200", "base_start", "300")
+	require.True(t, errors.Is(err, agent.ErrNoMatchingProfiles))
+
+	_, err = fetch(false, "start", "200", "base_query", "{")
+	require.Error(t, err)
+	w := httptest.NewRecorder()
+	WriteError(w, err)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	WriteError(w, fmt.Errorf("%w: heap, parca_agent_cpu", agent.ErrMixedSampleTypes))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestReportHandlerDiff(t *testing.T) {
+	q := windowQuerier{
+		100: {30, 10},
+		200: {10, 40},
+	}
+	h := NewReportHandler(log.NewNopLogger(), q)
+
+	v := url.Values{
+		"query":      {`{pod="a"}`},
+		"start":      {"200"},
+		"base_start": {"100"},
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/top?"+v.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	// Percentages are relative to the total of the base.
+	require.Contains(t, w.Body.String(), "of 40ns total")
+	require.Contains(t, w.Body.String(), "75.00%")
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pprofui serves the pprof web interface for the profiles recently
+// collected by the agent.
+package pprofui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/parca-dev/parca-agent/internal/pprof/binutils"
+	"github.com/parca-dev/parca-agent/internal/pprof/driver"
+	"github.com/parca-dev/parca-agent/internal/pprof/plugin"
+)
+
+// Querier returns the merged profile of the series matching a selector in a
+// time range.
+type Querier interface {
+	Query(matchers []*labels.Matcher, start, end time.Time) (*profile.Profile, error)
+}
+
+// Handler serves the pprof web interface for the profiles selected by the
+// query, start and end URL parameters. It is meant to be mounted with its
+// prefix stripped, for example:
+//
+//	mux.Handle("/pprof/", http.StripPrefix("/pprof", handler))
+type Handler struct {
+	logger  log.Logger
+	querier Querier
+	options *plugin.Options
+}
+
+func NewHandler(logger log.Logger, querier Querier) *Handler {
+	return &Handler{
+		logger:  logger,
+		querier: querier,
+		options: &plugin.Options{
+			UI:  &logUI{logger: logger},
+			Obj: &binutils.Binutils{},
+		},
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// The agent does not persist any state, so the pprof settings cannot
+	// be saved.
+	if path == "/saveconfig" || path == "/deleteconfig" {
+		http.Error(w, "saving settings is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("end") == "" {
+		// Pin the time range, so that switching between views keeps
+		// showing the same profile while new ones are being collected.
+		q.Set("end", strconv.FormatInt(time.Now().Unix(), 10))
+		// The location is relative to the unstripped request path, which
+		// http.Redirect does not know about.
+		w.Header().Set("Location", "./"+strings.TrimPrefix(path, "/")+"?"+q.Encode())
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	p, err := FetchProfile(h.querier, r, false)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	handler, ok := driver.WebHandlers(p, h.options)[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// ParseQuery parses the series selector and the optional time range of a
+// profile query from the query, start and end URL parameters of r.
+func ParseQuery(r *http.Request) ([]*labels.Matcher, time.Time, time.Time, error) {
+	q := r.URL.Query()
+
+	matchers, err := parser.ParseMetricSelector(q.Get("query"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, errors.New(`query incorrectly formatted, expecting selector in form of: {name1="value1",name2="value2"}`)
+	}
+	start, err := parseTime(q.Get("start"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := parseTime(q.Get("end"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("invalid end: %w", err)
+	}
+	return matchers, start, end, nil
+}
+
+// parseTime parses a Unix timestamp in seconds or an RFC 3339 time. An empty
+// string yields the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+	}
+	return t, nil
+}
+
+// logUI is a non-interactive plugin.UI that logs the messages of pprof.
+type logUI struct {
+	logger log.Logger
+}
+
+func (u *logUI) ReadLine(string) (string, error) {
+	return "", io.EOF
+}
+
+func (u *logUI) Print(args ...interface{}) {
+	level.Debug(u.logger).Log("msg", strings.TrimSpace(fmt.Sprint(args...)))
+}
+
+func (u *logUI) PrintErr(args ...interface{}) {
+	level.Warn(u.logger).Log("msg", strings.TrimSpace(fmt.Sprint(args...)))
+}
+
+func (u *logUI) IsTerminal() bool {
+	return false
+}
+
+func (u *logUI) WantBrowser() bool {
+	return false
+}
+
+func (u *logUI) SetAutoComplete(func(string) string) {}
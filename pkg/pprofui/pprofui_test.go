@@ -0,0 +1,99 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprofui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+)
+
+type fakeQuerier struct {
+	matchers   []*labels.Matcher
+	start, end time.Time
+}
+
+func (q *fakeQuerier) Query(matchers []*labels.Matcher, start, end time.Time) (*profile.Profile, error) {
+	q.matchers, q.start, q.end = matchers, start, end
+	if len(matchers) == 1 && matchers[0].Value == "missing" {
+		return nil, agent.ErrNoMatchingProfiles
+	}
+
+	fn := &profile.Function{ID: 1, Name: "main.busyLoop"}
+	loc := &profile.Location{ID: 1, Address: 0x1000, Line: []profile.Line{{Function: fn}}}
+	return &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		Sample:     []*profile.Sample{{Value: []int64{5000000}, Location: []*profile.Location{loc}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fn},
+	}, nil
+}
+
+func TestHandler(t *testing.T) {
+	q := &fakeQuerier{}
+	mux := http.NewServeMux()
+	mux.Handle("/pprof/", http.StripPrefix("/pprof", NewHandler(log.NewNopLogger(), q)))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	w := get(`/pprof/top?query={pod="a"}`)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Regexp(t, `^\./top\?end=\d+&query=`, w.Header().Get("Location"))
+
+	w = get(`/pprof/top?query={pod="a"}&start=1000&end=2000`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "main.busyLoop")
+	require.Equal(t, "a", q.matchers[0].Value)
+	require.Equal(t, time.Unix(1000, 0), q.start)
+	require.Equal(t, time.Unix(2000, 0), q.end)
+
+	w = get(`/pprof/flamegraph?query={pod="a"}&end=2000`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "main.busyLoop")
+
+	w = get(`/pprof/top?query={pod="missing"}&end=2000`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get(`/pprof/top?query={pod=&end=2000`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get(`/pprof/saveconfig?query={pod="a"}&end=2000`)
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestHandlerWithoutConfigDir(t *testing.T) {
+	// The settings are not read from the user's config directory, so the
+	// interface is served even if there is none.
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "")
+
+	w := httptest.NewRecorder()
+	NewHandler(log.NewNopLogger(), &fakeQuerier{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/top?query={pod="a"}&end=2000`, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "main.busyLoop")
+}
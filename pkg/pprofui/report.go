@@ -0,0 +1,167 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprofui
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+
+	"github.com/parca-dev/parca-agent/internal/pprof/measurement"
+	"github.com/parca-dev/parca-agent/internal/pprof/report"
+)
+
+// ReportFormats maps the names of the supported text reports to their
+// report output format.
+var ReportFormats = map[string]int{
+	"top":    report.Text,
+	"tree":   report.Tree,
+	"traces": report.Traces,
+}
+
+// ReportHandler serves plain-text reports of the profiles selected by the
+// query, start and end URL parameters, for example /top?query={pod="a"}. It
+// is meant to be mounted with its prefix stripped, like Handler.
+//
+// The reports can be refined with the following URL parameters:
+//
+//	nodecount     Maximum number of nodes to show.
+//	focus         Only show samples with a frame matching this regex.
+//	ignore        Drop samples with a frame matching this regex.
+//	hide          Drop frames matching this regex.
+//	show          Only show frames matching this regex.
+//	sample_index  Sample type to report, by name or index.
+//	unit          Unit to show values in, for example ms or MB.
+type ReportHandler struct {
+	logger  log.Logger
+	querier Querier
+}
+
+func NewReportHandler(logger log.Logger, querier Querier) *ReportHandler {
+	return &ReportHandler{
+		logger:  logger,
+		querier: querier,
+	}
+}
+
+func (h *ReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format, ok := ReportFormats[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := FetchProfile(h.querier, r, false)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	rpt, err := newReport(p, format, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := report.Generate(w, rpt, nil); err != nil {
+		http.Error(w, "Unexpected error occurred: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// newReport filters p and sets up a report of it in the given format, as
+// configured by the URL parameters in q.
+func newReport(p *profile.Profile, format int, q url.Values) (*report.Report, error) {
+	if len(p.SampleType) == 0 {
+		return nil, errors.New("profile has no sample types to report")
+	}
+
+	o := &report.Options{
+		OutputFormat: format,
+		NodeFraction: 0.005,
+		EdgeFraction: 0.001,
+		OutputUnit:   "minimum",
+		Title:        q.Get("query"),
+	}
+
+	if v := q.Get("nodecount"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid nodecount %q", v)
+		}
+		o.NodeCount = n
+	}
+	var filters []*regexp.Regexp
+	for _, name := range []string{"focus", "ignore", "hide", "show"} {
+		v := q.Get(name)
+		if v == "" {
+			filters = append(filters, nil)
+			continue
+		}
+		rx, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		filters = append(filters, rx)
+		o.ActiveFilters = append(o.ActiveFilters, name+"="+v)
+	}
+	p.FilterSamplesByName(filters[0], filters[1], filters[2], filters[3])
+
+	index := len(p.SampleType) - 1
+	if v := q.Get("sample_index"); v != "" {
+		i, err := p.SampleIndexByName(v)
+		if err != nil {
+			return nil, err
+		}
+		index = i
+	}
+	o.SampleType = p.SampleType[index].Type
+	o.SampleUnit = strings.ToLower(p.SampleType[index].Unit)
+	if v := q.Get("unit"); v != "" {
+		if !convertibleUnit(o.SampleUnit, v) {
+			return nil, fmt.Errorf("invalid unit %q for values in %q", v, o.SampleUnit)
+		}
+		o.OutputUnit = v
+	}
+	o.SampleValue = func(v []int64) int64 {
+		return v[index]
+	}
+
+	return report.New(p, o), nil
+}
+
+// convertibleUnit reports whether values in sampleUnit can be shown in unit,
+// which is the case for the units of the same measurement, such as ms for
+// nanoseconds, and the automatically chosen ones.
+func convertibleUnit(sampleUnit, unit string) bool {
+	if unit == "minimum" || unit == "auto" {
+		return true
+	}
+	// Units are only known to the measurement package if values in them are
+	// scaled to a unit of their own.
+	_, canonical := measurement.Scale(1, unit, "minimum")
+	if _, u := measurement.Scale(1, sampleUnit, "minimum"); canonical == "" || u == "" {
+		return false
+	}
+	_, u := measurement.Scale(1, sampleUnit, unit)
+	return u == canonical
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprofui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/report/", http.StripPrefix("/report", NewReportHandler(log.NewNopLogger(), &fakeQuerier{})))
+
+	get := func(report string, params ...string) *httptest.ResponseRecorder {
+		q := url.Values{"query": {`{pod="a"}`}}
+		for i := 0; i < len(params); i += 2 {
+			q.Set(params[i], params[i+1])
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/report/"+report+"?"+q.Encode(), nil))
+		return w
+	}
+
+	for report := range ReportFormats {
+		t.Run(report, func(t *testing.T) {
+			w := get(report)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Contains(t, w.Body.String(), "main.busyLoop")
+		})
+	}
+
+	w := get("top")
+	require.Contains(t, w.Body.String(), "Showing nodes accounting for 5ms, 100% of 5ms total")
+	w = get("top", "unit", "us")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "Showing nodes accounting for 5000us, 100% of 5000us total")
+
+	// Units that values in the sample unit cannot be shown in are rejected.
+	w = get("top", "unit", "foo")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = get("top", "unit", "MB")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get("top", "ignore", "busyLoop")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "main.busyLoop")
+	require.Contains(t, w.Body.String(), "Active filters:")
+
+	w = get("top", "focus", "(")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get("top", "sample_index", "alloc_space")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get("top", "query", `{pod="missing"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get("dot")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestNewReportWithoutSampleTypes(t *testing.T) {
+	_, err := newReport(&profile.Profile{}, ReportFormats["top"], url.Values{})
+	require.Error(t, err)
+}
+
+func TestConvertibleUnit(t *testing.T) {
+	require.True(t, convertibleUnit("nanoseconds", "ms"))
+	require.True(t, convertibleUnit("nanoseconds", "hour"))
+	require.True(t, convertibleUnit("bytes", "megabyte"))
+	require.True(t, convertibleUnit("count", "minimum"))
+	require.False(t, convertibleUnit("nanoseconds", "foo"))
+	require.False(t, convertibleUnit("nanoseconds", "MB"))
+	require.False(t, convertibleUnit("count", "ms"))
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+// Phases of a profile loop, as reported by the phase duration metric.
+const (
+	phaseMapRead           = "map_read"
+	phaseMappingResolution = "mapping_resolution"
+	phaseKsym              = "ksym"
+	phaseEncode            = "encode"
+	phaseSend              = "send"
+)
+
+var (
+	phases     = []string{phaseMapRead, phaseMappingResolution, phaseKsym, phaseEncode, phaseSend}
+	stackTypes = []string{"user", "kernel"}
+)
+
+// Metrics are the metrics of the profilers of a registry, with a series per
+// profiler labeled with the labels of its target. The series of a profiler
+// are deleted when it is stopped, so the number of series is bounded by the
+// number of active targets.
+type Metrics struct {
+	missingStacks       *prometheus.CounterVec
+	lastProfileSamples  *prometheus.GaugeVec
+	lastProfileStacks   *prometheus.GaugeVec
+	lastProfileSize     *prometheus.GaugeVec
+	phaseDuration       *prometheus.HistogramVec
+	consecutiveFailures *prometheus.GaugeVec
+
+	mtx sync.Mutex
+	// profilers counts the running profilers of each target, as the
+	// profilers of targets with the same labels share their series.
+	profilers map[string]int
+}
+
+// NewMetrics registers the metrics of profilers with the registry.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		missingStacks: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_agent_profiler_missing_stacks_total",
+				Help: "Number of missing profile stacks",
+			},
+			[]string{"target", "type"}),
+		lastProfileSamples: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_last_profile_samples",
+			Help: "Number of samples collected in the last profiling interval.",
+		}, []string{"target"}),
+		lastProfileStacks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_last_profile_stacks",
+			Help: "Number of distinct stacks in the last profile.",
+		}, []string{"target"}),
+		lastProfileSize: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_last_profile_size_bytes",
+			Help: "Size of the last encoded profile in bytes.",
+		}, []string{"target"}),
+		phaseDuration: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "parca_agent_profiler_phase_duration_seconds",
+				Help:    "Time spent in each phase of building and sending a profile.",
+				Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 5},
+			},
+			[]string{"target", "phase"}),
+		consecutiveFailures: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_profiler_consecutive_failures",
+			Help: "Number of profiling intervals that failed in a row.",
+		}, []string{"target"}),
+		profilers: map[string]int{},
+	}
+}
+
+// metrics are the metrics of the profiler of a single target.
+type metrics struct {
+	all    *Metrics
+	target string
+
+	missingStacks       *prometheus.CounterVec
+	lastProfileSamples  prometheus.Gauge
+	lastProfileStacks   prometheus.Gauge
+	lastProfileSize     prometheus.Gauge
+	phaseDuration       prometheus.ObserverVec
+	consecutiveFailures prometheus.Gauge
+}
+
+func newMetrics(all *Metrics, target model.LabelSet) *metrics {
+	all.mtx.Lock()
+	defer all.mtx.Unlock()
+
+	t := target.String()
+	all.profilers[t]++
+
+	labels := prometheus.Labels{"target": t}
+	return &metrics{
+		all:                 all,
+		target:              t,
+		missingStacks:       all.missingStacks.MustCurryWith(labels),
+		lastProfileSamples:  all.lastProfileSamples.With(labels),
+		lastProfileStacks:   all.lastProfileStacks.With(labels),
+		lastProfileSize:     all.lastProfileSize.With(labels),
+		phaseDuration:       all.phaseDuration.MustCurryWith(labels),
+		consecutiveFailures: all.consecutiveFailures.With(labels),
+	}
+}
+
+// unregister deletes the series of the target, unless another profiler of a
+// target with the same labels is running, and reports whether the metrics
+// were still registered.
+func (m *metrics) unregister() bool {
+	m.all.mtx.Lock()
+	defer m.all.mtx.Unlock()
+
+	n, ok := m.all.profilers[m.target]
+	if !ok {
+		return false
+	}
+	if n > 1 {
+		m.all.profilers[m.target] = n - 1
+		return true
+	}
+	delete(m.all.profilers, m.target)
+
+	for _, v := range []*prometheus.GaugeVec{m.all.lastProfileSamples, m.all.lastProfileStacks, m.all.lastProfileSize, m.all.consecutiveFailures} {
+		v.DeleteLabelValues(m.target)
+	}
+	for _, typ := range stackTypes {
+		m.all.missingStacks.DeleteLabelValues(m.target, typ)
+	}
+	for _, phase := range phases {
+		m.all.phaseDuration.DeleteLabelValues(m.target, phase)
+	}
+	return true
+}
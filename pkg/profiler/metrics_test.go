@@ -0,0 +1,65 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsUnregister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	all := NewMetrics(reg)
+
+	// Every profiler has its own series, even those of one workload.
+	web1 := newMetrics(all, model.LabelSet{"namespace": "shop", "workload_name": "web", "pod": "web-1"})
+	web2 := newMetrics(all, model.LabelSet{"namespace": "shop", "workload_name": "web", "pod": "web-2"})
+	for _, m := range []*metrics{web1, web2} {
+		m.missingStacks.WithLabelValues("user").Inc()
+		m.phaseDuration.WithLabelValues(phaseSend).Observe(0.1)
+	}
+	web1.consecutiveFailures.Set(3)
+	web2.consecutiveFailures.Set(0)
+
+	series := func() map[string]int {
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		res := map[string]int{}
+		for _, mf := range mfs {
+			res[mf.GetName()] = len(mf.Metric)
+		}
+		return res
+	}
+	require.Equal(t, map[string]int{
+		"parca_agent_profiler_missing_stacks_total":    2,
+		"parca_agent_profiler_last_profile_samples":    2,
+		"parca_agent_profiler_last_profile_stacks":     2,
+		"parca_agent_profiler_last_profile_size_bytes": 2,
+		"parca_agent_profiler_phase_duration_seconds":  2,
+		"parca_agent_profiler_consecutive_failures":    2,
+	}, series())
+	require.Equal(t, 3.0, testutil.ToFloat64(all.consecutiveFailures.WithLabelValues(`{namespace="shop", pod="web-1", workload_name="web"}`)))
+
+	// The series of a profiler are deleted when it is stopped.
+	require.True(t, web1.unregister())
+	require.Equal(t, 1, series()["parca_agent_profiler_consecutive_failures"])
+	require.False(t, web1.unregister())
+
+	require.True(t, web2.unregister())
+	require.Empty(t, series())
+}
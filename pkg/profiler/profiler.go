@@ -18,10 +18,12 @@ import (
 	"context"
 	_ "embed"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,8 +37,6 @@ import (
 	"github.com/google/pprof/profile"
 
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"golang.org/x/sys/unix"
 
@@ -57,6 +57,12 @@ const (
 	doubleStackDepth = 254
 )
 
+// sampleKey identifies the samples of a stack of a process.
+type sampleKey struct {
+	pid   uint32
+	stack [doubleStackDepth]uint64
+}
+
 type bpfMaps struct {
 	counts      *bpf.BPFMap
 	stackTraces *bpf.BPFMap
@@ -114,10 +120,11 @@ func (m bpfMaps) clean() error {
 
 type CgroupProfiler struct {
 	logger log.Logger
-	reg    prometheus.Registerer
 
 	mtx    *sync.RWMutex
 	cancel func()
+	// stopped is set once the profiler is stopped, possibly before it runs.
+	stopped bool
 
 	pidMappingFileCache *maps.PIDMappingFileCache
 	perfCache           *perf.Cache
@@ -126,20 +133,29 @@ type CgroupProfiler struct {
 
 	bpfMaps *bpfMaps
 
-	missingStacks      *prometheus.CounterVec
+	metrics            *metrics
 	lastError          error
 	lastProfileTakenAt time.Time
+	lastProfileSamples int64
+	lastProfileBytes   int
 
 	writeClient profilestorepb.ProfileStoreServiceClient
 	debugInfo   *debuginfo.DebugInfo
 
 	target            model.LabelSet
 	profilingDuration time.Duration
+
+	// resolver is set for host profilers, which sample all processes and
+	// attribute the samples to the targets the processes belong to, and
+	// labels returns their labels, which change when the configuration is
+	// reloaded.
+	resolver agent.TargetResolver
+	labels   func() model.LabelSet
 }
 
 func NewCgroupProfiler(
 	logger log.Logger,
-	reg prometheus.Registerer,
+	metrics *Metrics,
 	ksymCache *ksym.Cache,
 	objCache objectfile.Cache,
 	writeClient profilestorepb.ProfileStoreServiceClient,
@@ -150,7 +166,6 @@ func NewCgroupProfiler(
 ) *CgroupProfiler {
 	return &CgroupProfiler{
 		logger:              log.With(logger, "labels", target.String()),
-		reg:                 reg,
 		mtx:                 &sync.RWMutex{},
 		target:              target,
 		profilingDuration:   profilingDuration,
@@ -164,16 +179,32 @@ func NewCgroupProfiler(
 			debugInfoClient,
 			tmp,
 		),
-		missingStacks: promauto.With(reg).NewCounterVec(
-			prometheus.CounterOpts{
-				Name:        "parca_agent_profiler_missing_stacks_total",
-				Help:        "Number of missing profile stacks",
-				ConstLabels: map[string]string{"target": target.String()},
-			},
-			[]string{"type"}),
+		metrics: newMetrics(metrics, target),
 	}
 }
 
+// NewHostProfiler returns a profiler that samples all processes of the host,
+// including kernel threads. The samples of each process are sent with the
+// labels of the target the resolver finds for it, or with the labels returned
+// by labels and the command of the process if it belongs to no target.
+func NewHostProfiler(
+	logger log.Logger,
+	metrics *Metrics,
+	ksymCache *ksym.Cache,
+	objCache objectfile.Cache,
+	writeClient profilestorepb.ProfileStoreServiceClient,
+	debugInfoClient debuginfo.Client,
+	labels func() model.LabelSet,
+	resolver agent.TargetResolver,
+	profilingDuration time.Duration,
+	tmp string,
+) *CgroupProfiler {
+	p := NewCgroupProfiler(logger, metrics, ksymCache, objCache, writeClient, debugInfoClient, labels(), profilingDuration, tmp)
+	p.resolver = resolver
+	p.labels = labels
+	return p
+}
+
 func (p *CgroupProfiler) loopReport(lastProfileTakenAt time.Time, lastError error) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
@@ -188,6 +219,14 @@ func (p *CgroupProfiler) LastProfileTakenAt() time.Time {
 	return p.lastProfileTakenAt
 }
 
+// LastProfileSize returns the number of samples and the encoded size in bytes
+// of the last profile sent.
+func (p *CgroupProfiler) LastProfileSize() (samples int64, size int) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.lastProfileSamples, p.lastProfileBytes
+}
+
 func (p *CgroupProfiler) LastError() error {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
@@ -197,9 +236,13 @@ func (p *CgroupProfiler) LastError() error {
 func (p *CgroupProfiler) Stop() {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
 	level.Debug(p.logger).Log("msg", "stopping cgroup profiler")
-	if !p.reg.Unregister(p.missingStacks) {
-		level.Debug(p.logger).Log("msg", "cannot unregister metric")
+	if !p.metrics.unregister() {
+		level.Debug(p.logger).Log("msg", "cannot unregister metrics")
 	}
 	if p.cancel != nil {
 		p.cancel()
@@ -211,7 +254,11 @@ func (p *CgroupProfiler) Labels() model.LabelSet {
 		"__name__": "parca_agent_cpu",
 	}
 
-	for labelname, labelvalue := range p.target {
+	target := p.target
+	if p.labels != nil {
+		target = p.labels()
+	}
+	for labelname, labelvalue := range target {
 		if !strings.HasPrefix(string(labelname), "__") {
 			labels[labelname] = labelvalue
 		}
@@ -224,6 +271,12 @@ func (p *CgroupProfiler) Run(ctx context.Context) error {
 	level.Debug(p.logger).Log("msg", "starting cgroup profiler")
 
 	p.mtx.Lock()
+	if p.stopped {
+		// The profiler was stopped before it ran, and its metrics are
+		// already unregistered.
+		p.mtx.Unlock()
+		return nil
+	}
 	ctx, p.cancel = context.WithCancel(ctx)
 	p.mtx.Unlock()
 
@@ -240,31 +293,17 @@ func (p *CgroupProfiler) Run(ctx context.Context) error {
 		return fmt.Errorf("load bpf object: %w", err)
 	}
 
-	cgroup, err := os.Open(string(p.target[agent.CgroupPathLabelName]))
+	fds, err := p.openPerfEvents()
 	if err != nil {
-		return fmt.Errorf("open cgroup: %w", err)
+		return err
 	}
-	defer cgroup.Close()
-
-	cpus := runtime.NumCPU()
-	for i := 0; i < cpus; i++ {
-		// TODO(branz): Close the returned fd
-		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: 100,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-		}, int(cgroup.Fd()), i, -1, unix.PERF_FLAG_PID_CGROUP)
-		if err != nil {
-			return fmt.Errorf("open perf event: %w", err)
-		}
 
-		prog, err := m.GetProgram("do_sample")
-		if err != nil {
-			return fmt.Errorf("get bpf program: %w", err)
-		}
+	prog, err := m.GetProgram("do_sample")
+	if err != nil {
+		return fmt.Errorf("get bpf program: %w", err)
+	}
 
+	for _, fd := range fds {
 		// Because this is fd based, even if our program crashes or is ended
 		// without proper shutdown, things get cleaned up appropriately.
 		// TODO(brancz): destroy the returned link via bpf_link__destroy
@@ -288,6 +327,7 @@ func (p *CgroupProfiler) Run(ctx context.Context) error {
 	defer ticker.Stop()
 
 	level.Debug(p.logger).Log("msg", "start profiling loop")
+	failures := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -299,12 +339,134 @@ func (p *CgroupProfiler) Run(ctx context.Context) error {
 		err := p.profileLoop(ctx, captureTime)
 		if err != nil {
 			level.Debug(p.logger).Log("msg", "profile loop error", "err", err)
+			failures++
+		} else {
+			failures = 0
 		}
+		p.metrics.consecutiveFailures.Set(float64(failures))
 
 		p.loopReport(captureTime, err)
 	}
 }
 
+// openPerfEvents opens the perf events to sample the target with. Host
+// profilers open an event on each CPU for all processes. If the target has a
+// PID label, an event is opened for each thread of the process and of its
+// children, which is inherited by the threads and processes they create.
+// Otherwise an event is opened on each CPU for the target cgroup.
+func (p *CgroupProfiler) openPerfEvents() ([]int, error) {
+	attr := &unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Sample: 100,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	}
+
+	// TODO(branz): Close the returned fds
+	var fds []int
+	if p.resolver != nil {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			fd, err := unix.PerfEventOpen(attr, -1, i, -1, 0)
+			if err != nil {
+				return nil, fmt.Errorf("open perf event: %w", err)
+			}
+			fds = append(fds, fd)
+		}
+		return fds, nil
+	}
+
+	if pidLabel, ok := p.target[agent.PIDLabelName]; ok {
+		pid, err := strconv.Atoi(string(pidLabel))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q: %w", pidLabel, err)
+		}
+		tids, err := threadIDs(pid)
+		if err != nil {
+			return nil, fmt.Errorf("list threads: %w", err)
+		}
+
+		attr.Bits |= unix.PerfBitInherit
+		for _, tid := range tids {
+			fd, err := unix.PerfEventOpen(attr, tid, -1, -1, 0)
+			if errors.Is(err, unix.ESRCH) {
+				// The thread exited since it was listed.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("open perf event: %w", err)
+			}
+			fds = append(fds, fd)
+		}
+		if len(fds) == 0 {
+			return nil, fmt.Errorf("process %d exited", pid)
+		}
+		return fds, nil
+	}
+
+	cgroup, err := os.Open(string(p.target[agent.CgroupPathLabelName]))
+	if err != nil {
+		return nil, fmt.Errorf("open cgroup: %w", err)
+	}
+	defer cgroup.Close()
+
+	cpus := runtime.NumCPU()
+	for i := 0; i < cpus; i++ {
+		fd, err := unix.PerfEventOpen(attr, int(cgroup.Fd()), i, -1, unix.PERF_FLAG_PID_CGROUP)
+		if err != nil {
+			return nil, fmt.Errorf("open perf event: %w", err)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// threadIDs returns the IDs of the threads of a process and of the processes
+// it created, recursively.
+func threadIDs(pid int) ([]int, error) {
+	var tids []int
+	pids := []int{pid}
+	seen := map[int]struct{}{}
+	for len(pids) > 0 {
+		cur := pids[0]
+		pids = pids[1:]
+		if _, ok := seen[cur]; ok {
+			continue
+		}
+		seen[cur] = struct{}{}
+
+		entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", cur))
+		if err != nil {
+			if cur == pid {
+				return nil, err
+			}
+			// The child exited since it was listed.
+			continue
+		}
+
+		for _, e := range entries {
+			tid, err := strconv.Atoi(e.Name())
+			if err != nil {
+				continue
+			}
+			tids = append(tids, tid)
+
+			// The children file is not available on all kernels, in which
+			// case only the threads created from now on are followed.
+			children, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/children", cur, tid))
+			if err != nil {
+				continue
+			}
+			for _, f := range strings.Fields(string(children)) {
+				if child, err := strconv.Atoi(f); err == nil {
+					pids = append(pids, child)
+				}
+			}
+		}
+	}
+	return tids, nil
+}
+
 func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time) error {
 	prof := &profile.Profile{
 		SampleType: []*profile.ValueType{{
@@ -335,7 +497,12 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 	kernelLocations := []*profile.Location{}
 	kernelAddresses := map[uint64]struct{}{}
 	locationIndices := map[[2]uint64]int{}
-	samples := map[[doubleStackDepth]uint64]*profile.Sample{}
+	samples := map[sampleKey]*profile.Sample{}
+
+	// Mapping resolution happens while iterating over the BPF maps, so its
+	// duration is accumulated and subtracted from the map read duration.
+	var mappingDuration time.Duration
+	mapReadStart := time.Now()
 
 	it := p.bpfMaps.counts.Iterator()
 	byteOrder := byteorder.GetHostByteOrder()
@@ -374,7 +541,7 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 
 		stackBytes, err := p.bpfMaps.stackTraces.GetValue(unsafe.Pointer(&userStackID))
 		if err != nil {
-			p.missingStacks.WithLabelValues("user").Inc()
+			p.metrics.missingStacks.WithLabelValues("user").Inc()
 			continue
 		}
 
@@ -388,7 +555,7 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 		if kernelStackID >= 0 {
 			stackBytes, err = p.bpfMaps.stackTraces.GetValue(unsafe.Pointer(&kernelStackID))
 			if err != nil {
-				p.missingStacks.WithLabelValues("kernel").Inc()
+				p.metrics.missingStacks.WithLabelValues("kernel").Inc()
 				continue
 			}
 
@@ -398,7 +565,7 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 			}
 		}
 
-		sample, ok := samples[stack]
+		sample, ok := samples[sampleKey{pid: pid, stack: stack}]
 		if ok {
 			// We already have a sample with this stack trace, so just add
 			// it to the previous one.
@@ -444,6 +611,7 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 				if !ok {
 					locationIndex = len(locations)
 
+					mappingStart := time.Now()
 					m, err := mapping.PIDAddrMapping(pid, addr)
 					if err != nil {
 						level.Debug(p.logger).Log("msg", "failed to get process mapping", "err", err)
@@ -467,6 +635,8 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 							normalizedAddr = nAddr
 						}
 					}
+					mappingDuration += time.Since(mappingStart)
+
 					l := &profile.Location{
 						ID:      uint64(locationIndex + 1),
 						Address: normalizedAddr,
@@ -499,15 +669,19 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 			Value:    []int64{int64(value)},
 			Location: sampleLocations,
 		}
-		samples[stack] = sample
+		samples[sampleKey{pid: pid, stack: stack}] = sample
 	}
 	if it.Err() != nil {
 		return fmt.Errorf("failed iterator: %w", it.Err())
 	}
+	p.metrics.phaseDuration.WithLabelValues(phaseMapRead).Observe((time.Since(mapReadStart) - mappingDuration).Seconds())
+	p.metrics.phaseDuration.WithLabelValues(phaseMappingResolution).Observe(mappingDuration.Seconds())
 
 	// Build Profile from samples, locations and mappings.
-	for _, s := range samples {
+	samplePIDs := make(map[*profile.Sample]uint32, len(samples))
+	for k, s := range samples {
 		prof.Sample = append(prof.Sample, s)
+		samplePIDs[s] = k.pid
 	}
 
 	var mappedFiles []maps.ProcessMapping
@@ -528,10 +702,12 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 	}()
 
 	// Resolve Kernel function names.
+	ksymStart := time.Now()
 	kernelSymbols, err := p.ksymCache.Resolve(kernelAddresses)
 	if err != nil {
 		return fmt.Errorf("resolve kernel symbols: %w", err)
 	}
+	p.metrics.phaseDuration.WithLabelValues(phaseKsym).Observe(time.Since(ksymStart).Seconds())
 	for _, l := range kernelLocations {
 		kernelFunction, ok := kernelFunctions[l.Address]
 		if !ok {
@@ -561,26 +737,148 @@ func (p *CgroupProfiler) profileLoop(ctx context.Context, captureTime time.Time)
 		prof.Function = append(prof.Function, f)
 	}
 
-	if err := p.sendProfile(ctx, prof); err != nil {
-		level.Error(p.logger).Log("msg", "failed to send profile", "err", err)
+	var (
+		size    int
+		sendErr error
+	)
+	if p.resolver == nil {
+		size, sendErr = p.sendProfile(ctx, prof, p.Labels())
+	} else {
+		size, sendErr = p.sendAttributedProfiles(ctx, prof, samplePIDs)
+	}
+	p.reportProfileSize(prof, size)
+	if sendErr != nil {
+		level.Error(p.logger).Log("msg", "failed to send profile", "err", sendErr)
 	}
 
 	if err := p.bpfMaps.clean(); err != nil {
 		level.Warn(p.logger).Log("msg", "failed to clean BPF maps", "err", err)
 	}
 
+	if sendErr != nil {
+		return fmt.Errorf("send profile: %w", sendErr)
+	}
 	return nil
 }
 
-func (p *CgroupProfiler) sendProfile(ctx context.Context, prof *profile.Profile) error {
+// sendAttributedProfiles splits a host-wide profile into a profile per target
+// the sampled processes belong to, and a profile per command of the processes
+// that belong to no target, and sends them. It returns the total size of the
+// encoded profiles.
+func (p *CgroupProfiler) sendAttributedProfiles(ctx context.Context, prof *profile.Profile, samplePIDs map[*profile.Sample]uint32) (int, error) {
+	type series struct {
+		labels  model.LabelSet
+		samples []*profile.Sample
+	}
+
+	pidLabels := map[uint32]model.LabelSet{}
+	seriesByFingerprint := map[model.Fingerprint]*series{}
+	for _, sample := range prof.Sample {
+		pid := samplePIDs[sample]
+		labels, ok := pidLabels[pid]
+		if !ok {
+			labels = p.attribute(int(pid))
+			pidLabels[pid] = labels
+		}
+
+		fp := labels.Fingerprint()
+		sr, ok := seriesByFingerprint[fp]
+		if !ok {
+			sr = &series{labels: labels}
+			seriesByFingerprint[fp] = sr
+		}
+		sr.samples = append(sr.samples, sample)
+	}
+
+	var (
+		size    int
+		lastErr error
+	)
+	for _, sr := range seriesByFingerprint {
+		attributed := &profile.Profile{
+			SampleType:    prof.SampleType,
+			Sample:        sr.samples,
+			Mapping:       prof.Mapping,
+			Location:      prof.Location,
+			Function:      prof.Function,
+			TimeNanos:     prof.TimeNanos,
+			DurationNanos: prof.DurationNanos,
+			PeriodType:    prof.PeriodType,
+			Period:        prof.Period,
+		}
+		// Compacting drops the locations, mappings and functions of the
+		// samples of other series.
+		n, err := p.sendProfile(ctx, attributed.Compact(), sr.labels)
+		size += n
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return size, lastErr
+}
+
+// attribute returns the labels of the series the samples of a process are
+// sent in. These are the labels of the target the process belongs to, or the
+// labels of the profiler and the command of the process if it belongs to no
+// target.
+func (p *CgroupProfiler) attribute(pid int) model.LabelSet {
+	labels := model.LabelSet{
+		"__name__": "parca_agent_cpu",
+	}
+
+	if target, ok := p.resolver.TargetForPID(pid); ok {
+		for labelname, labelvalue := range target {
+			if !strings.HasPrefix(string(labelname), "__") {
+				labels[labelname] = labelvalue
+			}
+		}
+		return labels
+	}
+
+	for labelname, labelvalue := range p.Labels() {
+		labels[labelname] = labelvalue
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		// The process exited since it was sampled.
+		comm = []byte("unknown")
+	}
+	labels["unattributed"] = "true"
+	labels["comm"] = model.LabelValue(strings.TrimSpace(string(comm)))
+	return labels
+}
+
+// reportProfileSize records the number of samples and stacks of a profile,
+// and the size of the profiles it was encoded to.
+func (p *CgroupProfiler) reportProfileSize(prof *profile.Profile, size int) {
+	var samples int64
+	for _, s := range prof.Sample {
+		samples += s.Value[0]
+	}
+
+	p.mtx.Lock()
+	p.lastProfileSamples = samples
+	p.lastProfileBytes = size
+	p.mtx.Unlock()
+
+	p.metrics.lastProfileSamples.Set(float64(samples))
+	p.metrics.lastProfileStacks.Set(float64(len(prof.Sample)))
+	p.metrics.lastProfileSize.Set(float64(size))
+}
+
+// sendProfile encodes a profile and sends it in the series with the given
+// labels. It returns the size of the encoded profile.
+func (p *CgroupProfiler) sendProfile(ctx context.Context, prof *profile.Profile, labels model.LabelSet) (int, error) {
+	encodeStart := time.Now()
 	buf := bytes.NewBuffer(nil)
 	if err := prof.Write(buf); err != nil {
-		return err
+		return 0, err
 	}
+	p.metrics.phaseDuration.WithLabelValues(phaseEncode).Observe(time.Since(encodeStart).Seconds())
 
 	var labeloldformat []*profilestorepb.Label
 
-	for key, value := range p.Labels() {
+	for key, value := range labels {
 		labeloldformat = append(labeloldformat,
 			&profilestorepb.Label{
 				Name:  string(key),
@@ -588,6 +886,7 @@ func (p *CgroupProfiler) sendProfile(ctx context.Context, prof *profile.Profile)
 			})
 	}
 
+	sendStart := time.Now()
 	_, err := p.writeClient.WriteRaw(ctx, &profilestorepb.WriteRawRequest{
 		Series: []*profilestorepb.RawProfileSeries{{
 			Labels: &profilestorepb.LabelSet{Labels: labeloldformat},
@@ -596,6 +895,7 @@ func (p *CgroupProfiler) sendProfile(ctx context.Context, prof *profile.Profile)
 			}},
 		}},
 	})
+	p.metrics.phaseDuration.WithLabelValues(phaseSend).Observe(time.Since(sendStart).Seconds())
 
-	return err
+	return buf.Len(), err
 }
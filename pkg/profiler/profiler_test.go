@@ -0,0 +1,130 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/parca-dev/parca-agent/pkg/debuginfo"
+)
+
+type fakeWriteClient struct {
+	series []*profilestorepb.RawProfileSeries
+}
+
+func (c *fakeWriteClient) WriteRaw(ctx context.Context, in *profilestorepb.WriteRawRequest, opts ...grpc.CallOption) (*profilestorepb.WriteRawResponse, error) {
+	c.series = append(c.series, in.Series...)
+	return &profilestorepb.WriteRawResponse{}, nil
+}
+
+type fakeTargetResolver map[int]model.LabelSet
+
+func (r fakeTargetResolver) TargetForPID(pid int) (model.LabelSet, bool) {
+	ls, ok := r[pid]
+	return ls, ok
+}
+
+func TestSendAttributedProfiles(t *testing.T) {
+	// A PID that is not in use, so that the process has no command.
+	const unattributedPID = 1 << 30
+
+	wc := &fakeWriteClient{}
+	p := NewHostProfiler(
+		log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()),
+		nil, nil,
+		wc, debuginfo.NewNoopClient(),
+		func() model.LabelSet { return model.LabelSet{"node": "a"} },
+		fakeTargetResolver{1: {"node": "a", "pod": "web", "__cgroup_path__": "/sys/fs/cgroup/web"}},
+		10*time.Second,
+		"",
+	)
+
+	fnWeb := &profile.Function{ID: 1, Name: "web"}
+	fnOther := &profile.Function{ID: 2, Name: "other"}
+	locWeb := &profile.Location{ID: 1, Address: 0x1, Line: []profile.Line{{Function: fnWeb}}}
+	locOther := &profile.Location{ID: 2, Address: 0x2, Line: []profile.Line{{Function: fnOther}}}
+	sWeb1 := &profile.Sample{Value: []int64{3}, Location: []*profile.Location{locWeb}}
+	sWeb2 := &profile.Sample{Value: []int64{2}, Location: []*profile.Location{locWeb, locOther}}
+	sOther := &profile.Sample{Value: []int64{1}, Location: []*profile.Location{locOther}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		Sample:     []*profile.Sample{sWeb1, sWeb2, sOther},
+		Location:   []*profile.Location{locWeb, locOther},
+		Function:   []*profile.Function{fnWeb, fnOther},
+	}
+
+	size, err := p.sendAttributedProfiles(context.Background(), prof, map[*profile.Sample]uint32{
+		sWeb1:  1,
+		sWeb2:  1,
+		sOther: unattributedPID,
+	})
+	require.NoError(t, err)
+	require.Greater(t, size, 0)
+	require.Equal(t, 2, len(wc.series))
+
+	got := map[string]*profile.Profile{}
+	for _, s := range wc.series {
+		ls := model.LabelSet{}
+		for _, l := range s.Labels.Labels {
+			ls[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		prof, err := profile.ParseData(s.Samples[0].RawProfile)
+		require.NoError(t, err)
+		got[ls.String()] = prof
+	}
+
+	web := got[`{__name__="parca_agent_cpu", node="a", pod="web"}`]
+	require.NotNil(t, web)
+	require.Equal(t, 2, len(web.Sample))
+	require.Equal(t, 2, len(web.Location))
+
+	other := got[`{__name__="parca_agent_cpu", comm="unknown", node="a", unattributed="true"}`]
+	require.NotNil(t, other)
+	require.Equal(t, 1, len(other.Sample))
+	require.Equal(t, 1, len(other.Location))
+	require.Equal(t, "other", other.Location[0].Line[0].Function.Name)
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p := NewCgroupProfiler(
+		log.NewNopLogger(), NewMetrics(reg),
+		nil, nil,
+		&fakeWriteClient{}, debuginfo.NewNoopClient(),
+		model.LabelSet{"pod": "web", "__cgroup_path__": "/sys/fs/cgroup/web"},
+		10*time.Second,
+		"",
+	)
+	p.Stop()
+	p.Stop()
+
+	// A profiler stopped before it runs does not start profiling.
+	require.NoError(t, p.Run(context.Background()))
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	require.Empty(t, mfs)
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/agent"
+)
+
+// cgroupMountPrefixes are the mount points that target cgroup paths may be
+// prefixed with, most specific first.
+var cgroupMountPrefixes = []string{
+	"/sys/fs/cgroup/perf_event",
+	"/sys/fs/cgroup/unified",
+	"/sys/fs/cgroup/systemd",
+	"/sys/fs/cgroup",
+}
+
+// trimCgroupMount returns the path of a cgroup without the mount point of its
+// hierarchy, which is empty for the root cgroup.
+func trimCgroupMount(cgroupPath string) string {
+	cgroupPath = strings.TrimSuffix(cgroupPath, "/")
+	for _, prefix := range cgroupMountPrefixes {
+		if cgroupPath == prefix {
+			return ""
+		}
+		if strings.HasPrefix(cgroupPath, prefix+"/") {
+			return strings.TrimPrefix(cgroupPath, prefix)
+		}
+	}
+	return cgroupPath
+}
+
+// cgroupPathMatch reports whether a process in the cgroup at processPath, as
+// resolved to the hierarchy perf events are attached to, belongs to the
+// target cgroup at targetPath, which is the case if it is the same cgroup or
+// one of its ancestors. It returns the length of the target path without its
+// mount point, so that the most specific of the matching targets can be
+// chosen. The root cgroup matches no process.
+func cgroupPathMatch(targetPath, processPath string) (int, bool) {
+	target := trimCgroupMount(targetPath)
+	if target == "" {
+		return 0, false
+	}
+	process := trimCgroupMount(processPath)
+	if process != target && !strings.HasPrefix(process, target+"/") {
+		return 0, false
+	}
+	return len(target), true
+}
+
+// TargetForPID returns the labels of the active target that is the process
+// with the given PID, or otherwise of the target with the most specific
+// cgroup that the process belongs to.
+func (m *Manager) TargetForPID(pid int) (model.LabelSet, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, pp := range m.profilerPools {
+		if ls, ok := pp.targetForProcess(pid); ok {
+			return ls, true
+		}
+	}
+
+	processPath, err := m.cgroupPath(pid)
+	if err != nil {
+		return nil, false
+	}
+
+	var (
+		best    model.LabelSet
+		bestLen int
+	)
+	for _, pp := range m.profilerPools {
+		ls, n, ok := pp.targetForCgroup(processPath)
+		if ok && moreSpecific(n, ls, bestLen, best) {
+			best, bestLen = ls, n
+		}
+	}
+	return best, best != nil
+}
+
+func (pp *ProfilerPool) targetForProcess(pid int) (model.LabelSet, bool) {
+	pp.mtx.RLock()
+	defer pp.mtx.RUnlock()
+
+	for _, t := range pp.activeTargets {
+		if t.labelSet[agent.PIDLabelName] == model.LabelValue(strconv.Itoa(pid)) {
+			return t.labelSet.Clone(), true
+		}
+	}
+	return nil, false
+}
+
+// targetForCgroup returns the labels of the target of the pool with the most
+// specific cgroup that a process in the given cgroup belongs to, and the
+// length of the path of that cgroup.
+func (pp *ProfilerPool) targetForCgroup(processPath string) (model.LabelSet, int, bool) {
+	pp.mtx.RLock()
+	defer pp.mtx.RUnlock()
+
+	var (
+		best    model.LabelSet
+		bestLen int
+	)
+	for _, t := range pp.activeTargets {
+		n, ok := cgroupPathMatch(string(t.labelSet[agent.CgroupPathLabelName]), processPath)
+		if ok && moreSpecific(n, t.labelSet, bestLen, best) {
+			best, bestLen = t.labelSet, n
+		}
+	}
+	if best == nil {
+		return nil, 0, false
+	}
+	return best.Clone(), bestLen, true
+}
+
+// moreSpecific reports whether the target with the labels ls, whose cgroup
+// path has length n, is a better match than the best one so far. Targets of
+// the same cgroup are ordered by their labels, so that the choice does not
+// depend on the order they are visited in.
+func moreSpecific(n int, ls model.LabelSet, bestLen int, best model.LabelSet) bool {
+	if best == nil || n != bestLen {
+		return best == nil || n > bestLen
+	}
+	return ls.Before(best)
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+func TestCgroupPathMatch(t *testing.T) {
+	cases := []struct {
+		name        string
+		targetPath  string
+		processPath string
+		expected    bool
+	}{{
+		name:        "kubernetes-perf-event",
+		targetPath:  "/sys/fs/cgroup/perf_event/kubepods/burstable/pod1234/abcd",
+		processPath: "/sys/fs/cgroup/perf_event/kubepods/burstable/pod1234/abcd",
+		expected:    true,
+	}, {
+		name:        "kubernetes-systemd-driver",
+		targetPath:  "/sys/fs/cgroup/perf_event/kubepods.slice/kubepods-pod1234.slice/cri-containerd-abcd.scope",
+		processPath: "/sys/fs/cgroup/perf_event/kubepods.slice/kubepods-pod1234.slice/cri-containerd-abcd.scope",
+		expected:    true,
+	}, {
+		name:        "systemd-unified",
+		targetPath:  "/sys/fs/cgroup/system.slice/docker.service/",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service",
+		expected:    true,
+	}, {
+		name:        "other-mount",
+		targetPath:  "/sys/fs/cgroup/unified/system.slice/docker.service",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service",
+		expected:    true,
+	}, {
+		name:        "child-cgroup",
+		targetPath:  "/sys/fs/cgroup/system.slice/docker.service/",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service/child",
+		expected:    true,
+	}, {
+		name:        "sibling-with-common-prefix",
+		targetPath:  "/sys/fs/cgroup/system.slice/docker.service/",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service2",
+		expected:    false,
+	}, {
+		name:        "middle-segment",
+		targetPath:  "/sys/fs/cgroup/docker.service",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service",
+		expected:    false,
+	}, {
+		name:        "root",
+		targetPath:  "/sys/fs/cgroup/",
+		processPath: "/sys/fs/cgroup/system.slice/docker.service",
+		expected:    false,
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, ok := cgroupPathMatch(c.targetPath, c.processPath)
+			require.Equal(t, c.expected, ok)
+		})
+	}
+}
+
+func TestManagerTargetForPID(t *testing.T) {
+	m := NewManager(
+		log.NewNopLogger(), profiler.NewMetrics(prometheus.NewRegistry()),
+		nil, nil,
+		10*time.Second,
+		nil,
+		"", true,
+		nil, nil,
+	)
+	m.cgroupPath = func(pid int) (string, error) {
+		switch pid {
+		case 1:
+			return "/sys/fs/cgroup/perf_event/kubepods.slice/pod1234.slice/abcd.scope", nil
+		case 2:
+			return "/sys/fs/cgroup/perf_event/kubepods.slice/pod5678.slice", nil
+		case 3:
+			return "/sys/fs/cgroup/perf_event/system.slice/kubepods.slice", nil
+		}
+		return "", errors.New("no such process")
+	}
+
+	require.NoError(t, m.reconcileTargets(context.Background(), map[string][]*Group{
+		"pods": {{
+			Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/perf_event/kubepods.slice/pod1234.slice/abcd.scope", "container": "web"}},
+			Source:  "pod/default/web",
+		}},
+		"services": {{
+			Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/kubepods.slice", "unit": "kubepods.slice"}},
+			Source:  "systemd",
+		}},
+	}))
+
+	// The container is more specific than the slice it is in.
+	ls, ok := m.TargetForPID(1)
+	require.True(t, ok)
+	require.Equal(t, model.LabelValue("web"), ls["container"])
+
+	ls, ok = m.TargetForPID(2)
+	require.True(t, ok)
+	require.Equal(t, model.LabelValue("kubepods.slice"), ls["unit"])
+
+	// Cgroups only match from the root of the hierarchy.
+	_, ok = m.TargetForPID(3)
+	require.False(t, ok)
+
+	_, ok = m.TargetForPID(4)
+	require.False(t, ok)
+}
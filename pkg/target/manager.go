@@ -21,47 +21,70 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
 
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
 	"github.com/parca-dev/parca-agent/pkg/ksym"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/profiler"
 )
 
 type Manager struct {
 	mtx               *sync.RWMutex
 	profilerPools     map[string]*ProfilerPool
 	logger            log.Logger
-	reg               prometheus.Registerer
+	metrics           *profiler.Metrics
 	externalLabels    model.LabelSet
 	ksymCache         *ksym.Cache
 	writeClient       profilestorepb.ProfileStoreServiceClient
 	debugInfoClient   debuginfo.Client
 	profilingDuration time.Duration
 	tmp               string
+
+	// trackOnly is set when the host is profiled as a whole, in which case
+	// the targets are only tracked to attribute samples to them.
+	trackOnly bool
+	// cgroupPath returns the cgroup of a process that perf events are
+	// attached to, which samples are attributed to targets by.
+	cgroupPath func(pid int) (string, error)
+
+	// relabelConfigs are the relabel configurations of the targets, by the
+	// name of the discovery configuration they apply to.
+	relabelConfigs map[string][]*relabel.Config
+	// samplingConfigs select the targets to profile, by the name of the
+	// discovery configuration they apply to.
+	samplingConfigs map[string]*SamplingConfig
 }
 
 func NewManager(
 	logger log.Logger,
-	reg prometheus.Registerer,
+	metrics *profiler.Metrics,
 	writeClient profilestorepb.ProfileStoreServiceClient,
 	debugInfoClient debuginfo.Client,
 	profilingDuration time.Duration,
 	externalLabels model.LabelSet,
 	tmp string,
+	trackOnly bool,
+	relabelConfigs map[string][]*relabel.Config,
+	samplingConfigs map[string]*SamplingConfig,
 ) *Manager {
 	return &Manager{
 		mtx:               &sync.RWMutex{},
 		profilerPools:     map[string]*ProfilerPool{},
 		logger:            logger,
-		reg:               reg,
+		metrics:           metrics,
 		externalLabels:    externalLabels,
 		ksymCache:         ksym.NewKsymCache(logger),
 		writeClient:       writeClient,
 		debugInfoClient:   debugInfoClient,
 		profilingDuration: profilingDuration,
 		tmp:               tmp,
+		trackOnly:         trackOnly,
+		cgroupPath:        cgroup.PerfEventCgroupPath,
+		relabelConfigs:    relabelConfigs,
+		samplingConfigs:   samplingConfigs,
 	}
 }
 
@@ -90,11 +113,13 @@ func (m *Manager) reconcileTargets(ctx context.Context, targetSets map[string][]
 			// An arbitrary coefficient. Number of assumed object files per target.
 			cacheSize := len(targetSet) * 5
 			pp = NewProfilerPool(
-				ctx, m.logger, m.reg,
+				ctx, m.logger, m.metrics,
 				m.ksymCache, objectfile.NewCache(m.logger, cacheSize),
 				m.writeClient, m.debugInfoClient,
 				m.profilingDuration, m.externalLabels,
-				m.tmp,
+				m.tmp, m.trackOnly,
+				m.relabelConfigs[name],
+				m.samplingConfigs[name],
 			)
 			m.profilerPools[name] = pp
 		}
@@ -104,6 +129,47 @@ func (m *Manager) reconcileTargets(ctx context.Context, targetSets map[string][]
 	return nil
 }
 
+// ApplyConfig replaces the configuration of the targets and syncs the
+// discovered targets with it. Profilers of targets whose labels and profiling
+// duration do not change keep running. The targets of discovery
+// configurations that are not in discoveryNames are stopped.
+func (m *Manager) ApplyConfig(
+	discoveryNames []string,
+	profilingDuration time.Duration,
+	externalLabels model.LabelSet,
+	relabelConfigs map[string][]*relabel.Config,
+	samplingConfigs map[string]*SamplingConfig,
+) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.profilingDuration = profilingDuration
+	m.externalLabels = externalLabels
+	m.relabelConfigs = relabelConfigs
+	m.samplingConfigs = samplingConfigs
+
+	names := make(map[string]struct{}, len(discoveryNames))
+	for _, name := range discoveryNames {
+		names[name] = struct{}{}
+	}
+	for name, pp := range m.profilerPools {
+		if _, ok := names[name]; !ok {
+			pp.Stop()
+			delete(m.profilerPools, name)
+			continue
+		}
+		pp.ApplyConfig(profilingDuration, externalLabels, relabelConfigs[name], samplingConfigs[name])
+	}
+}
+
+// ExternalLabels returns the labels attached to all targets, as of the last
+// configuration applied.
+func (m *Manager) ExternalLabels() model.LabelSet {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.externalLabels.Clone()
+}
+
 func (m *Manager) ActiveProfilers() map[string][]Profiler {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -115,3 +181,43 @@ func (m *Manager) ActiveProfilers() map[string][]Profiler {
 
 	return profilerSet
 }
+
+// ActiveTargets returns the targets that are being profiled, by the name of
+// the discovery configuration they were discovered by.
+func (m *Manager) ActiveTargets() map[string][]ActiveTarget {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	targets := map[string][]ActiveTarget{}
+	for name, profilerPool := range m.profilerPools {
+		targets[name] = profilerPool.ActiveTargets()
+	}
+	return targets
+}
+
+// DroppedTargets returns the discovered targets that are not profiled, by the
+// name of the discovery configuration they were discovered by.
+func (m *Manager) DroppedTargets() map[string][]*Target {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	targets := map[string][]*Target{}
+	for name, profilerPool := range m.profilerPools {
+		targets[name] = profilerPool.DroppedTargets()
+	}
+	return targets
+}
+
+// SampledOutTargets returns the discovered targets that are not profiled
+// because they are not part of the sample, by the name of the discovery
+// configuration they were discovered by.
+func (m *Manager) SampledOutTargets() map[string][]*Target {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	targets := map[string][]*Target{}
+	for name, profilerPool := range m.profilerPools {
+		targets[name] = profilerPool.SampledOutTargets()
+	}
+	return targets
+}
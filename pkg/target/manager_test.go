@@ -0,0 +1,74 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+func TestManagerApplyConfig(t *testing.T) {
+	m := NewManager(
+		log.NewNopLogger(), profiler.NewMetrics(prometheus.NewRegistry()),
+		nil, nil,
+		10*time.Second,
+		model.LabelSet{"node": "a"},
+		"", true,
+		nil, nil,
+	)
+
+	require.NoError(t, m.reconcileTargets(context.Background(), map[string][]*Group{
+		"pods": {{
+			Targets: []model.LabelSet{
+				{"__cgroup_path__": "/sys/fs/cgroup/web", "container": "web"},
+				{"__cgroup_path__": "/sys/fs/cgroup/db", "container": "db"},
+			},
+			Source: "pod/default/web",
+		}},
+		"services": {{
+			Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/nginx.service", "unit": "nginx.service"}},
+			Source:  "systemd",
+		}},
+	}))
+	require.Equal(t, 2, len(m.ActiveTargets()))
+
+	// The targets of removed discovery configurations are stopped, and the
+	// others get the new labels.
+	m.ApplyConfig(
+		[]string{"pods"},
+		10*time.Second,
+		model.LabelSet{"node": "a", "region": "eu"},
+		map[string][]*relabel.Config{"pods": {{
+			SourceLabels: model.LabelNames{"container"},
+			Regex:        relabel.MustNewRegexp("web"),
+			Action:       relabel.Keep,
+		}}},
+		nil,
+	)
+	targets := m.ActiveTargets()
+	require.Equal(t, 1, len(targets))
+	require.Equal(t, 1, len(targets["pods"]))
+	require.Equal(t, `{container="web", node="a", region="eu"}`, targets["pods"][0].Labels().String())
+	require.Equal(t, model.LabelSet{"node": "a", "region": "eu"}, m.ExternalLabels())
+	require.Equal(t, 1, len(m.DroppedTargets()["pods"]))
+}
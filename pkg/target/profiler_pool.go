@@ -16,53 +16,115 @@ package target
 import (
 	"context"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	profilestorepb "github.com/parca-dev/parca/gen/proto/go/parca/profilestore/v1alpha1"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 
+	"github.com/parca-dev/parca-agent/pkg/agent"
 	"github.com/parca-dev/parca-agent/pkg/debuginfo"
 	"github.com/parca-dev/parca-agent/pkg/ksym"
 	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
 )
 
+// Target is a cgroup or process to profile, as discovered by a discovery mechanism.
 type Target struct {
-	labelSet model.LabelSet
+	// discoveredLabels are the labels of the target before relabeling,
+	// including the meta labels set by the discovery mechanism.
+	discoveredLabels model.LabelSet
+	labelSet         model.LabelSet
+	source           string
+}
+
+// NewTarget returns a target with the given labels, as discovered in a target
+// group from the given source.
+func NewTarget(labels, discoveredLabels model.LabelSet, source string) *Target {
+	return &Target{
+		discoveredLabels: discoveredLabels,
+		labelSet:         labels,
+		source:           source,
+	}
+}
+
+// DiscoveredLabels returns the labels of the target before relabeling.
+func (t *Target) DiscoveredLabels() model.LabelSet {
+	return t.discoveredLabels
+}
+
+// Labels returns the labels of the target after relabeling, without the
+// labels starting with "__".
+func (t *Target) Labels() model.LabelSet {
+	ls := make(model.LabelSet, len(t.labelSet))
+	for name, value := range t.labelSet {
+		if !strings.HasPrefix(string(name), "__") {
+			ls[name] = value
+		}
+	}
+	return ls
+}
+
+// Error returns why the cgroup or process of the target could not be looked
+// up by the discovery mechanism, if it could not.
+func (t *Target) Error() string {
+	return string(t.discoveredLabels[agent.ErrorLabelName])
+}
+
+// Source returns the source of the target group the target was discovered in.
+func (t *Target) Source() string {
+	return t.source
 }
 
 type Profiler interface {
 	Labels() model.LabelSet
 	LastProfileTakenAt() time.Time
+	LastProfileSize() (samples int64, size int)
 	LastError() error
 	Stop()
 }
 
+// ActiveTarget is a target that is being profiled.
+type ActiveTarget struct {
+	*Target
+	Profiler Profiler
+}
+
 type ProfilerPool struct {
 	ctx               context.Context
 	mtx               *sync.RWMutex
 	activeTargets     map[uint64]*Target
 	activeProfilers   map[uint64]Profiler
+	droppedTargets    []*Target
 	externalLabels    model.LabelSet
 	logger            log.Logger
-	reg               prometheus.Registerer
+	metrics           *profiler.Metrics
 	ksymCache         *ksym.Cache
 	objCache          objectfile.Cache
 	writeClient       profilestorepb.ProfileStoreServiceClient
 	debugInfoClient   debuginfo.Client
 	profilingDuration time.Duration
 	tmp               string
+	trackOnly         bool
+
+	relabelConfigs []*relabel.Config
+	// sampling selects the targets to profile, all are profiled if nil.
+	sampling          *SamplingConfig
+	sampledOutTargets []*Target
+	// lastGroups are the target groups of the last sync, to sync them again
+	// when the relabel configurations change.
+	lastGroups []*Group
 }
 
 func NewProfilerPool(
 	ctx context.Context,
 	logger log.Logger,
-	reg prometheus.Registerer,
+	metrics *profiler.Metrics,
 	ksymCache *ksym.Cache,
 	objCache objectfile.Cache,
 	writeClient profilestorepb.ProfileStoreServiceClient,
@@ -70,6 +132,9 @@ func NewProfilerPool(
 	profilingDuration time.Duration,
 	externalLabels model.LabelSet,
 	tmp string,
+	trackOnly bool,
+	relabelConfigs []*relabel.Config,
+	sampling *SamplingConfig,
 ) *ProfilerPool {
 	return &ProfilerPool{
 		ctx:               ctx,
@@ -78,13 +143,16 @@ func NewProfilerPool(
 		activeProfilers:   map[uint64]Profiler{},
 		externalLabels:    externalLabels,
 		logger:            logger,
-		reg:               reg,
+		metrics:           metrics,
 		ksymCache:         ksymCache,
 		objCache:          objCache,
 		writeClient:       writeClient,
 		debugInfoClient:   debugInfoClient,
 		profilingDuration: profilingDuration,
 		tmp:               tmp,
+		trackOnly:         trackOnly,
+		relabelConfigs:    relabelConfigs,
+		sampling:          sampling,
 	}
 }
 
@@ -99,26 +167,123 @@ func (pp *ProfilerPool) Profilers() []Profiler {
 	return res
 }
 
+// ActiveTargets returns the targets that are being profiled.
+func (pp *ProfilerPool) ActiveTargets() []ActiveTarget {
+	pp.mtx.RLock()
+	defer pp.mtx.RUnlock()
+
+	res := make([]ActiveTarget, 0, len(pp.activeTargets))
+	for h, target := range pp.activeTargets {
+		res = append(res, ActiveTarget{Target: target, Profiler: pp.activeProfilers[h]})
+	}
+	return res
+}
+
+// DroppedTargets returns the targets of the last sync that are not profiled.
+func (pp *ProfilerPool) DroppedTargets() []*Target {
+	pp.mtx.RLock()
+	defer pp.mtx.RUnlock()
+
+	res := make([]*Target, len(pp.droppedTargets))
+	copy(res, pp.droppedTargets)
+	return res
+}
+
+// SampledOutTargets returns the targets of the last sync that are not
+// profiled because they are not part of the sample.
+func (pp *ProfilerPool) SampledOutTargets() []*Target {
+	pp.mtx.RLock()
+	defer pp.mtx.RUnlock()
+
+	res := make([]*Target, len(pp.sampledOutTargets))
+	copy(res, pp.sampledOutTargets)
+	return res
+}
+
+// ApplyConfig replaces the configuration of the pool and syncs the targets of
+// the last sync with it. Profilers of targets whose labels do not change keep
+// running, unless the profiling duration changed.
+func (pp *ProfilerPool) ApplyConfig(
+	profilingDuration time.Duration,
+	externalLabels model.LabelSet,
+	relabelConfigs []*relabel.Config,
+	sampling *SamplingConfig,
+) {
+	pp.mtx.Lock()
+	defer pp.mtx.Unlock()
+
+	if profilingDuration != pp.profilingDuration {
+		pp.stop()
+	}
+	pp.profilingDuration = profilingDuration
+	pp.externalLabels = externalLabels
+	pp.relabelConfigs = relabelConfigs
+	pp.sampling = sampling
+	pp.sync(pp.lastGroups)
+}
+
+// Stop stops the profilers of all targets of the pool.
+func (pp *ProfilerPool) Stop() {
+	pp.mtx.Lock()
+	defer pp.mtx.Unlock()
+
+	pp.stop()
+	pp.lastGroups = nil
+	pp.droppedTargets = nil
+	pp.sampledOutTargets = nil
+}
+
+func (pp *ProfilerPool) stop() {
+	for h := range pp.activeTargets {
+		if p, ok := pp.activeProfilers[h]; ok {
+			p.Stop()
+		}
+		delete(pp.activeTargets, h)
+		delete(pp.activeProfilers, h)
+	}
+}
+
 func (pp *ProfilerPool) Sync(tg []*Group) {
 	pp.mtx.Lock()
 	defer pp.mtx.Unlock()
 
+	pp.sync(tg)
+}
+
+func (pp *ProfilerPool) sync(tg []*Group) {
+	pp.lastGroups = tg
 	newTargets := map[uint64]*Target{}
+	pp.droppedTargets = pp.droppedTargets[:0]
+	pp.sampledOutTargets = pp.sampledOutTargets[:0]
 
 	for _, newTargetGroup := range tg {
 		for _, t := range newTargetGroup.Targets {
-			target := &Target{labelSet: model.LabelSet{}}
+			discoveredLabels := model.LabelSet{}
 
 			for labelName, labelValue := range t {
-				target.labelSet[labelName] = labelValue
+				discoveredLabels[labelName] = labelValue
 			}
 
 			for labelName, labelValue := range newTargetGroup.Labels {
-				target.labelSet[labelName] = labelValue
+				discoveredLabels[labelName] = labelValue
+			}
+
+			labelSet := relabelTarget(discoveredLabels, pp.relabelConfigs)
+
+			// Targets without a cgroup or process cannot be profiled.
+			if labelSet == nil || (labelSet[agent.CgroupPathLabelName] == "" && labelSet[agent.PIDLabelName] == "") {
+				pp.droppedTargets = append(pp.droppedTargets, NewTarget(nil, discoveredLabels, newTargetGroup.Source))
+				continue
 			}
 
+			sampled := pp.sampling.sampled(labelSet)
 			for labelName, labelValue := range pp.externalLabels {
-				target.labelSet[labelName] = labelValue
+				labelSet[labelName] = labelValue
+			}
+			target := NewTarget(labelSet, discoveredLabels, newTargetGroup.Source)
+			if !sampled {
+				pp.sampledOutTargets = append(pp.sampledOutTargets, target)
+				continue
 			}
 
 			h := labelsetToLabels(target.labelSet).Hash()
@@ -131,9 +296,14 @@ func (pp *ProfilerPool) Sync(tg []*Group) {
 		h := labelsetToLabels(newTarget.labelSet).Hash()
 
 		if _, found := pp.activeTargets[h]; !found {
+			pp.activeTargets[h] = newTarget
+			if pp.trackOnly {
+				continue
+			}
+
 			newProfiler := profiler.NewCgroupProfiler(
 				pp.logger,
-				pp.reg,
+				pp.metrics,
 				pp.ksymCache,
 				pp.objCache,
 				pp.writeClient,
@@ -148,14 +318,17 @@ func (pp *ProfilerPool) Sync(tg []*Group) {
 				level.Debug(pp.logger).Log("msg", "profiler ended with error", "error", err, "labels", newProfiler.Labels().String())
 			}()
 
-			pp.activeTargets[h] = newTarget
 			pp.activeProfilers[h] = newProfiler
 		}
 	}
 
-	// delete profiles no longer active
+	// Stop and delete profilers of targets no longer active, which also
+	// unregisters their per-target metrics.
 	for h := range pp.activeTargets {
 		if _, found := newTargets[h]; !found {
+			if p, ok := pp.activeProfilers[h]; ok {
+				p.Stop()
+			}
 			delete(pp.activeTargets, h)
 			delete(pp.activeProfilers, h)
 		}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// relabelFile is the format of the file read by LoadRelabelConfigs.
+type relabelFile struct {
+	RelabelConfigs map[string][]*relabel.Config `yaml:"relabel_configs"`
+}
+
+// LoadRelabelConfigs reads and validates the relabel configurations in the
+// YAML file at filename, by the name of the discovery configuration they
+// apply to.
+func LoadRelabelConfigs(filename string) (map[string][]*relabel.Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read relabel config: %w", err)
+	}
+
+	f := relabelFile{}
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("parse relabel config %s: %w", filename, err)
+	}
+	for name, cfgs := range f.RelabelConfigs {
+		for i, cfg := range cfgs {
+			if cfg == nil {
+				return nil, fmt.Errorf("empty relabel config %d of %q", i, name)
+			}
+		}
+	}
+	return f.RelabelConfigs, nil
+}
+
+// relabelTarget applies the relabel configurations to the labels of a
+// discovered target. It returns nil if the target is dropped. The meta labels
+// set by the discovery mechanism are removed from the result.
+func relabelTarget(discoveredLabels model.LabelSet, cfgs []*relabel.Config) model.LabelSet {
+	lset := relabel.Process(labelsetToLabels(discoveredLabels), cfgs...)
+	if lset == nil {
+		return nil
+	}
+
+	res := make(model.LabelSet, len(lset))
+	for _, l := range lset {
+		if strings.HasPrefix(l.Name, model.MetaLabelPrefix) {
+			continue
+		}
+		res[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return res
+}
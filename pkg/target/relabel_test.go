@@ -0,0 +1,95 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+func TestLoadRelabelConfigs(t *testing.T) {
+	cfgs, err := LoadRelabelConfigs("testdata/relabel.yaml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(cfgs["pod"]))
+	require.Equal(t, relabel.Drop, cfgs["pod"][0].Action)
+	require.Equal(t, relabel.LabelMap, cfgs["pod"][1].Action)
+	require.Equal(t, 1, len(cfgs["systemd"]))
+	require.Equal(t, relabel.Replace, cfgs["systemd"][0].Action)
+}
+
+func TestProfilerPoolRelabel(t *testing.T) {
+	cfgs, err := LoadRelabelConfigs("testdata/relabel.yaml")
+	require.NoError(t, err)
+
+	pp := NewProfilerPool(
+		context.Background(), log.NewNopLogger(), profiler.NewMetrics(prometheus.NewRegistry()),
+		nil, nil, nil, nil, 0,
+		model.LabelSet{"node": "a"},
+		"", true,
+		cfgs["pod"],
+		nil,
+	)
+
+	groups := []*Group{{
+		Targets: []model.LabelSet{
+			{"__cgroup_path__": "/sys/fs/cgroup/web", "container": "web", "__meta_kubernetes_pod_label_app": "shop"},
+			{"__cgroup_path__": "/sys/fs/cgroup/db", "container": "db"},
+		},
+		Labels: model.LabelSet{"namespace": "default"},
+		Source: "pod/default/web",
+	}, {
+		Targets: []model.LabelSet{{"__cgroup_path__": "/sys/fs/cgroup/dns", "container": "coredns"}},
+		Labels:  model.LabelSet{"namespace": "kube-system"},
+		Source:  "pod/kube-system/coredns",
+	}}
+	pp.Sync(groups)
+
+	active := activeLabels(pp)
+	require.Equal(t, []string{
+		`{app="shop", container="web", namespace="default", node="a"}`,
+		`{container="db", namespace="default", node="a"}`,
+	}, active)
+
+	dropped := pp.DroppedTargets()
+	require.Equal(t, 1, len(dropped))
+	require.Equal(t, model.LabelValue("kube-system"), dropped[0].DiscoveredLabels()["namespace"])
+	require.Equal(t, model.LabelValue("/sys/fs/cgroup/dns"), dropped[0].DiscoveredLabels()["__cgroup_path__"])
+
+	// New relabel configurations apply to the targets of the last sync.
+	pp.ApplyConfig(0, model.LabelSet{"node": "a"}, []*relabel.Config{{
+		SourceLabels: model.LabelNames{"container"},
+		Regex:        relabel.MustNewRegexp("db"),
+		Action:       relabel.Keep,
+	}}, nil)
+	require.Equal(t, []string{`{container="db", namespace="default", node="a"}`}, activeLabels(pp))
+	require.Equal(t, 2, len(pp.DroppedTargets()))
+}
+
+func activeLabels(pp *ProfilerPool) []string {
+	var res []string
+	for _, t := range pp.ActiveTargets() {
+		res = append(res, t.Labels().String())
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// DefaultSamplingConfig profiles all targets.
+var DefaultSamplingConfig = SamplingConfig{
+	Ratio: 1,
+}
+
+// defaultSamplingLabels are the labels of targets hashed if none are
+// configured. They identify the workload, container, unit or executable of a
+// target rather than its pod or process, so that the replicas of a workload
+// are in or out of the sample together, and stay so when they are replaced.
+var defaultSamplingLabels = []string{"namespace", "workload_kind", "workload_name", "container", "systemd_unit", "executable"}
+
+// SamplingConfig selects a stable subset of the targets to profile. Whether a
+// target is sampled only depends on the values of the hashed labels, so the
+// same workload is in or out of the sample across restarts and nodes.
+type SamplingConfig struct {
+	// Ratio is the share of the targets to profile, between 0 and 1.
+	Ratio float64 `yaml:"ratio"`
+	// Labels are the labels of the targets to hash. The labels identifying
+	// the workload of a target are hashed if empty.
+	Labels []string `yaml:"labels,omitempty"`
+	// NamespaceRatios override the ratio for the targets with the given
+	// values of the namespace label.
+	NamespaceRatios map[string]float64 `yaml:"namespace_ratios,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *SamplingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultSamplingConfig
+	type plain SamplingConfig
+	return unmarshal((*plain)(c))
+}
+
+// Validate makes sure the ratios are between 0 and 1 and the label names are
+// valid.
+func (c *SamplingConfig) Validate() error {
+	if c.Ratio < 0 || c.Ratio > 1 {
+		return fmt.Errorf("sampling ratio %v must be between 0 and 1", c.Ratio)
+	}
+	for _, name := range c.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid sampling label name %q", name)
+		}
+	}
+	for namespace, ratio := range c.NamespaceRatios {
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("sampling ratio %v of namespace %q must be between 0 and 1", ratio, namespace)
+		}
+	}
+	return nil
+}
+
+// sampled reports whether the target with the given labels, before the
+// external labels are added, is profiled.
+func (c *SamplingConfig) sampled(labelSet model.LabelSet) bool {
+	if c == nil {
+		return true
+	}
+
+	ratio := c.Ratio
+	if r, ok := c.NamespaceRatios[string(labelSet["namespace"])]; ok {
+		ratio = r
+	}
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+
+	names := c.Labels
+	if len(names) == 0 {
+		names = defaultSamplingLabels
+	}
+	ls := make(labels.Labels, 0, len(names))
+	for _, name := range names {
+		ls = append(ls, labels.Label{Name: name, Value: string(labelSet[model.LabelName(name)])})
+	}
+
+	// The hash of the labels does not depend on their order, and is the same
+	// in every process.
+	return float64(labels.New(ls...).Hash()) < ratio*math.MaxUint64
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profiler"
+)
+
+func TestSamplingConfigSampled(t *testing.T) {
+	c := &SamplingConfig{Ratio: 0.3}
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if c.sampled(model.LabelSet{"workload_name": model.LabelValue(fmt.Sprintf("web-%d", i))}) {
+			sampled++
+		}
+	}
+	require.InDelta(t, 300, sampled, 50)
+
+	// Only the hashed labels select the targets.
+	c = &SamplingConfig{Ratio: 0.5, Labels: []string{"namespace", "deployment"}}
+	for i := 0; i < 100; i++ {
+		ls := model.LabelSet{"namespace": "shop", "deployment": model.LabelValue(fmt.Sprintf("web-%d", i))}
+		expected := c.sampled(ls)
+		ls["pod"] = model.LabelValue(fmt.Sprintf("web-%d-abcde", i))
+		ls["__cgroup_path__"] = "/sys/fs/cgroup/a"
+		require.Equal(t, expected, c.sampled(ls))
+	}
+
+	// The pods of a Deployment are in or out of the sample together, across
+	// restarts and nodes.
+	c = &SamplingConfig{Ratio: 0.5}
+	for i := 0; i < 100; i++ {
+		workload := model.LabelSet{
+			"namespace":     "shop",
+			"workload_kind": "Deployment",
+			"workload_name": model.LabelValue(fmt.Sprintf("web-%d", i)),
+			"container":     "app",
+		}
+		pod1 := workload.Merge(model.LabelSet{"pod": model.LabelValue(fmt.Sprintf("web-%d-6d4cf56db6-x7z2k", i)), "containerid": "containerd://abc", "node": "a"})
+		pod2 := workload.Merge(model.LabelSet{"pod": model.LabelValue(fmt.Sprintf("web-%d-7f8b9c5d4-q2w3e", i)), "containerid": "containerd://def", "node": "b"})
+		require.Equal(t, c.sampled(pod1), c.sampled(pod2))
+	}
+
+	c = &SamplingConfig{Ratio: 0, NamespaceRatios: map[string]float64{"prod": 1}}
+	require.True(t, c.sampled(model.LabelSet{"namespace": "prod", "pod": "web"}))
+	require.False(t, c.sampled(model.LabelSet{"namespace": "dev", "pod": "web"}))
+
+	require.True(t, (*SamplingConfig)(nil).sampled(model.LabelSet{"pod": "web"}))
+	require.Error(t, (&SamplingConfig{Ratio: 1.5}).Validate())
+	require.Error(t, (&SamplingConfig{Ratio: 1, NamespaceRatios: map[string]float64{"a": -1}}).Validate())
+}
+
+func TestProfilerPoolSampling(t *testing.T) {
+	pp := NewProfilerPool(
+		context.Background(), log.NewNopLogger(), profiler.NewMetrics(prometheus.NewRegistry()),
+		nil, nil, nil, nil, 0,
+		model.LabelSet{"node": "a"},
+		"", true,
+		nil,
+		&SamplingConfig{Ratio: 1, NamespaceRatios: map[string]float64{"kube-system": 0}},
+	)
+
+	pp.Sync([]*Group{{
+		Targets: []model.LabelSet{
+			{"__cgroup_path__": "/sys/fs/cgroup/web", "namespace": "default", "container": "web"},
+			{"__cgroup_path__": "/sys/fs/cgroup/dns", "namespace": "kube-system", "container": "coredns"},
+		},
+		Source: "pod",
+	}})
+
+	require.Equal(t, []string{`{container="web", namespace="default", node="a"}`}, activeLabels(pp))
+	sampledOut := pp.SampledOutTargets()
+	require.Equal(t, 1, len(sampledOut))
+	require.Equal(t, `{container="coredns", namespace="kube-system", node="a"}`, sampledOut[0].Labels().String())
+	require.Empty(t, pp.DroppedTargets())
+}
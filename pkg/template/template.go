@@ -26,11 +26,6 @@ var StatusPageTemplateBytes []byte
 
 var StatusPageTemplate = template.Must(template.New("statuspage").Parse(string(StatusPageTemplateBytes)))
 
-//go:embed profileview.html
-var ProfileViewTemplateBytes []byte
-
-var ProfileViewTemplate = template.Must(template.New("profileview").Parse(string(ProfileViewTemplateBytes)))
-
 type ActiveProfiler struct {
 	Type         string
 	Labels       labels.Labels
@@ -39,6 +34,23 @@ type ActiveProfiler struct {
 	Link         string
 }
 
+// SampledOutTarget is a discovered target that is not profiled because it is
+// not part of the sample.
+type SampledOutTarget struct {
+	DiscoveryConfig string
+	Labels          labels.Labels
+}
+
+// FailedTarget is a discovered target that is not profiled because its
+// cgroup or process could not be looked up.
+type FailedTarget struct {
+	DiscoveryConfig string
+	Labels          labels.Labels
+	Error           string
+}
+
 type StatusPage struct {
-	ActiveProfilers []ActiveProfiler
+	ActiveProfilers   []ActiveProfiler
+	SampledOutTargets []SampledOutTarget
+	FailedTargets     []FailedTarget
 }
@@ -43,6 +43,21 @@ func TestStatusPageTemplate(t *testing.T) {
 			Error:        errors.New("test"),
 			Link:         "/test123",
 		}},
+		SampledOutTargets: []SampledOutTarget{{
+			DiscoveryConfig: "pod",
+			Labels: []labels.Label{{
+				Name:  "name3",
+				Value: "value3",
+			}},
+		}},
+		FailedTargets: []FailedTarget{{
+			DiscoveryConfig: "pod",
+			Labels: []labels.Label{{
+				Name:  "name4",
+				Value: "value4",
+			}},
+			Error: "find pid: not found",
+		}},
 	})
 	require.NoError(t, err)
 